@@ -2,75 +2,157 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"crypto/tls"
+	"embed"
+	"flag"
 	"fmt"
 	"github.com/alexmarian/httpfromtcp/internal/headers"
+	"github.com/alexmarian/httpfromtcp/internal/proxy"
 	"github.com/alexmarian/httpfromtcp/internal/request"
 	"github.com/alexmarian/httpfromtcp/internal/response"
 	"github.com/alexmarian/httpfromtcp/internal/server"
+	"github.com/alexmarian/httpfromtcp/internal/templates"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 )
 
 const port = 42069
 
+const shutdownTimeout = 10 * time.Second
+
+//go:embed html
+var embeddedPages embed.FS
+
+var pages *templates.Templates
+
+var static *response.Assets
+
 func main() {
-	server, err := server.Serve(port, handler)
+	pagesDir := flag.String("html", "", "load pages and static/ files from this directory instead of the embedded copy and reload them on change")
+	forwardProxy := flag.Bool("proxy", false, "also act as a forward proxy for CONNECT and absolute-form requests to public addresses")
+	h2c := flag.Bool("h2c", false, "also serve HTTP/2 over cleartext, by prior knowledge or Upgrade: h2c")
+	certFile := flag.String("cert", "", "serve TLS with this PEM certificate, negotiating HTTP/2 through ALPN (needs -key)")
+	keyFile := flag.String("key", "", "PEM private key for -cert")
+	flag.Parse()
+	var html fs.FS
+	var err error
+	if *pagesDir != "" {
+		html = os.DirFS(*pagesDir)
+		pages, err = templates.New(html, templates.WithDevMode())
+	} else {
+		html, err = fs.Sub(embeddedPages, "html")
+		if err == nil {
+			pages, err = templates.New(html)
+		}
+	}
+	if err != nil {
+		log.Fatalf("Error loading pages: %v", err)
+	}
+	staticFS, err := fs.Sub(html, "static")
+	if err != nil {
+		log.Fatalf("Error loading static files: %v", err)
+	}
+	static = response.NewAssets(staticFS)
+	if *pagesDir == "" {
+		if err := static.Precompute(); err != nil {
+			log.Fatalf("Error loading static files: %v", err)
+		}
+	}
+
+	mux := server.NewMux()
+	mux.Handle("GET", "/httpbin/", handleProxy)
+	mux.Handle("GET", "/yourproblem", handleYourProblem)
+	mux.Handle("GET", "/myproblem", handleMyProblem)
+	mux.Handle("GET", "/video", handleVideo)
+	mux.Handle("GET", "/static/", handleStatic)
+	mux.Handle("GET", "/", handleSuccess)
+	handler := mux.Serve
+	if *forwardProxy {
+		handler = proxy.New(proxy.WithDeniedHosts(proxy.PrivateNetworks...)).Middleware(handler)
+	}
+	opts := []server.Option{server.WithTrace()}
+	if *h2c {
+		opts = append(opts, server.WithH2C())
+	}
+	if *certFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			log.Fatalf("Error loading certificate: %v", err)
+		}
+		opts = append(opts, server.WithTLS(&tls.Config{Certificates: []tls.Certificate{cert}}))
+	}
+	server, err := server.Serve(port, handler, opts...)
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer server.Close()
 	log.Println("Server started on port", port)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Error shutting down:", err)
+	}
 	log.Println("Server gracefully stopped")
 }
 
-func handler(w *response.Writer, req *request.Request) *response.HandlerError {
-	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/") {
-		handlerError := handleProxy(w, req)
-		if handlerError != nil {
-			return handlerError
-		}
-	} else {
-		switch req.RequestLine.RequestTarget {
-		case "/yourproblem":
-			return &response.HandlerError{
-				StatusCode: response.BAD_REQUEST,
-				Message:    "Your problem is not my problem",
-			}
-		case "/myproblem":
-			return &response.HandlerError{
-				StatusCode: response.INTERNAL_SERVER_ERROR,
-				Message:    "Woopsie, my bad",
-			}
-		case "/video":
-			w.WriteFile("assets/vim.mp4", "video/mp4", response.SUCCESS)
+func handleYourProblem(w *response.Writer, req *request.Request) *response.HandlerError {
+	return &response.HandlerError{
+		StatusCode: response.BAD_REQUEST,
+		Message:    "Your problem is not my problem",
+	}
+}
 
-		default:
-			w.WriteFile("html/success.html", "text/html", response.SUCCESS)
-		}
+func handleMyProblem(w *response.Writer, req *request.Request) *response.HandlerError {
+	return &response.HandlerError{
+		StatusCode: response.INTERNAL_SERVER_ERROR,
+		Message:    "Woopsie, my bad",
 	}
-	return nil
+}
+
+func handleVideo(w *response.Writer, req *request.Request) *response.HandlerError {
+	_, hErr := w.WriteFile("assets/vim.mp4", "video/mp4", response.SUCCESS)
+	return hErr
+}
+
+func handleStatic(w *response.Writer, req *request.Request) *response.HandlerError {
+	name, _, _ := strings.Cut(strings.TrimPrefix(req.RequestLine.RequestTarget, "/static/"), "?")
+	return static.Write(w, req, name)
+}
+
+func handleSuccess(w *response.Writer, req *request.Request) *response.HandlerError {
+	return pages.Render(w, req, response.SUCCESS, "success.html", nil)
 }
 
 func handleProxy(w *response.Writer, req *request.Request) *response.HandlerError {
 	location := "https://httpbin.org/" + strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin/")
-	resp, err := http.Get(location)
-	defer resp.Body.Close()
+	// the upstream request is abandoned as soon as the client goes away
+	upstream, err := http.NewRequestWithContext(req.Context(), http.MethodGet, location, nil)
+	if err != nil {
+		return &response.HandlerError{
+			StatusCode: response.BAD_REQUEST,
+			Message:    "Invalid httpbin path",
+		}
+	}
+	resp, err := http.DefaultClient.Do(upstream)
 	if err != nil {
 		return &response.HandlerError{
 			StatusCode: response.INTERNAL_SERVER_ERROR,
 			Message:    "Error fetching data from httpbin",
 		}
 	}
+	defer resp.Body.Close()
 	w.WriteStatusLine(response.SUCCESS)
 	hs := headers.NewHeaders()
 	hs.Set(headers.ContentTypeHeader, resp.Header.Get(headers.ContentTypeHeader))
@@ -102,6 +184,13 @@ func handleProxy(w *response.Writer, req *request.Request) *response.HandlerErro
 			w.WriteTrailers(trailers)
 			return nil
 		}
+		if err != nil {
+			// a started response ending in an error drops the connection
+			// instead of closing the chunked body as if it were complete
+			return &response.HandlerError{
+				StatusCode: response.BAD_GATEWAY,
+				Message:    fmt.Sprintf("Error reading proxied body: %v", err),
+			}
+		}
 	}
-	return nil
 }
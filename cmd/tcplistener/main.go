@@ -31,7 +31,8 @@ func main() {
 		fmt.Printf("- Target: %s\n", req.RequestLine.RequestTarget)
 		fmt.Printf("- Version: %s\n", req.RequestLine.HttpVersion)
 		fmt.Println("Headers:")
-		for name, value := range req.Headers {
+		for name := range req.Headers {
+			value, _ := req.Headers.Get(name)
 			fmt.Printf("- %s: %s\n", name, value)
 		}
 		fmt.Println("Body:")
@@ -0,0 +1,196 @@
+package cookies
+
+import (
+	"errors"
+	"fmt"
+	"github.com/alexmarian/httpfromtcp/internal/headers"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SameSite int
+
+const (
+	// SameSiteDefault omits the attribute and leaves the choice to the browser.
+	SameSiteDefault SameSite = iota
+	SameSiteLax
+	SameSiteStrict
+	SameSiteNone
+)
+
+// Cookie is a single name/value pair with the attributes of RFC 6265bis used
+// when building a Set-Cookie line. Request cookies only carry Name and Value.
+type Cookie struct {
+	Name  string
+	Value string
+
+	Path    string
+	Domain  string
+	Expires time.Time
+	// MaxAge is omitted when 0; a negative value expires the cookie at once.
+	MaxAge      int
+	Secure      bool
+	HttpOnly    bool
+	SameSite    SameSite
+	Partitioned bool
+}
+
+var (
+	ErrInvalidName      = errors.New("invalid cookie name")
+	ErrInvalidValue     = errors.New("invalid cookie value")
+	ErrInvalidAttribute = errors.New("invalid cookie attribute")
+)
+
+const expiresLayout = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// Parse parses the value of a Cookie header. Malformed pairs are skipped, as
+// user agents are expected to recover from them.
+func Parse(value string) []Cookie {
+	var cookies []Cookie
+	for _, pair := range strings.Split(value, ";") {
+		name, val, found := strings.Cut(strings.Trim(pair, " \t"), "=")
+		if !found || !headers.IsToken(name) {
+			continue
+		}
+		val = strings.Trim(val, " \t")
+		if !isValidValue(val) {
+			continue
+		}
+		cookies = append(cookies, Cookie{
+			Name:  name,
+			Value: strings.TrimSuffix(strings.TrimPrefix(val, `"`), `"`),
+		})
+	}
+	return cookies
+}
+
+// FromHeaders returns the cookies sent in the Cookie header of a request.
+func FromHeaders(h headers.Headers) []Cookie {
+	value, present := h.Get(headers.CookieHeader)
+	if !present {
+		return nil
+	}
+	return Parse(value)
+}
+
+// Get returns the first request cookie called name.
+func Get(h headers.Headers, name string) (Cookie, bool) {
+	for _, c := range FromHeaders(h) {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return Cookie{}, false
+}
+
+// SetCookie validates c and adds it to h as its own Set-Cookie line.
+func SetCookie(h headers.Headers, c *Cookie) error {
+	if err := c.Valid(); err != nil {
+		return err
+	}
+	h.Add(headers.SetCookieHeader, c.String())
+	return nil
+}
+
+// Valid reports whether c can be serialized into a well-formed Set-Cookie line.
+func (c *Cookie) Valid() error {
+	if !headers.IsToken(c.Name) {
+		return fmt.Errorf("%w: %q", ErrInvalidName, c.Name)
+	}
+	if !isValidValue(c.Value) {
+		return fmt.Errorf("%w: %q", ErrInvalidValue, c.Value)
+	}
+	if !isValidAttributeValue(c.Path) {
+		return fmt.Errorf("%w: path %q", ErrInvalidAttribute, c.Path)
+	}
+	if !isValidDomain(c.Domain) {
+		return fmt.Errorf("%w: domain %q", ErrInvalidAttribute, c.Domain)
+	}
+	if c.SameSite == SameSiteNone && !c.Secure {
+		return fmt.Errorf("%w: SameSite=None requires Secure", ErrInvalidAttribute)
+	}
+	if c.Partitioned && !c.Secure {
+		return fmt.Errorf("%w: Partitioned requires Secure", ErrInvalidAttribute)
+	}
+	return nil
+}
+
+// String serializes c as a Set-Cookie value without validating it.
+func (c *Cookie) String() string {
+	b := strings.Builder{}
+	b.WriteString(c.Name)
+	b.WriteString("=")
+	b.WriteString(c.Value)
+	if c.Path != "" {
+		b.WriteString("; Path=" + c.Path)
+	}
+	if c.Domain != "" {
+		b.WriteString("; Domain=" + strings.TrimPrefix(c.Domain, "."))
+	}
+	if !c.Expires.IsZero() {
+		b.WriteString("; Expires=" + c.Expires.UTC().Format(expiresLayout))
+	}
+	if c.MaxAge > 0 {
+		b.WriteString("; Max-Age=" + strconv.Itoa(c.MaxAge))
+	} else if c.MaxAge < 0 {
+		b.WriteString("; Max-Age=0")
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	switch c.SameSite {
+	case SameSiteLax:
+		b.WriteString("; SameSite=Lax")
+	case SameSiteStrict:
+		b.WriteString("; SameSite=Strict")
+	case SameSiteNone:
+		b.WriteString("; SameSite=None")
+	}
+	if c.Partitioned {
+		b.WriteString("; Partitioned")
+	}
+	return b.String()
+}
+
+// isValidValue checks cookie-value: *cookie-octet, optionally wrapped in double
+// quotes.
+func isValidValue(value string) bool {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	for i := 0; i < len(value); i++ {
+		if !isCookieOctet(value[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isCookieOctet(c byte) bool {
+	return c == 0x21 || (c >= 0x23 && c <= 0x2b) || (c >= 0x2d && c <= 0x3a) ||
+		(c >= 0x3c && c <= 0x5b) || (c >= 0x5d && c <= 0x7e)
+}
+
+func isValidAttributeValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] < 0x20 || value[i] == 0x7f || value[i] == ';' {
+			return false
+		}
+	}
+	return true
+}
+
+func isValidDomain(domain string) bool {
+	domain = strings.TrimPrefix(domain, ".")
+	for i := 0; i < len(domain); i++ {
+		c := domain[i]
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
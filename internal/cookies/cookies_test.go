@@ -0,0 +1,82 @@
+package cookies
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexmarian/httpfromtcp/internal/headers"
+	"github.com/alexmarian/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	// Test: Several pairs with quoting and odd spacing
+	cookies := Parse(`session=abc123;  theme="dark" ;lang=en-US`)
+	require.Len(t, cookies, 3)
+	assert.Equal(t, Cookie{Name: "session", Value: "abc123"}, cookies[0])
+	assert.Equal(t, Cookie{Name: "theme", Value: "dark"}, cookies[1])
+	assert.Equal(t, Cookie{Name: "lang", Value: "en-US"}, cookies[2])
+
+	// Test: Malformed pairs are skipped
+	cookies = Parse(`novalue; bad name=x; ok=1; semi=a,b; empty=`)
+	require.Len(t, cookies, 2)
+	assert.Equal(t, "ok", cookies[0].Name)
+	assert.Equal(t, "empty", cookies[1].Name)
+	assert.Equal(t, "", cookies[1].Value)
+
+	// Test: Lookup from request headers
+	h := headers.NewHeaders()
+	h.Set(headers.CookieHeader, "a=1; b=2")
+	c, ok := Get(h, "b")
+	require.True(t, ok)
+	assert.Equal(t, "2", c.Value)
+	_, ok = Get(h, "c")
+	assert.False(t, ok)
+}
+
+func TestSetCookie(t *testing.T) {
+	// Test: Every attribute
+	c := &Cookie{
+		Name:        "session",
+		Value:       "abc123",
+		Path:        "/",
+		Domain:      ".example.com",
+		Expires:     time.Date(2030, time.January, 2, 3, 4, 5, 0, time.UTC),
+		MaxAge:      3600,
+		Secure:      true,
+		HttpOnly:    true,
+		SameSite:    SameSiteNone,
+		Partitioned: true,
+	}
+	assert.Equal(t, "session=abc123; Path=/; Domain=example.com; Expires=Wed, 02 Jan 2030 03:04:05 GMT; "+
+		"Max-Age=3600; Secure; HttpOnly; SameSite=None; Partitioned", c.String())
+
+	// Test: Deletion
+	c = &Cookie{Name: "session", MaxAge: -1, SameSite: SameSiteLax}
+	assert.Equal(t, "session=; Max-Age=0; SameSite=Lax", c.String())
+
+	// Test: Invalid cookies
+	assert.ErrorIs(t, (&Cookie{Name: "bad name"}).Valid(), ErrInvalidName)
+	assert.ErrorIs(t, (&Cookie{Name: "a", Value: "x;y"}).Valid(), ErrInvalidValue)
+	assert.ErrorIs(t, (&Cookie{Name: "a", Path: "/\r\nX-Injected: 1"}).Valid(), ErrInvalidAttribute)
+	assert.ErrorIs(t, (&Cookie{Name: "a", SameSite: SameSiteNone}).Valid(), ErrInvalidAttribute)
+	assert.ErrorIs(t, (&Cookie{Name: "a", Partitioned: true}).Valid(), ErrInvalidAttribute)
+	require.Error(t, SetCookie(headers.NewHeaders(), &Cookie{Name: ""}))
+
+	// Test: Each cookie is written on its own line
+	h := response.GetDefaultHeaders(0)
+	require.NoError(t, SetCookie(h, &Cookie{Name: "a", Value: "1"}))
+	require.NoError(t, SetCookie(h, &Cookie{Name: "b", Value: "2", HttpOnly: true}))
+	assert.Equal(t, []string{"a=1", "b=2; HttpOnly"}, h.Values(headers.SetCookieHeader))
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(response.SUCCESS))
+	require.NoError(t, w.WriteHeaders(h))
+	out := buf.String()
+	assert.Contains(t, out, "set-cookie: a=1\r\n")
+	assert.Contains(t, out, "set-cookie: b=2; HttpOnly\r\n")
+	assert.Equal(t, 2, strings.Count(out, "set-cookie"))
+}
@@ -0,0 +1,383 @@
+package form
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/alexmarian/httpfromtcp/internal/headers"
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	URLEncodedType = "application/x-www-form-urlencoded"
+	MultipartType  = "multipart/form-data"
+)
+
+var (
+	ErrUnsupportedMediaType = errors.New("unsupported form media type")
+	ErrInvalidForm          = errors.New("invalid form body")
+	ErrTooManyParts         = errors.New("too many form parts")
+	ErrPartTooLarge         = errors.New("form part too large")
+	ErrFormTooLarge         = errors.New("form too large")
+)
+
+type config struct {
+	maxBytes    int64
+	maxMemory   int64
+	maxPartSize int64
+	maxParts    int
+	tempDir     string
+}
+
+type Option func(*config)
+
+// WithMaxBytes limits the size of the whole body. A larger body fails with
+// ErrFormTooLarge without being read past the limit. Defaults to 64 MiB.
+func WithMaxBytes(n int64) Option {
+	return func(c *config) {
+		c.maxBytes = n
+	}
+}
+
+// WithMaxMemory sets how many bytes of field values and file contents are kept
+// in memory across all parts. Files past it spill to temporary files, while
+// values past it fail with ErrFormTooLarge. Defaults to 10 MiB.
+func WithMaxMemory(n int64) Option {
+	return func(c *config) {
+		c.maxMemory = n
+	}
+}
+
+// WithMaxPartSize limits the size of a single value or file. Defaults to 32 MiB.
+func WithMaxPartSize(n int64) Option {
+	return func(c *config) {
+		c.maxPartSize = n
+	}
+}
+
+// WithMaxParts limits the number of fields and files. Defaults to 1000.
+func WithMaxParts(n int) Option {
+	return func(c *config) {
+		c.maxParts = n
+	}
+}
+
+// WithTempDir sets where spilled files are created. Defaults to os.TempDir.
+func WithTempDir(dir string) Option {
+	return func(c *config) {
+		c.tempDir = dir
+	}
+}
+
+// Form holds the fields and files of a parsed form body.
+type Form struct {
+	values map[string][]string
+	files  map[string][]*File
+}
+
+// File is an uploaded file, kept in memory or spilled to a temporary file.
+type File struct {
+	Filename    string
+	ContentType string
+	Header      headers.Headers
+	Size        int64
+	content     []byte
+	path        string
+}
+
+// Open returns a reader over the file contents. The caller must close it.
+func (f *File) Open() (io.ReadSeekCloser, error) {
+	if f.path != "" {
+		return os.Open(f.path)
+	}
+	return nopCloser{bytes.NewReader(f.content)}, nil
+}
+
+// Spilled reports whether the contents were written to a temporary file.
+func (f *File) Spilled() bool {
+	return f.path != ""
+}
+
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error { return nil }
+
+// Value returns the first value of the field name, or "".
+func (f *Form) Value(name string) string {
+	if values := f.values[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Values returns every value of the field name.
+func (f *Form) Values(name string) []string {
+	return f.values[name]
+}
+
+// File returns the first file uploaded as name.
+func (f *Form) File(name string) (*File, bool) {
+	if files := f.files[name]; len(files) > 0 {
+		return files[0], true
+	}
+	return nil, false
+}
+
+// Files returns every file uploaded as name.
+func (f *Form) Files(name string) []*File {
+	return f.files[name]
+}
+
+// RemoveAll deletes the temporary files of spilled uploads. Handlers should
+// defer it after a successful Parse.
+func (f *Form) RemoveAll() error {
+	var errs []error
+	for _, files := range f.files {
+		for _, file := range files {
+			if file.path == "" {
+				continue
+			}
+			if err := os.Remove(file.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+			file.path = ""
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func newForm() *Form {
+	return &Form{
+		values: make(map[string][]string),
+		files:  make(map[string][]*File),
+	}
+}
+
+func newConfig(opts []Option) config {
+	cfg := config{
+		maxBytes:    64 << 20,
+		maxMemory:   10 << 20,
+		maxPartSize: 32 << 20,
+		maxParts:    1000,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// Parse parses the body of req according to its Content-Type. A multipart
+// body is streamed into ParseMultipart, straight from the connection when it
+// was deferred by "Expect: 100-continue", and never read past WithMaxBytes; a
+// body read along with the request is bounded by request.WithMaxBodySize.
+func Parse(req *request.Request, opts ...Option) (*Form, error) {
+	contentType, _ := req.Headers.Get(headers.ContentTypeHeader)
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedMediaType, contentType)
+	}
+	if mediaType != URLEncodedType && mediaType != MultipartType {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedMediaType, mediaType)
+	}
+	cfg := newConfig(opts)
+	if mediaType == URLEncodedType {
+		body, err := req.ReadBodyLimit(min(cfg.maxBytes, cfg.maxMemory))
+		if err != nil {
+			return nil, formError(err)
+		}
+		return ParseURLEncoded(body, opts...)
+	}
+	body, err := req.BodyReader(cfg.maxBytes)
+	if err != nil {
+		return nil, formError(err)
+	}
+	f, err := ParseMultipart(body, params["boundary"], opts...)
+	if err == nil {
+		// whatever follows the closing boundary is read so the connection
+		// can carry another request
+		_, err = io.Copy(io.Discard, body)
+		if err != nil {
+			f.RemoveAll()
+		}
+	}
+	if err != nil {
+		return nil, formError(err)
+	}
+	return f, nil
+}
+
+// formError reports a body over the request's limit as ErrFormTooLarge.
+func formError(err error) error {
+	if errors.Is(err, request.ErrBodyTooLarge) {
+		return fmt.Errorf("%w: %w", ErrFormTooLarge, err)
+	}
+	return err
+}
+
+// ParseURLEncoded parses an application/x-www-form-urlencoded body.
+func ParseURLEncoded(body []byte, opts ...Option) (*Form, error) {
+	cfg := newConfig(opts)
+	if int64(len(body)) > min(cfg.maxBytes, cfg.maxMemory) {
+		return nil, ErrFormTooLarge
+	}
+	if strings.Count(string(body), "&")+1 > cfg.maxParts {
+		return nil, ErrTooManyParts
+	}
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidForm, err)
+	}
+	f := newForm()
+	for name, vs := range values {
+		for _, v := range vs {
+			if int64(len(v)) > cfg.maxPartSize {
+				return nil, fmt.Errorf("%w: %q", ErrPartTooLarge, name)
+			}
+		}
+		f.values[name] = vs
+	}
+	return f, nil
+}
+
+// ParseMultipart parses a multipart/form-data body part by part, so only the
+// part being read and the files below the memory threshold are held in memory.
+func ParseMultipart(r io.Reader, boundary string, opts ...Option) (*Form, error) {
+	if boundary == "" {
+		return nil, fmt.Errorf("%w: missing boundary", ErrInvalidForm)
+	}
+	cfg := newConfig(opts)
+	f := newForm()
+	mr := multipart.NewReader(&limitedReader{r: r, n: cfg.maxBytes}, boundary)
+	memory := cfg.maxMemory
+	for parts := 0; ; parts++ {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return f, nil
+		}
+		if err != nil {
+			f.RemoveAll()
+			return nil, fmt.Errorf("%w: %w", ErrInvalidForm, err)
+		}
+		if parts == cfg.maxParts {
+			f.RemoveAll()
+			return nil, ErrTooManyParts
+		}
+		if err := f.readPart(part, &cfg, &memory); err != nil {
+			f.RemoveAll()
+			return nil, err
+		}
+	}
+}
+
+func (f *Form) readPart(part *multipart.Part, cfg *config, memory *int64) error {
+	defer part.Close()
+	name := part.FormName()
+	if name == "" {
+		return nil
+	}
+	filename := part.FileName()
+	if filename == "" {
+		limit := min(cfg.maxPartSize, *memory)
+		value, err := readLimited(part, limit)
+		if errors.Is(err, ErrPartTooLarge) && limit < cfg.maxPartSize {
+			err = ErrFormTooLarge
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %q", err, name)
+		}
+		*memory -= int64(len(value))
+		f.values[name] = append(f.values[name], string(value))
+		return nil
+	}
+
+	file := &File{
+		Filename:    filename,
+		ContentType: part.Header.Get("Content-Type"),
+		Header:      headers.NewHeaders(),
+	}
+	for key, values := range part.Header {
+		for _, v := range values {
+			file.Header.Set(key, v)
+		}
+	}
+	// Keep the file in memory while it fits in what is left of the budget,
+	// then move what was read so far into a temporary file.
+	inMemory := min(*memory, cfg.maxPartSize)
+	content, err := readLimited(part, inMemory)
+	if err == nil {
+		file.content = content
+		file.Size = int64(len(content))
+		*memory -= file.Size
+	} else if errors.Is(err, ErrPartTooLarge) {
+		if err := spill(file, content, part, cfg); err != nil {
+			return fmt.Errorf("%w: %q", err, name)
+		}
+	} else {
+		return err
+	}
+	f.files[name] = append(f.files[name], file)
+	return nil
+}
+
+func spill(file *File, head []byte, rest io.Reader, cfg *config) error {
+	tmp, err := os.CreateTemp(cfg.tempDir, "form-*")
+	if err != nil {
+		return err
+	}
+	defer tmp.Close()
+	file.path = tmp.Name()
+	n, err := tmp.Write(head)
+	if err != nil {
+		os.Remove(file.path)
+		return err
+	}
+	m, err := io.Copy(tmp, io.LimitReader(rest, cfg.maxPartSize-int64(n)+1))
+	file.Size = int64(n) + m
+	if err == nil && file.Size > cfg.maxPartSize {
+		err = ErrPartTooLarge
+	}
+	if err != nil {
+		os.Remove(file.path)
+		file.path = ""
+	}
+	return err
+}
+
+// limitedReader fails with ErrFormTooLarge once r yields more than n bytes.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, ErrFormTooLarge
+	}
+	return n, err
+}
+
+// readLimited reads r to the end, or returns ErrPartTooLarge together with the
+// first limit+1 bytes when r holds more than limit.
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return data, fmt.Errorf("%w: %w", ErrInvalidForm, err)
+	}
+	if int64(len(data)) > limit {
+		return data, ErrPartTooLarge
+	}
+	return data, nil
+}
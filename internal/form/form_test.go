@@ -0,0 +1,224 @@
+package form
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const boundary = "X-BOUNDARY"
+
+func multipartBody(parts ...string) string {
+	return strings.Join(parts, "") + "--" + boundary + "--\r\n"
+}
+
+func field(name, value string) string {
+	return fmt.Sprintf("--%s\r\nContent-Disposition: form-data; name=%q\r\n\r\n%s\r\n", boundary, name, value)
+}
+
+func file(name, filename, content string) string {
+	return fmt.Sprintf("--%s\r\nContent-Disposition: form-data; name=%q; filename=%q\r\nContent-Type: text/plain\r\n\r\n%s\r\n",
+		boundary, name, filename, content)
+}
+
+func readFile(t *testing.T, f *File) string {
+	r, err := f.Open()
+	require.NoError(t, err)
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestURLEncoded(t *testing.T) {
+	// Test: Values through a request
+	body := "name=Alex+M&tag=a&tag=b%26c&empty="
+	raw := fmt.Sprintf("POST /submit HTTP/1.1\r\nHost: localhost\r\nContent-Type: application/x-www-form-urlencoded; charset=utf-8\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	f, err := Parse(req)
+	require.NoError(t, err)
+	assert.Equal(t, "Alex M", f.Value("name"))
+	assert.Equal(t, []string{"a", "b&c"}, f.Values("tag"))
+	assert.Equal(t, "", f.Value("empty"))
+	assert.Equal(t, "", f.Value("missing"))
+
+	// Test: Limits
+	_, err = ParseURLEncoded([]byte("a=1&b=2&c=3"), WithMaxParts(2))
+	assert.ErrorIs(t, err, ErrTooManyParts)
+	_, err = ParseURLEncoded([]byte("a=12345"), WithMaxPartSize(4))
+	assert.ErrorIs(t, err, ErrPartTooLarge)
+
+	_, err = ParseURLEncoded([]byte("a=1&b=2"), WithMaxMemory(5))
+	assert.ErrorIs(t, err, ErrFormTooLarge)
+
+	// Test: Bad escapes
+	_, err = ParseURLEncoded([]byte("a=%zz"))
+	assert.ErrorIs(t, err, ErrInvalidForm)
+
+	// Test: Unsupported media type
+	raw = "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Type: text/plain\r\nContent-Length: 1\r\n\r\nx"
+	req, err = request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	_, err = Parse(req)
+	assert.ErrorIs(t, err, ErrUnsupportedMediaType)
+}
+
+func TestMultipart(t *testing.T) {
+	dir := t.TempDir()
+
+	// Test: Fields and small files stay in memory
+	body := multipartBody(
+		field("title", "hello"),
+		field("title", "world"),
+		file("doc", "notes.txt", "small file"),
+	)
+	raw := fmt.Sprintf("POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Type: multipart/form-data; boundary=%s\r\nContent-Length: %d\r\n\r\n%s", boundary, len(body), body)
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	f, err := Parse(req, WithTempDir(dir))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"hello", "world"}, f.Values("title"))
+	doc, ok := f.File("doc")
+	require.True(t, ok)
+	assert.Equal(t, "notes.txt", doc.Filename)
+	assert.Equal(t, "text/plain", doc.ContentType)
+	assert.Equal(t, int64(10), doc.Size)
+	assert.False(t, doc.Spilled())
+	assert.Equal(t, "small file", readFile(t, doc))
+
+	// Test: Files over the memory threshold spill to disk and are removed
+	big := strings.Repeat("x", 100)
+	f, err = ParseMultipart(strings.NewReader(multipartBody(file("a", "a.txt", "0123456789"), file("b", "b.txt", big))),
+		boundary, WithMaxMemory(20), WithTempDir(dir))
+	require.NoError(t, err)
+	a, _ := f.File("a")
+	b, _ := f.File("b")
+	assert.False(t, a.Spilled())
+	require.True(t, b.Spilled())
+	assert.Equal(t, int64(100), b.Size)
+	assert.Equal(t, big, readFile(t, b))
+	require.NoError(t, f.RemoveAll())
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Test: Per-part size limit for values and files, no temp files left
+	_, err = ParseMultipart(strings.NewReader(multipartBody(field("v", big))), boundary, WithMaxPartSize(50))
+	assert.ErrorIs(t, err, ErrPartTooLarge)
+	_, err = ParseMultipart(strings.NewReader(multipartBody(file("a", "a.txt", "ok"), file("b", "b.txt", big))),
+		boundary, WithMaxPartSize(50), WithMaxMemory(10), WithTempDir(dir))
+	assert.ErrorIs(t, err, ErrPartTooLarge)
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Test: Part count limit
+	_, err = ParseMultipart(strings.NewReader(multipartBody(field("a", "1"), field("b", "2"), field("c", "3"))),
+		boundary, WithMaxParts(2))
+	assert.ErrorIs(t, err, ErrTooManyParts)
+
+	// Test: Values count against the memory budget, files spill instead
+	_, err = ParseMultipart(strings.NewReader(multipartBody(field("a", "0123456789"), field("b", "0123456789"))),
+		boundary, WithMaxMemory(15))
+	assert.ErrorIs(t, err, ErrFormTooLarge)
+	f, err = ParseMultipart(strings.NewReader(multipartBody(field("a", "0123456789"), file("b", "b.txt", "0123456789"))),
+		boundary, WithMaxMemory(15), WithTempDir(dir))
+	require.NoError(t, err)
+	b, _ = f.File("b")
+	assert.True(t, b.Spilled())
+	require.NoError(t, f.RemoveAll())
+
+	// Test: Total size limit
+	_, err = ParseMultipart(strings.NewReader(multipartBody(field("a", big))), boundary, WithMaxBytes(80))
+	assert.ErrorIs(t, err, ErrFormTooLarge)
+
+	// Test: Truncated body and missing boundary
+	_, err = ParseMultipart(bytes.NewReader([]byte(field("a", "1"))), boundary)
+	assert.ErrorIs(t, err, ErrInvalidForm)
+	_, err = ParseMultipart(strings.NewReader(""), "")
+	assert.ErrorIs(t, err, ErrInvalidForm)
+}
+
+func TestMaxBytes(t *testing.T) {
+	body := multipartBody(field("a", strings.Repeat("x", 100)))
+	head := fmt.Sprintf("POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Type: multipart/form-data; boundary=%s\r\nExpect: 100-continue\r\n", boundary)
+
+	// Test: A deferred body announced as too large is never asked for
+	req, err := request.RequestFromReader(strings.NewReader(head + fmt.Sprintf("Content-Length: %d\r\n\r\n", len(body))))
+	require.NoError(t, err)
+	req.OnContinue(func() error {
+		t.Error("100 Continue sent for a body over the limit")
+		return nil
+	})
+	_, err = Parse(req, WithMaxBytes(50))
+	assert.ErrorIs(t, err, ErrFormTooLarge)
+	assert.ErrorIs(t, err, request.ErrBodyTooLarge)
+	assert.True(t, req.BodyPending())
+
+	// Test: A deferred chunked body is abandoned once it passes the limit
+	chunked := ""
+	for i := 0; i < len(body); i += 10 {
+		chunk := body[i:min(i+10, len(body))]
+		chunked += fmt.Sprintf("%x\r\n%s\r\n", len(chunk), chunk)
+	}
+	reader := &countingReader{r: strings.NewReader(head + "Transfer-Encoding: chunked\r\n\r\n" + chunked + "0\r\n\r\n")}
+	req, err = request.RequestFromReader(reader)
+	require.NoError(t, err)
+	_, err = Parse(req, WithMaxBytes(50))
+	assert.ErrorIs(t, err, ErrFormTooLarge)
+	assert.True(t, req.BodyPending())
+	assert.Less(t, reader.n, len(head)+len(chunked))
+
+	// Test: Bodies within the limit parse
+	req, err = request.RequestFromReader(strings.NewReader(head + fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(body), body)))
+	require.NoError(t, err)
+	f, err := Parse(req, WithMaxBytes(int64(len(body))))
+	require.NoError(t, err)
+	assert.Len(t, f.Value("a"), 100)
+}
+
+// countingReader counts the bytes read through it, one byte at a time.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p[:min(len(p), 1)])
+	c.n += n
+	return n, err
+}
+
+func TestStreamedBody(t *testing.T) {
+	dir := t.TempDir()
+	content := strings.Repeat("x", 8<<20)
+	body := multipartBody(field("a", "1"), file("big", "big.bin", content))
+	head := fmt.Sprintf("POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Type: multipart/form-data; boundary=%s\r\nExpect: 100-continue\r\nContent-Length: %d\r\n\r\n", boundary, len(body))
+
+	// Test: A deferred body larger than the memory threshold is never held whole
+	req, err := request.RequestFromReader(io.MultiReader(strings.NewReader(head), strings.NewReader(body)))
+	require.NoError(t, err)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	f, err := Parse(req, WithMaxMemory(1<<10), WithTempDir(dir))
+	runtime.ReadMemStats(&after)
+	require.NoError(t, err)
+	defer f.RemoveAll()
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(len(content)/4))
+	assert.False(t, req.BodyPending())
+	assert.Equal(t, "1", f.Value("a"))
+	big, ok := f.File("big")
+	require.True(t, ok)
+	assert.True(t, big.Spilled())
+	assert.Equal(t, int64(len(content)), big.Size)
+	assert.Equal(t, content, readFile(t, big))
+}
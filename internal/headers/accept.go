@@ -0,0 +1,79 @@
+package headers
+
+import (
+	"strconv"
+	"strings"
+)
+
+const AcceptHeader = "Accept"
+
+type mediaRange struct {
+	typ, subtype string
+	q            float64
+}
+
+// Negotiate picks the offered media type the Accept value prefers, following
+// RFC 9110 section 12.5.1: the most specific matching range sets the quality of
+// an offer and ties go to the earlier offer. An empty Accept accepts anything,
+// so the first offer is returned. It returns "" when no offer is acceptable.
+func Negotiate(accept string, offers ...string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+	ranges := parseAccept(accept)
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		q := quality(ranges, offer)
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+func quality(ranges []mediaRange, offer string) float64 {
+	typ, subtype, _ := strings.Cut(strings.ToLower(offer), "/")
+	q, specificity := 0.0, -1
+	for _, r := range ranges {
+		s := -1
+		switch {
+		case r.typ == typ && r.subtype == subtype:
+			s = 2
+		case r.typ == typ && r.subtype == "*":
+			s = 1
+		case r.typ == "*" && r.subtype == "*":
+			s = 0
+		}
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+	return q
+}
+
+func parseAccept(accept string) []mediaRange {
+	var ranges []mediaRange
+	for _, element := range strings.Split(accept, ",") {
+		params := strings.Split(element, ";")
+		typ, subtype, found := strings.Cut(strings.ToLower(strings.TrimSpace(params[0])), "/")
+		if !found || !IsToken(typ) || !IsToken(subtype) {
+			continue
+		}
+		r := mediaRange{typ: typ, subtype: subtype, q: 1}
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "q") {
+				q, err := strconv.ParseFloat(value, 64)
+				if err != nil || q < 0 || q > 1 {
+					q = 0
+				}
+				r.q = q
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
@@ -2,97 +2,348 @@ package headers
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"slices"
 	"strings"
 )
 
 const ContentLengthHeader = "Content-Length"
+const HostHeader = "Host"
 const ContentTypeHeader = "Content-Type"
 const ConnectionHeader = "Connection"
 const TransferEncodingHeader = "Transfer-Encoding"
 const TrailerHeader = "Trailer"
+const ExpectHeader = "Expect"
+const LinkHeader = "Link"
+const AllowHeader = "Allow"
+const CookieHeader = "Cookie"
+const SetCookieHeader = "Set-Cookie"
+const ETagHeader = "ETag"
+const IfNoneMatchHeader = "If-None-Match"
 const XContentSHA256Trailer = "X-Content-SHA256"
 const XContentSLengthTrailer = "X-Content-Length"
 
-type Headers map[string]string
+// Headers maps lower-cased field names to their field lines. Repeated fields
+// are combined into one line with Set, while fields such as Set-Cookie that
+// cannot be combined keep a line each with Add.
+type Headers map[string][]string
 
 func NewHeaders() Headers {
 	return make(Headers)
 }
 
-const crlf = "\r\n"
 const column = ":"
 
-func (h *Headers) Parse(data []byte) (n int, done bool, err error) {
-	index := bytes.Index(data, []byte(crlf))
+var (
+	ErrInvalidFieldName  = errors.New("invalid field name")
+	ErrInvalidFieldValue = errors.New("invalid field value")
+	ErrObsFold           = errors.New("obsolete line folding")
+	ErrBareLF            = errors.New("bare LF line ending")
+)
+
+// FieldError reports a malformed field line together with the name of the
+// offending header, when one could be determined.
+type FieldError struct {
+	Name string
+	Err  error
+}
+
+func (e *FieldError) Error() string {
+	if e.Name == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("header %q: %v", e.Name, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+type ObsFoldPolicy int
+
+const (
+	// ObsFoldReject fails a field line that continues the previous one.
+	ObsFoldReject ObsFoldPolicy = iota
+	// ObsFoldReplace joins a continuation line to the previous value with a
+	// single SP, as allowed by RFC 9112 section 5.2.
+	ObsFoldReplace
+)
+
+type BareLFPolicy int
+
+const (
+	// BareLFReject fails any line terminated by LF without a preceding CR.
+	BareLFReject BareLFPolicy = iota
+	// BareLFAccept treats a lone LF as a line terminator.
+	BareLFAccept
+)
+
+// Policy selects how lenient parsing is towards obsolete syntax.
+type Policy struct {
+	ObsFold ObsFoldPolicy
+	BareLF  BareLFPolicy
+}
+
+// Parser parses field lines one at a time and remembers the previous field so
+// obsolete line folding can be detected.
+type Parser struct {
+	Policy Policy
+	last   string
+	spare  []string
+}
+
+// Parse parses a single field line from data into h. It returns 0 bytes
+// consumed when data does not hold a complete line yet, and done once the empty
+// line ending the field section is reached. The returned name is empty for
+// folded continuation lines.
+func (p *Parser) Parse(h Headers, data []byte) (name string, n int, done bool, err error) {
+	line, n, err := p.nextLine(data)
+	if err != nil || n == 0 {
+		return "", 0, false, err
+	}
+	if len(line) == 0 {
+		return "", n, true, nil
+	}
+
+	if line[0] == ' ' || line[0] == '\t' {
+		// RFC 9112 section 5.2: such a line continues the previous field, and
+		// without one it could hide a field from other parsers
+		if p.last == "" {
+			return "", 0, false, &FieldError{Err: fmt.Errorf("%w: whitespace before the first field line", ErrInvalidFieldName)}
+		}
+		if err := p.unfold(h, line); err != nil {
+			return "", 0, false, err
+		}
+		return "", n, false, nil
+	}
+	name, err = p.parseHeaderLine(line, h)
+	if err != nil {
+		return "", 0, false, fmt.Errorf("invalid header line: %w", err)
+	}
+	p.last = name
+	return name, n, false, nil
+}
+
+// nextLine returns the next line without its terminator and the number of
+// bytes it spans, or 0 bytes when the line is incomplete.
+func (p *Parser) nextLine(data []byte) ([]byte, int, error) {
+	index := bytes.IndexByte(data, '\n')
 	if index == -1 {
-		return 0, false, nil
+		return nil, 0, nil
+	}
+	if index > 0 && data[index-1] == '\r' {
+		return data[:index-1], index + 1, nil
+	}
+	if p.Policy.BareLF == BareLFAccept {
+		return data[:index], index + 1, nil
+	}
+	name, _, _ := bytes.Cut(data[:index], []byte(column))
+	return nil, 0, &FieldError{Name: strings.TrimSpace(string(name)), Err: ErrBareLF}
+}
+
+func (p *Parser) unfold(h Headers, line []byte) error {
+	if p.Policy.ObsFold != ObsFoldReplace {
+		return &FieldError{Name: p.last, Err: ErrObsFold}
+	}
+	continuation := trimOWS(line)
+	if !isValidValue(continuation) {
+		return &FieldError{Name: p.last, Err: ErrInvalidFieldValue}
+	}
+	key := strings.ToLower(p.last)
+	h[key] = extend(h[key], " ", string(continuation))
+	return nil
+}
+
+// parseHeaderLine works on the bytes of the line and only allocates the
+// strings it stores: the value and, for names not in commonFields, the name.
+func (p *Parser) parseHeaderLine(data []byte, headers Headers) (string, error) {
+	colon := bytes.IndexByte(data, ':')
+	if colon == -1 {
+		return "", &FieldError{Name: strings.TrimSpace(string(data)), Err: fmt.Errorf("%w: missing colon", ErrInvalidFieldName)}
+	}
+	rawName := data[:colon]
+	if len(rawName) == 0 || rawName[len(rawName)-1] == ' ' || rawName[len(rawName)-1] == '\t' {
+		return "", &FieldError{Name: strings.TrimSpace(string(rawName)), Err: ErrInvalidFieldName}
 	}
-	if index == 0 {
-		return 2, true, nil
+	if !isToken(rawName) {
+		return "", &FieldError{Name: string(rawName), Err: ErrInvalidFieldName}
 	}
+	value := trimOWS(data[colon+1:])
+	if !isValidValue(value) {
+		return "", &FieldError{Name: string(rawName), Err: ErrInvalidFieldValue}
+	}
+	name, key := fieldName(rawName)
+	if lines, present := headers[key]; present {
+		headers[key] = extend(lines, ", ", string(value))
+	} else {
+		headers[key] = p.line(string(value))
+	}
+	return name, nil
+}
 
-	if err := parseHeaderLine(data[:index], h); err != nil {
-		return 0, false, fmt.Errorf("invalid header line: %w", err)
+// line returns a single field line, carving it from a shared backing array
+// so that the fields of a section cost one slice allocation between them.
+func (p *Parser) line(value string) []string {
+	if len(p.spare) == 0 {
+		p.spare = make([]string, 16)
 	}
+	line := p.spare[:1:1]
+	line[0] = value
+	p.spare = p.spare[1:]
+	return line
+}
+
+// commonFields maps the lower-cased names of frequent fields to their usual
+// spelling, so parsing them allocates neither the name nor the map key.
+var commonFields = map[string]commonField{}
 
-	return index + 2, false, nil
+type commonField struct {
+	name, key string
 }
 
-func parseHeaderLine(data []byte, headers *Headers) error {
-	parts := bytes.SplitN(data, []byte(":"), 2)
-	name := string(parts[0])
+func init() {
+	for _, name := range []string{
+		"Accept", "Accept-Charset", "Accept-Encoding", "Accept-Language", "Authorization",
+		"Cache-Control", "Connection", "Content-Encoding", "Content-Length", "Content-Type",
+		"Cookie", "Date", "DNT", "Expect", "Forwarded", "Host", "HTTP2-Settings",
+		"If-Match", "If-Modified-Since", "If-None-Match", "Keep-Alive", "Last-Event-ID",
+		"Origin", "Pragma", "Proxy-Authorization", "Range", "Referer",
+		"Sec-Fetch-Dest", "Sec-Fetch-Mode", "Sec-Fetch-Site", "Sec-WebSocket-Extensions",
+		"Sec-WebSocket-Key", "Sec-WebSocket-Protocol", "Sec-WebSocket-Version",
+		"TE", "Trailer", "Transfer-Encoding", "Upgrade", "Upgrade-Insecure-Requests",
+		"User-Agent", "Via", "X-Forwarded-For", "X-Forwarded-Proto", "X-Request-ID",
+	} {
+		key := strings.ToLower(name)
+		commonFields[key] = commonField{name: name, key: key}
+	}
+}
 
-	if name == "" || strings.HasSuffix(name, " ") {
-		return fmt.Errorf("invalid header line name: %s", name)
+// fieldName returns the name as sent and the lower-cased key it is stored
+// under, taking both from commonFields when the name is found there.
+func fieldName(raw []byte) (name, key string) {
+	var lower [32]byte
+	if len(raw) <= len(lower) {
+		for i, c := range raw {
+			lower[i] = toLower(c)
+		}
+		if common, found := commonFields[string(lower[:len(raw)])]; found {
+			if string(raw) == common.name {
+				return common.name, common.key
+			}
+			return string(raw), common.key
+		}
 	}
+	name = string(raw)
+	return name, strings.ToLower(name)
+}
 
-	name = strings.TrimSpace(name)
-	if !isValidName(name) {
-		return fmt.Errorf("invalid header line name: %s", name)
+func toLower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
 	}
-	(*headers).Set(name, strings.TrimSpace(string(parts[1])))
-	return nil
+	return c
+}
 
+func trimOWS(b []byte) []byte {
+	return bytes.Trim(b, " \t")
 }
 
-func isValidName(name string) bool {
-	if len(name) == 0 {
-		return false
+var (
+	// tokenChars holds the RFC 9110 tchar set.
+	tokenChars = charTable(func(c byte) bool {
+		return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			strings.IndexByte("!#$%&'*+-.^_`|~", c) != -1
+	})
+	// valueChars holds the characters of an RFC 9110 field-value: visible
+	// characters, obs-text, SP and HTAB.
+	valueChars = charTable(func(c byte) bool {
+		return c == ' ' || c == '\t' || (c >= 0x21 && c != 0x7f)
+	})
+)
+
+func charTable(member func(c byte) bool) (table [256]bool) {
+	for c := range table {
+		table[c] = member(byte(c))
 	}
-	for _, r := range name {
-		if !isValidHeaderNameChar(byte(r)) {
+	return table
+}
+
+func isValidValue[T string | []byte](value T) bool {
+	for i := 0; i < len(value); i++ {
+		if !valueChars[value[i]] {
 			return false
 		}
 	}
 	return true
 }
 
-func isValidHeaderNameChar(r byte) bool {
-	specials := []byte{
-		'!', '#', '$', '%', '&', '\'', '*', '+', '-', '.', '^', '_', '`', '|', '~',
+// IsToken reports whether s is a non-empty RFC 9110 token, the grammar shared by
+// field names and request methods.
+func IsToken(s string) bool {
+	return isToken(s)
+}
+
+func isToken[T string | []byte](s T) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !tokenChars[s[i]] {
+			return false
+		}
 	}
-	return (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || slices.Contains(specials, r)
+	return true
 }
 
+// Set stores value for key, combining it with the last line already stored
+// into a comma-separated list.
 func (h Headers) Set(key, value string) {
-	evalue, present := h[strings.ToLower(key)]
-	if present {
-		h[strings.ToLower(key)] = fmt.Sprintf("%s, %s", evalue, value)
+	key = strings.ToLower(key)
+	if lines, present := h[key]; present {
+		h[key] = extend(lines, ", ", value)
 	} else {
-		h[strings.ToLower(key)] = value
+		h[key] = []string{value}
 	}
+}
+
+// extend returns lines with value joined to the last line by sep, or as the
+// only line when there is none. Like Add, it never writes to the array behind
+// lines, which copies of the Headers may share.
+func extend(lines []string, sep, value string) []string {
+	if len(lines) == 0 {
+		return []string{value}
+	}
+	last := len(lines) - 1
+	return append(lines[:last:last], lines[last]+sep+value)
+}
 
+// Add appends value as a separate field line instead of joining it with a
+// comma, for fields such as Set-Cookie that cannot be combined into a list.
+func (h Headers) Add(key, value string) {
+	key = strings.ToLower(key)
+	lines := h[key]
+	h[key] = append(lines[:len(lines):len(lines)], value)
 }
+
+// Values returns every field line stored for key.
+func (h Headers) Values(key string) []string {
+	return slices.Clone(h[strings.ToLower(key)])
+}
+
 func (h Headers) Override(key, value string) {
-	h[strings.ToLower(key)] = value
+	h[strings.ToLower(key)] = []string{value}
 }
 func (h Headers) Remove(key string) {
 	delete(h, strings.ToLower(key))
 }
 
+// Get returns the value of key, with the lines of a field added more than
+// once joined into a comma-separated list.
 func (h Headers) Get(key string) (string, bool) {
-	val, present := h[strings.ToLower(key)]
-	return val, present
+	lines, present := h[strings.ToLower(key)]
+	if len(lines) == 1 {
+		return lines[0], true
+	}
+	return strings.Join(lines, ", "), present
 }
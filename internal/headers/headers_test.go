@@ -1,6 +1,7 @@
 package headers
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -11,38 +12,47 @@ func TestHeadersParse(t *testing.T) {
 	// Test: Valid single header
 	headers := NewHeaders()
 	data := []byte("Host: localhost:42069\r\n\r\n")
-	n, done, err := headers.Parse(data)
+	n, done, err := parse(headers, data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, []string{"localhost:42069"}, headers["host"])
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
 	// Test: Valid single header with extra whitespace
 	headers = NewHeaders()
-	data = []byte("       Host: localhost:42069                           \r\n\r\n")
-	n, done, err = headers.Parse(data)
+	data = []byte("Host:    localhost:42069                           \r\n\r\n")
+	n, done, err = parse(headers, data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
-	assert.Equal(t, 57, n)
+	assert.Equal(t, []string{"localhost:42069"}, headers["host"])
+	assert.Equal(t, 53, n)
 	assert.False(t, done)
 
+	// Test: Whitespace before the first field line
+	headers = NewHeaders()
+	data = []byte("       Host: localhost:42069\r\n\r\n")
+	n, done, err = parse(headers, data)
+	require.ErrorIs(t, err, ErrInvalidFieldName)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+	assert.Empty(t, headers)
+
 	// Test: Valid 2 headers with existing headers
-	headers = map[string]string{"host": "localhost:42069"}
+	headers = Headers{"host": {"localhost:42069"}}
 	data = []byte("User-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n")
-	n, done, err = headers.Parse(data)
+	n, done, err = parse(headers, data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
-	assert.Equal(t, "curl/7.81.0", headers["user-agent"])
+	assert.Equal(t, []string{"localhost:42069"}, headers["host"])
+	assert.Equal(t, []string{"curl/7.81.0"}, headers["user-agent"])
 	assert.Equal(t, 25, n)
 	assert.False(t, done)
 
 	// Test: Valid done
 	headers = NewHeaders()
 	data = []byte("\r\n a bunch of other stuff")
-	n, done, err = headers.Parse(data)
+	n, done, err = parse(headers, data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
 	assert.Empty(t, headers)
@@ -52,7 +62,7 @@ func TestHeadersParse(t *testing.T) {
 	// Test: Invalid spacing header
 	headers = NewHeaders()
 	data = []byte("       Host : localhost:42069       \r\n\r\n")
-	n, done, err = headers.Parse(data)
+	n, done, err = parse(headers, data)
 	require.Error(t, err)
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
@@ -60,17 +70,215 @@ func TestHeadersParse(t *testing.T) {
 	// Test: Invalid character header
 	headers = NewHeaders()
 	data = []byte("H©st: localhost:42069\r\n\r\n")
-	n, done, err = headers.Parse(data)
+	n, done, err = parse(headers, data)
 	require.Error(t, err)
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 
-	headers = map[string]string{"host": "localhost:42069"}
+	headers = Headers{"host": {"localhost:42069"}}
 	data = []byte("host: localhost:42070\r\n\r\n")
-	n, done, err = headers.Parse(data)
+	n, done, err = parse(headers, data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Contains(t, headers["host"], "localhost:42069")
-	assert.Contains(t, headers["host"], "localhost:42070")
+	host, _ := headers.Get("host")
+	assert.Contains(t, host, "localhost:42069")
+	assert.Contains(t, host, "localhost:42070")
 	assert.False(t, done)
 }
+
+// parse parses one field line of data into h with a fresh Parser.
+func parse(h Headers, data []byte) (int, bool, error) {
+	p := Parser{}
+	_, n, done, err := p.Parse(h, data)
+	return n, done, err
+}
+
+func TestHeaderValueValidation(t *testing.T) {
+	// Test: Control characters in values
+	for _, value := range []string{"a\x00b", "a\rb", "a\x7fb", "a\x01b", "a\vb"} {
+		headers := NewHeaders()
+		_, _, err := parse(headers, []byte("X-Test: "+value+"\r\n\r\n"))
+		require.ErrorIs(t, err, ErrInvalidFieldValue, "%q", value)
+		var fieldErr *FieldError
+		require.ErrorAs(t, err, &fieldErr)
+		assert.Equal(t, "X-Test", fieldErr.Name)
+		assert.Empty(t, headers)
+	}
+
+	// Test: Internal whitespace and obs-text are valid
+	headers := NewHeaders()
+	_, _, err := parse(headers, []byte("X-Test: a \tb\xe9\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a \tb\xe9"}, headers["x-test"])
+
+	// Test: Missing colon
+	headers = NewHeaders()
+	_, _, err = parse(headers, []byte("X-Test\r\n\r\n"))
+	require.ErrorIs(t, err, ErrInvalidFieldName)
+
+	// Test: Tab before colon
+	headers = NewHeaders()
+	_, _, err = parse(headers, []byte("X-Test\t: a\r\n\r\n"))
+	require.ErrorIs(t, err, ErrInvalidFieldName)
+}
+
+func TestObsFold(t *testing.T) {
+	data := []byte("X-Folded: first\r\n  second\r\nHost: localhost\r\n\r\n")
+
+	// Test: Rejected by default
+	headers := NewHeaders()
+	p := Parser{}
+	_, n, _, err := p.Parse(headers, data)
+	require.NoError(t, err)
+	_, _, _, err = p.Parse(headers, data[n:])
+	require.ErrorIs(t, err, ErrObsFold)
+	var fieldErr *FieldError
+	require.ErrorAs(t, err, &fieldErr)
+	assert.Equal(t, "X-Folded", fieldErr.Name)
+
+	// Test: Replaced with SP
+	headers = NewHeaders()
+	p = Parser{Policy: Policy{ObsFold: ObsFoldReplace}}
+	total := 0
+	for {
+		_, n, done, err := p.Parse(headers, data[total:])
+		require.NoError(t, err)
+		total += n
+		if done {
+			break
+		}
+	}
+	assert.Equal(t, len(data), total)
+	assert.Equal(t, []string{"first second"}, headers["x-folded"])
+	assert.Equal(t, []string{"localhost"}, headers["host"])
+
+	// Test: A continuation without a previous field is rejected either way
+	headers = NewHeaders()
+	p = Parser{Policy: Policy{ObsFold: ObsFoldReplace}}
+	_, _, _, err = p.Parse(headers, []byte("  second\r\nHost: localhost\r\n\r\n"))
+	require.ErrorIs(t, err, ErrInvalidFieldName)
+	assert.Empty(t, headers)
+}
+
+func TestBareLF(t *testing.T) {
+	// Test: Rejected by default
+	headers := NewHeaders()
+	_, _, err := parse(headers, []byte("Host: localhost\n\r\n"))
+	require.ErrorIs(t, err, ErrBareLF)
+	var fieldErr *FieldError
+	require.ErrorAs(t, err, &fieldErr)
+	assert.Equal(t, "Host", fieldErr.Name)
+
+	// Test: Accepted as a line terminator
+	headers = NewHeaders()
+	p := Parser{Policy: Policy{BareLF: BareLFAccept}}
+	_, n, done, err := p.Parse(headers, []byte("Host: localhost\n\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 16, n)
+	assert.False(t, done)
+	_, n, done, err = p.Parse(headers, []byte("\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.True(t, done)
+	assert.Equal(t, []string{"localhost"}, headers["host"])
+}
+
+func TestFieldLines(t *testing.T) {
+	// Test: Add keeps a line per value
+	h := NewHeaders()
+	h.Add(SetCookieHeader, "a=1")
+	h.Add("set-cookie", "b=2; Path=/")
+	assert.Equal(t, []string{"a=1", "b=2; Path=/"}, h.Values(SetCookieHeader))
+	value, present := h.Get(SetCookieHeader)
+	assert.True(t, present)
+	assert.Equal(t, "a=1, b=2; Path=/", value)
+
+	// Test: Set joins the last line into a list
+	h.Set(SetCookieHeader, "c=3")
+	assert.Equal(t, []string{"a=1", "b=2; Path=/, c=3"}, h.Values(SetCookieHeader))
+
+	// Test: Changes never reach a copy sharing the lines
+	c := Headers{}
+	for name, lines := range h {
+		c[name] = lines
+	}
+	h.Set(SetCookieHeader, "d=4")
+	h.Add(SetCookieHeader, "e=5")
+	assert.Equal(t, []string{"a=1", "b=2; Path=/, c=3"}, c.Values(SetCookieHeader))
+
+	// Test: Override replaces every line
+	h.Override(SetCookieHeader, "f=6")
+	assert.Equal(t, []string{"f=6"}, h[strings.ToLower(SetCookieHeader)])
+	_, present = h.Get("X-Missing")
+	assert.False(t, present)
+	assert.Nil(t, h.Values("X-Missing"))
+
+	// Test: Set on a field stored without lines starts one
+	h = Headers{"x-empty": nil, "x-none": {}}
+	h.Set("X-Empty", "a")
+	h.Set("X-None", "b")
+	assert.Equal(t, []string{"a"}, h.Values("X-Empty"))
+	assert.Equal(t, []string{"b"}, h.Values("X-None"))
+}
+
+func TestNegotiate(t *testing.T) {
+	json, text := "application/json", "text/plain"
+
+	// Test: Missing Accept takes the first offer
+	assert.Equal(t, json, Negotiate("", json, text))
+
+	// Test: Exact match, wildcards and quality
+	assert.Equal(t, text, Negotiate("text/plain", json, text))
+	assert.Equal(t, json, Negotiate("*/*", json, text))
+	assert.Equal(t, text, Negotiate("text/*, application/json;q=0.5", json, text))
+	assert.Equal(t, json, Negotiate("text/html, application/*;q=0.8, */*;q=0.1", json, text))
+
+	// Test: The most specific range wins even with a lower quality
+	assert.Equal(t, text, Negotiate("application/*, application/json;q=0.2, text/plain;q=0.5", json, text))
+
+	// Test: q=0 excludes, nothing acceptable
+	assert.Equal(t, text, Negotiate("*/*, application/json;q=0", json, text))
+	assert.Equal(t, "", Negotiate("image/png", json, text))
+
+	// Test: Case insensitivity and malformed ranges
+	assert.Equal(t, json, Negotiate("Application/JSON, garbage, text/plain;q=oops", json, text))
+}
+
+var benchmarkFields = []byte("Host: localhost:42069\r\n" +
+	"User-Agent: Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0\r\n" +
+	"Accept: text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8\r\n" +
+	"Accept-Language: en-US,en;q=0.5\r\n" +
+	"Accept-Encoding: gzip, deflate, br\r\n" +
+	"Connection: keep-alive\r\n" +
+	"Cookie: session=3f9a2c; theme=dark\r\n" +
+	"Upgrade-Insecure-Requests: 1\r\n" +
+	"X-Request-Id: 6c1e0d4b-8f7a-4c36-9a39-0d6f2b1e5a77\r\n" +
+	"\r\n")
+
+func BenchmarkParse(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchmarkFields)))
+	for i := 0; i < b.N; i++ {
+		h := NewHeaders()
+		p := Parser{}
+		for data := benchmarkFields; ; {
+			_, n, done, err := p.Parse(h, data)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if done {
+				break
+			}
+			data = data[n:]
+		}
+	}
+}
+
+func BenchmarkIsToken(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if !IsToken("Upgrade-Insecure-Requests") {
+			b.Fatal("not a token")
+		}
+	}
+}
@@ -0,0 +1,767 @@
+package http2
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/alexmarian/httpfromtcp/internal/http2/hpack"
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/alexmarian/httpfromtcp/internal/response"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// serverConn is the state of one HTTP/2 connection. A single goroutine reads
+// and processes frames; every stream's handler runs in its own goroutine and
+// writes through the connection's frame writer.
+type serverConn struct {
+	srv    *Server
+	conn   net.Conn
+	reader io.Reader
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	tls    *tls.ConnectionState
+
+	// only touched by the read loop
+	decoder     *hpack.Decoder
+	readBuf     []byte
+	recvWindow  int64
+	continued   *headerBlock
+	resets      int
+	resetsSince time.Time
+
+	writeMu sync.Mutex
+	encoder *hpack.Encoder
+
+	mu                sync.Mutex
+	cond              *sync.Cond
+	streams           map[uint32]*stream
+	active            int // client streams open or with a running handler
+	lastStreamID      uint32
+	sendWindow        int64
+	peerInitialWindow int64
+	peerMaxFrameSize  uint32
+	peerPush          bool
+	peerMaxStreams    uint32
+	nextPushID        uint32
+	pushes            int
+	closed            bool
+	goingAway         bool
+
+	handlers sync.WaitGroup
+}
+
+// headerBlock collects a header block split over CONTINUATION frames.
+type headerBlock struct {
+	streamID  uint32
+	block     []byte
+	endStream bool
+}
+
+func newServerConn(ctx context.Context, srv *Server, conn net.Conn, reader io.Reader) *serverConn {
+	sc := &serverConn{
+		srv:               srv,
+		conn:              conn,
+		reader:            reader,
+		decoder:           hpack.NewDecoder(hpack.DefaultTableSize),
+		recvWindow:        defaultWindowSize,
+		encoder:           hpack.NewEncoder(),
+		streams:           make(map[uint32]*stream),
+		sendWindow:        defaultWindowSize,
+		peerInitialWindow: defaultWindowSize,
+		peerMaxFrameSize:  defaultMaxFrameSize,
+		peerPush:          true,
+		peerMaxStreams:    math.MaxUint32,
+		nextPushID:        2,
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		sc.tls = &state
+	}
+	sc.decoder.MaxStringLength = int(srv.maxHeaderListSize)
+	sc.cond = sync.NewCond(&sc.mu)
+	sc.ctx, sc.cancel = context.WithCancelCause(ctx)
+	return sc
+}
+
+// serve runs the connection. For an upgraded connection settings are the
+// client's HTTP2-Settings and upgrade the request to answer on stream 1.
+func (sc *serverConn) serve(settings []setting, upgrade *request.Request) error {
+	shuttingDown := sc.srv.track(sc, true)
+	defer sc.srv.track(sc, false)
+	defer sc.teardown()
+	stop := context.AfterFunc(sc.ctx, func() {
+		sc.writeGoAway(ErrCodeNo, "server shutting down")
+		sc.conn.Close()
+	})
+	defer stop()
+	sc.conn.SetDeadline(time.Time{})
+
+	if upgrade != nil {
+		if _, err := io.WriteString(sc.conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"); err != nil {
+			return err
+		}
+	}
+	if err := sc.writeSettings(); err != nil {
+		return err
+	}
+	if upgrade != nil {
+		if err := sc.applySettings(settings); err != nil {
+			return sc.fail(err)
+		}
+		sc.mu.Lock()
+		sc.lastStreamID = 1
+		sc.mu.Unlock()
+		st := sc.newStream(1)
+		st.remoteClosed = true
+		host, _ := upgrade.Headers.Get("Host")
+		st.head = requestHead{
+			method:    upgrade.RequestLine.Method,
+			scheme:    "http",
+			path:      upgrade.RequestLine.RequestTarget,
+			authority: host,
+		}
+		upgrade.TLS = sc.tls
+		sc.dispatch(st, upgrade, nil)
+	}
+	if shuttingDown {
+		sc.goAway()
+	}
+
+	preface := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(sc.reader, preface); err != nil {
+		return err
+	}
+	if string(preface) != ClientPreface {
+		return sc.fail(connError{ErrCodeProtocol, "invalid client preface"})
+	}
+	first := true
+	for {
+		if sc.srv.idleTimeout > 0 {
+			sc.mu.Lock()
+			idle := len(sc.streams) == 0
+			sc.mu.Unlock()
+			if idle {
+				sc.conn.SetReadDeadline(time.Now().Add(sc.srv.idleTimeout))
+			} else {
+				sc.conn.SetReadDeadline(time.Time{})
+			}
+		}
+		h, payload, err := readFrame(sc.reader, sc.readBuf, defaultMaxFrameSize)
+		if err != nil {
+			return sc.fail(err)
+		}
+		if cap(payload) > cap(sc.readBuf) {
+			sc.readBuf = payload[:0]
+		}
+		if first && (h.typ != frameSettings || h.has(flagAck)) {
+			return sc.fail(connError{ErrCodeProtocol, "first frame is not SETTINGS"})
+		}
+		first = false
+		if err := sc.processFrame(h, payload); err != nil {
+			var se streamError
+			if errors.As(err, &se) {
+				sc.resetStream(se.streamID, se.code)
+				continue
+			}
+			return sc.fail(err)
+		}
+	}
+}
+
+// fail ends the connection after err, telling the client why when that is
+// still possible.
+func (sc *serverConn) fail(err error) error {
+	var ce connError
+	switch {
+	case errors.As(err, &ce):
+		sc.writeGoAway(ce.code, ce.reason)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		sc.writeGoAway(ErrCodeNo, "idle timeout")
+		return nil
+	case errors.Is(err, io.EOF), errors.Is(err, net.ErrClosed), sc.ctx.Err() != nil:
+		return nil
+	}
+	return err
+}
+
+// teardown cancels every stream, closes the connection and waits for the
+// handlers to return.
+func (sc *serverConn) teardown() {
+	sc.mu.Lock()
+	sc.closed = true
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	sc.cancel(ErrConnectionClosed)
+	sc.conn.Close()
+	sc.handlers.Wait()
+}
+
+// goAway tells the client that no further streams will be accepted and closes
+// the connection once the open ones are done.
+func (sc *serverConn) goAway() {
+	sc.writeGoAway(ErrCodeNo, "server shutting down")
+	sc.mu.Lock()
+	sc.closeIfDone()
+	sc.mu.Unlock()
+}
+
+// closeIfDone closes the connection when it is going away and no stream is
+// left. Called with mu held.
+func (sc *serverConn) closeIfDone() {
+	if sc.goingAway && len(sc.streams) == 0 {
+		sc.conn.Close()
+	}
+}
+
+func (sc *serverConn) processFrame(h frameHeader, payload []byte) error {
+	if sc.continued != nil && (h.typ != frameContinuation || h.streamID != sc.continued.streamID) {
+		return connError{ErrCodeProtocol, "expected CONTINUATION"}
+	}
+	switch h.typ {
+	case frameData:
+		return sc.onData(h, payload)
+	case frameHeaders:
+		return sc.onHeaders(h, payload)
+	case frameContinuation:
+		return sc.onContinuation(h, payload)
+	case framePriority:
+		if h.streamID == 0 {
+			return connError{ErrCodeProtocol, "PRIORITY on stream 0"}
+		}
+		if len(payload) != 5 {
+			return streamError{h.streamID, ErrCodeFrameSize, "PRIORITY must be 5 bytes"}
+		}
+		return nil
+	case frameRSTStream:
+		return sc.onReset(h, payload)
+	case frameSettings:
+		return sc.onSettings(h, payload)
+	case framePushPromise:
+		return connError{ErrCodeProtocol, "clients cannot push"}
+	case framePing:
+		if h.streamID != 0 {
+			return connError{ErrCodeProtocol, "PING on a stream"}
+		}
+		if len(payload) != 8 {
+			return connError{ErrCodeFrameSize, "PING must be 8 bytes"}
+		}
+		if h.has(flagAck) {
+			return nil
+		}
+		return sc.writeFrame(framePing, flagAck, 0, payload)
+	case frameGoAway:
+		if h.streamID != 0 {
+			return connError{ErrCodeProtocol, "GOAWAY on a stream"}
+		}
+		sc.mu.Lock()
+		sc.goingAway = true
+		sc.closeIfDone()
+		sc.mu.Unlock()
+		return nil
+	case frameWindowUpdate:
+		return sc.onWindowUpdate(h, payload)
+	default:
+		// unknown frame types are ignored
+		return nil
+	}
+}
+
+func (sc *serverConn) onHeaders(h frameHeader, payload []byte) error {
+	if h.streamID == 0 {
+		return connError{ErrCodeProtocol, "HEADERS on stream 0"}
+	}
+	payload, err := stripPadding(h, payload)
+	if err != nil {
+		return err
+	}
+	if h.has(flagPriority) {
+		if len(payload) < 5 {
+			return connError{ErrCodeFrameSize, "HEADERS too short for its priority"}
+		}
+		payload = payload[5:]
+	}
+	if !h.has(flagEndHeaders) {
+		sc.continued = &headerBlock{
+			streamID:  h.streamID,
+			block:     append([]byte(nil), payload...),
+			endStream: h.has(flagEndStream),
+		}
+		return nil
+	}
+	return sc.onHeaderBlock(h.streamID, payload, h.has(flagEndStream))
+}
+
+func (sc *serverConn) onContinuation(h frameHeader, payload []byte) error {
+	if sc.continued == nil {
+		return connError{ErrCodeProtocol, "unexpected CONTINUATION"}
+	}
+	sc.continued.block = append(sc.continued.block, payload...)
+	if len(sc.continued.block) > int(sc.srv.maxHeaderListSize) {
+		return connError{ErrCodeEnhanceYourCalm, "header block too large"}
+	}
+	if !h.has(flagEndHeaders) {
+		return nil
+	}
+	hb := sc.continued
+	sc.continued = nil
+	return sc.onHeaderBlock(hb.streamID, hb.block, hb.endStream)
+}
+
+// onHeaderBlock handles a complete header block, which opens a stream or
+// carries the trailers of an open one.
+func (sc *serverConn) onHeaderBlock(id uint32, block []byte, endStream bool) error {
+	// decoded even for streams that are refused, to keep the table in sync
+	fields, err := sc.decoder.Decode(block)
+	if err != nil {
+		return connError{ErrCodeCompression, err.Error()}
+	}
+	size := 0
+	for _, f := range fields {
+		size += len(f.Name) + len(f.Value) + 32
+	}
+
+	sc.mu.Lock()
+	st := sc.streams[id]
+	sc.mu.Unlock()
+	if st != nil {
+		if st.remoteClosed {
+			return streamError{id, ErrCodeStreamClosed, "HEADERS after the end of the stream"}
+		}
+		if !endStream {
+			return streamError{id, ErrCodeProtocol, "trailers must end the stream"}
+		}
+		trailers, err := trailerFields(fields)
+		if err != nil {
+			return streamError{id, ErrCodeProtocol, err.Error()}
+		}
+		st.trailers = trailers
+		return sc.endRequest(st)
+	}
+
+	if id%2 == 0 {
+		return connError{ErrCodeProtocol, fmt.Sprintf("client opened even stream %d", id)}
+	}
+	if id <= sc.lastStreamID {
+		return streamError{id, ErrCodeStreamClosed, "HEADERS on a closed stream"}
+	}
+	sc.mu.Lock()
+	sc.lastStreamID = id
+	refused := sc.goingAway || uint32(sc.active) >= sc.srv.maxConcurrentStreams
+	sc.mu.Unlock()
+	if refused {
+		return streamError{id, ErrCodeRefusedStream, "too many concurrent streams"}
+	}
+	if size > int(sc.srv.maxHeaderListSize) {
+		return streamError{id, ErrCodeRefusedStream, "header list too large"}
+	}
+	head, err := requestFields(fields)
+	if err != nil {
+		return streamError{id, ErrCodeProtocol, err.Error()}
+	}
+	if head.contentLength > sc.srv.maxBodySize {
+		return streamError{id, ErrCodeCancel, "body too large"}
+	}
+	st = sc.newStream(id)
+	st.head = head
+	if endStream {
+		return sc.endRequest(st)
+	}
+	return nil
+}
+
+func (sc *serverConn) onData(h frameHeader, payload []byte) error {
+	if h.streamID == 0 {
+		return connError{ErrCodeProtocol, "DATA on stream 0"}
+	}
+	// padding counts against flow control too
+	n := int64(h.length)
+	sc.recvWindow -= n
+	if sc.recvWindow < 0 {
+		return connError{ErrCodeFlowControl, "connection window exceeded"}
+	}
+	if err := sc.replenish(0, &sc.recvWindow); err != nil {
+		return err
+	}
+	data, err := stripPadding(h, payload)
+	if err != nil {
+		return err
+	}
+
+	sc.mu.Lock()
+	st := sc.streams[h.streamID]
+	idle := sc.idle(h.streamID)
+	sc.mu.Unlock()
+	switch {
+	case st == nil && idle:
+		return connError{ErrCodeProtocol, "DATA on an idle stream"}
+	case st == nil:
+		// the stream was reset while the client was still sending
+		return nil
+	case st.remoteClosed:
+		return streamError{h.streamID, ErrCodeStreamClosed, "DATA after the end of the stream"}
+	}
+	st.recvWindow -= n
+	if st.recvWindow < 0 {
+		return streamError{st.id, ErrCodeFlowControl, "stream window exceeded"}
+	}
+	if int64(len(st.body)+len(data)) > sc.srv.maxBodySize {
+		return streamError{st.id, ErrCodeCancel, "body too large"}
+	}
+	st.body = append(st.body, data...)
+	if st.head.contentLength >= 0 && int64(len(st.body)) > st.head.contentLength {
+		return streamError{st.id, ErrCodeProtocol, "body longer than its content-length"}
+	}
+	if h.has(flagEndStream) {
+		return sc.endRequest(st)
+	}
+	return sc.replenish(st.id, &st.recvWindow)
+}
+
+// replenish gives the client back the window it used up once half of it is
+// gone. Bodies are buffered as they arrive, so they never hold it back; what
+// a stream may buffer is bounded by WithMaxBodySize instead. The connection
+// window starts at the default size and cannot shrink below it.
+func (sc *serverConn) replenish(streamID uint32, window *int64) error {
+	size := int64(sc.srv.initialWindowSize)
+	if streamID == 0 {
+		size = max(size, defaultWindowSize)
+	}
+	if *window > size/2 {
+		return nil
+	}
+	increment := size - *window
+	*window = size
+	return sc.writeWindowUpdate(streamID, uint32(increment))
+}
+
+// endRequest handles the end of the client's half of st and starts its
+// handler.
+func (sc *serverConn) endRequest(st *stream) error {
+	if st.head.contentLength >= 0 && int64(len(st.body)) != st.head.contentLength {
+		return streamError{st.id, ErrCodeProtocol, "body shorter than its content-length"}
+	}
+	sc.mu.Lock()
+	st.remoteClosed = true
+	sc.mu.Unlock()
+	req, err := st.head.request(st.body, sc.srv.requestOpts)
+	if req != nil {
+		req.Trailers = st.trailers
+		req.TLS = sc.tls
+	}
+	sc.dispatch(st, req, err)
+	return nil
+}
+
+// dispatch runs the handler for st, or the invalid request handler when err
+// is set. A client stream keeps counting against the concurrency limit until
+// the handler returns, so resetting streams cannot pile up handlers.
+func (sc *serverConn) dispatch(st *stream, req *request.Request, err error) {
+	sc.handlers.Add(1)
+	sc.mu.Lock()
+	st.running = true
+	sc.mu.Unlock()
+	go func() {
+		defer sc.handlers.Done()
+		defer st.cancel(nil)
+		defer sc.handlerDone(st)
+		w := response.NewFramedWriter(st)
+		switch {
+		case err == nil:
+			req.SetContext(st.ctx)
+			if err := sc.srv.handler(w, req); err != nil {
+				sc.resetStream(st.id, ErrCodeInternal)
+				return
+			}
+		case sc.srv.invalidRequest != nil:
+			sc.srv.invalidRequest(w, err)
+			w.Finish()
+		default:
+			log.Printf("HTTP/2 stream %d: invalid request: %v", st.id, err)
+		}
+		st.finish()
+	}()
+}
+
+func (sc *serverConn) onReset(h frameHeader, payload []byte) error {
+	if h.streamID == 0 {
+		return connError{ErrCodeProtocol, "RST_STREAM on stream 0"}
+	}
+	if len(payload) != 4 {
+		return connError{ErrCodeFrameSize, "RST_STREAM must be 4 bytes"}
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.idle(h.streamID) {
+		return connError{ErrCodeProtocol, "RST_STREAM on an idle stream"}
+	}
+	if st := sc.streams[h.streamID]; st != nil {
+		sc.closeStream(st, ErrStreamReset)
+		if st.id%2 == 1 && sc.countReset() {
+			return connError{ErrCodeEnhanceYourCalm, "too many stream resets"}
+		}
+	}
+	return nil
+}
+
+// handlerDone releases the concurrency slot of a client stream whose handler
+// returned after the stream was closed.
+func (sc *serverConn) handlerDone(st *stream) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	st.running = false
+	if _, open := sc.streams[st.id]; !open && st.id%2 == 1 {
+		sc.active--
+	}
+}
+
+// countReset records a stream reset by the client and reports whether the
+// client reset more streams within the last second than the server allows,
+// which is how the Rapid Reset attack (CVE-2023-44487) looks.
+func (sc *serverConn) countReset() bool {
+	now := time.Now()
+	if now.Sub(sc.resetsSince) > time.Second {
+		sc.resetsSince = now
+		sc.resets = 0
+	}
+	sc.resets++
+	return sc.resets > sc.srv.maxResetRate
+}
+
+// resetStream sends RST_STREAM and forgets the stream.
+func (sc *serverConn) resetStream(id uint32, code ErrCode) {
+	sc.mu.Lock()
+	st := sc.streams[id]
+	if st != nil {
+		if st.localClosed {
+			st = nil
+		} else {
+			st.localClosed = true
+			sc.closeStream(st, ErrStreamReset)
+		}
+	}
+	sc.mu.Unlock()
+	sc.writeFrame(frameRSTStream, 0, id, binary.BigEndian.AppendUint32(nil, uint32(code)))
+}
+
+// closeStream removes st and wakes its writers. Called with mu held.
+func (sc *serverConn) closeStream(st *stream, cause error) {
+	st.reset = st.reset || cause != nil
+	_, open := sc.streams[st.id]
+	switch {
+	case open && st.id%2 == 0:
+		sc.pushes--
+	case open && !st.running:
+		sc.active--
+	}
+	delete(sc.streams, st.id)
+	if cause != nil {
+		st.cancel(cause)
+	}
+	sc.cond.Broadcast()
+	sc.closeIfDone()
+}
+
+// idle reports whether stream id was never opened, by the client for odd ids
+// and by a push for even ones. Called with mu held.
+func (sc *serverConn) idle(id uint32) bool {
+	if id%2 == 1 {
+		return id > sc.lastStreamID
+	}
+	return id >= sc.nextPushID
+}
+
+func (sc *serverConn) onSettings(h frameHeader, payload []byte) error {
+	if h.streamID != 0 {
+		return connError{ErrCodeProtocol, "SETTINGS on a stream"}
+	}
+	if h.has(flagAck) {
+		if len(payload) != 0 {
+			return connError{ErrCodeFrameSize, "SETTINGS ACK with a payload"}
+		}
+		return nil
+	}
+	settings, err := parseSettings(payload)
+	if err != nil {
+		return err
+	}
+	if err := sc.applySettings(settings); err != nil {
+		return err
+	}
+	return sc.writeFrame(frameSettings, flagAck, 0, nil)
+}
+
+func (sc *serverConn) applySettings(settings []setting) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, s := range settings {
+		switch s.id {
+		case settingHeaderTableSize:
+			sc.writeMu.Lock()
+			sc.encoder.SetMaxTableSize(int(s.value))
+			sc.writeMu.Unlock()
+		case settingEnablePush:
+			if s.value > 1 {
+				return connError{ErrCodeProtocol, "SETTINGS_ENABLE_PUSH must be 0 or 1"}
+			}
+			sc.peerPush = s.value == 1
+		case settingMaxConcurrentStreams:
+			sc.peerMaxStreams = s.value
+		case settingInitialWindowSize:
+			if s.value > maxWindowSize {
+				return connError{ErrCodeFlowControl, "SETTINGS_INITIAL_WINDOW_SIZE too large"}
+			}
+			delta := int64(s.value) - sc.peerInitialWindow
+			for _, st := range sc.streams {
+				st.sendWindow += delta
+				if st.sendWindow > maxWindowSize {
+					return connError{ErrCodeFlowControl, "stream window overflow"}
+				}
+			}
+			sc.peerInitialWindow = int64(s.value)
+		case settingMaxFrameSize:
+			if s.value < defaultMaxFrameSize || s.value > maxFrameSizeLimit {
+				return connError{ErrCodeProtocol, "SETTINGS_MAX_FRAME_SIZE out of range"}
+			}
+			sc.peerMaxFrameSize = s.value
+		}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) onWindowUpdate(h frameHeader, payload []byte) error {
+	if len(payload) != 4 {
+		return connError{ErrCodeFrameSize, "WINDOW_UPDATE must be 4 bytes"}
+	}
+	increment := int64(binary.BigEndian.Uint32(payload) & (1<<31 - 1))
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if h.streamID == 0 {
+		if increment == 0 {
+			return connError{ErrCodeProtocol, "WINDOW_UPDATE of 0"}
+		}
+		sc.sendWindow += increment
+		if sc.sendWindow > maxWindowSize {
+			return connError{ErrCodeFlowControl, "connection window overflow"}
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+	st := sc.streams[h.streamID]
+	switch {
+	case st == nil && sc.idle(h.streamID):
+		return connError{ErrCodeProtocol, "WINDOW_UPDATE on an idle stream"}
+	case st == nil:
+		return nil
+	case increment == 0:
+		return streamError{h.streamID, ErrCodeProtocol, "WINDOW_UPDATE of 0"}
+	}
+	st.sendWindow += increment
+	if st.sendWindow > maxWindowSize {
+		return streamError{h.streamID, ErrCodeFlowControl, "stream window overflow"}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) newStream(id uint32) *stream {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	st := &stream{
+		sc:         sc,
+		id:         id,
+		sendWindow: sc.peerInitialWindow,
+		recvWindow: int64(sc.srv.initialWindowSize),
+	}
+	st.ctx, st.cancel = context.WithCancelCause(sc.ctx)
+	sc.streams[id] = st
+	sc.active++
+	return st
+}
+
+func (sc *serverConn) writeSettings() error {
+	payload := appendSettings(nil,
+		setting{settingMaxConcurrentStreams, sc.srv.maxConcurrentStreams},
+		setting{settingInitialWindowSize, sc.srv.initialWindowSize},
+		setting{settingMaxHeaderListSize, sc.srv.maxHeaderListSize},
+	)
+	if err := sc.writeFrame(frameSettings, 0, 0, payload); err != nil {
+		return err
+	}
+	if sc.srv.initialWindowSize > defaultWindowSize {
+		sc.recvWindow = int64(sc.srv.initialWindowSize)
+		return sc.writeWindowUpdate(0, sc.srv.initialWindowSize-defaultWindowSize)
+	}
+	return nil
+}
+
+func (sc *serverConn) writeWindowUpdate(streamID, increment uint32) error {
+	return sc.writeFrame(frameWindowUpdate, 0, streamID, binary.BigEndian.AppendUint32(nil, increment))
+}
+
+func (sc *serverConn) writeGoAway(code ErrCode, debug string) error {
+	sc.mu.Lock()
+	last := sc.lastStreamID
+	sc.goingAway = true
+	sc.mu.Unlock()
+	payload := binary.BigEndian.AppendUint32(nil, last)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	return sc.writeFrame(frameGoAway, 0, 0, append(payload, debug...))
+}
+
+func (sc *serverConn) writeFrame(typ frameType, flags uint8, streamID uint32, payload []byte) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	_, err := sc.conn.Write(appendFrame(nil, typ, flags, streamID, payload))
+	return err
+}
+
+// writeHeaders encodes fields and sends them as HEADERS plus as many
+// CONTINUATION frames as the peer's frame size requires.
+func (sc *serverConn) writeHeaders(streamID uint32, fields []hpack.HeaderField, endStream bool) error {
+	var flags uint8
+	if endStream {
+		flags = flagEndStream
+	}
+	return sc.writeHeaderBlock(frameHeaders, flags, streamID, nil, fields)
+}
+
+// writePushPromise promises stream promisedID, whose request has fields, on
+// stream streamID.
+func (sc *serverConn) writePushPromise(streamID, promisedID uint32, fields []hpack.HeaderField) error {
+	return sc.writeHeaderBlock(framePushPromise, 0, streamID, binary.BigEndian.AppendUint32(nil, promisedID), fields)
+}
+
+// writeHeaderBlock sends a frame of type typ holding prefix and the encoded
+// fields, followed by CONTINUATION frames for what does not fit in it.
+func (sc *serverConn) writeHeaderBlock(typ frameType, flags uint8, streamID uint32, prefix []byte, fields []hpack.HeaderField) error {
+	sc.mu.Lock()
+	maxSize := int(sc.peerMaxFrameSize)
+	sc.mu.Unlock()
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	block := sc.encoder.Encode(prefix, fields)
+	var buf []byte
+	for {
+		chunk := block[:min(len(block), maxSize)]
+		block = block[len(chunk):]
+		if len(block) == 0 {
+			flags |= flagEndHeaders
+		}
+		buf = appendFrame(buf, typ, flags, streamID, chunk)
+		if len(block) == 0 {
+			break
+		}
+		typ, flags = frameContinuation, 0
+	}
+	_, err := sc.conn.Write(buf)
+	return err
+}
@@ -0,0 +1,199 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ClientPreface starts every HTTP/2 connection, before the client's SETTINGS.
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+type frameType uint8
+
+const (
+	frameData         frameType = 0x0
+	frameHeaders      frameType = 0x1
+	framePriority     frameType = 0x2
+	frameRSTStream    frameType = 0x3
+	frameSettings     frameType = 0x4
+	framePushPromise  frameType = 0x5
+	framePing         frameType = 0x6
+	frameGoAway       frameType = 0x7
+	frameWindowUpdate frameType = 0x8
+	frameContinuation frameType = 0x9
+)
+
+const (
+	flagEndStream  = 0x1
+	flagAck        = 0x1
+	flagEndHeaders = 0x4
+	flagPadded     = 0x8
+	flagPriority   = 0x20
+)
+
+type settingID uint16
+
+const (
+	settingHeaderTableSize      settingID = 0x1
+	settingEnablePush           settingID = 0x2
+	settingMaxConcurrentStreams settingID = 0x3
+	settingInitialWindowSize    settingID = 0x4
+	settingMaxFrameSize         settingID = 0x5
+	settingMaxHeaderListSize    settingID = 0x6
+)
+
+const (
+	frameHeaderLen      = 9
+	defaultMaxFrameSize = 16384
+	maxFrameSizeLimit   = 1<<24 - 1
+	defaultWindowSize   = 65535
+	maxWindowSize       = 1<<31 - 1
+)
+
+// ErrCode is the error code carried by RST_STREAM and GOAWAY frames.
+type ErrCode uint32
+
+const (
+	ErrCodeNo                 ErrCode = 0x0
+	ErrCodeProtocol           ErrCode = 0x1
+	ErrCodeInternal           ErrCode = 0x2
+	ErrCodeFlowControl        ErrCode = 0x3
+	ErrCodeSettingsTimeout    ErrCode = 0x4
+	ErrCodeStreamClosed       ErrCode = 0x5
+	ErrCodeFrameSize          ErrCode = 0x6
+	ErrCodeRefusedStream      ErrCode = 0x7
+	ErrCodeCancel             ErrCode = 0x8
+	ErrCodeCompression        ErrCode = 0x9
+	ErrCodeConnect            ErrCode = 0xa
+	ErrCodeEnhanceYourCalm    ErrCode = 0xb
+	ErrCodeInadequateSecurity ErrCode = 0xc
+	ErrCodeHTTP11Required     ErrCode = 0xd
+)
+
+var errCodeNames = map[ErrCode]string{
+	ErrCodeNo:                 "NO_ERROR",
+	ErrCodeProtocol:           "PROTOCOL_ERROR",
+	ErrCodeInternal:           "INTERNAL_ERROR",
+	ErrCodeFlowControl:        "FLOW_CONTROL_ERROR",
+	ErrCodeSettingsTimeout:    "SETTINGS_TIMEOUT",
+	ErrCodeStreamClosed:       "STREAM_CLOSED",
+	ErrCodeFrameSize:          "FRAME_SIZE_ERROR",
+	ErrCodeRefusedStream:      "REFUSED_STREAM",
+	ErrCodeCancel:             "CANCEL",
+	ErrCodeCompression:        "COMPRESSION_ERROR",
+	ErrCodeConnect:            "CONNECT_ERROR",
+	ErrCodeEnhanceYourCalm:    "ENHANCE_YOUR_CALM",
+	ErrCodeInadequateSecurity: "INADEQUATE_SECURITY",
+	ErrCodeHTTP11Required:     "HTTP_1_1_REQUIRED",
+}
+
+func (c ErrCode) String() string {
+	if name, ok := errCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown error code 0x%x", uint32(c))
+}
+
+// connError ends the whole connection with a GOAWAY.
+type connError struct {
+	code   ErrCode
+	reason string
+}
+
+func (e connError) Error() string {
+	return fmt.Sprintf("http2: connection error %s: %s", e.code, e.reason)
+}
+
+// streamError ends a single stream with a RST_STREAM.
+type streamError struct {
+	streamID uint32
+	code     ErrCode
+	reason   string
+}
+
+func (e streamError) Error() string {
+	return fmt.Sprintf("http2: stream %d error %s: %s", e.streamID, e.code, e.reason)
+}
+
+type frameHeader struct {
+	length   uint32
+	typ      frameType
+	flags    uint8
+	streamID uint32
+}
+
+func (h frameHeader) has(flag uint8) bool {
+	return h.flags&flag != 0
+}
+
+// readFrame reads the next frame into buf, growing it as needed, and returns
+// its header and payload. Frames larger than maxSize are a connection error.
+func readFrame(r io.Reader, buf []byte, maxSize uint32) (frameHeader, []byte, error) {
+	var head [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return frameHeader{}, nil, err
+	}
+	h := frameHeader{
+		length:   uint32(head[0])<<16 | uint32(head[1])<<8 | uint32(head[2]),
+		typ:      frameType(head[3]),
+		flags:    head[4],
+		streamID: binary.BigEndian.Uint32(head[5:]) & (1<<31 - 1),
+	}
+	if h.length > maxSize {
+		return h, nil, connError{ErrCodeFrameSize, fmt.Sprintf("frame of %d bytes exceeds %d", h.length, maxSize)}
+	}
+	if uint32(cap(buf)) < h.length {
+		buf = make([]byte, h.length)
+	}
+	payload := buf[:h.length]
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return h, nil, err
+	}
+	return h, payload, nil
+}
+
+func appendFrame(dst []byte, typ frameType, flags uint8, streamID uint32, payload []byte) []byte {
+	n := len(payload)
+	dst = append(dst, byte(n>>16), byte(n>>8), byte(n), byte(typ), flags)
+	dst = binary.BigEndian.AppendUint32(dst, streamID)
+	return append(dst, payload...)
+}
+
+// stripPadding removes the padding of a PADDED frame.
+func stripPadding(h frameHeader, payload []byte) ([]byte, error) {
+	if !h.has(flagPadded) {
+		return payload, nil
+	}
+	if len(payload) == 0 || int(payload[0]) >= len(payload) {
+		return nil, connError{ErrCodeProtocol, "padding exceeds the frame payload"}
+	}
+	return payload[1 : len(payload)-int(payload[0])], nil
+}
+
+type setting struct {
+	id    settingID
+	value uint32
+}
+
+func appendSettings(dst []byte, settings ...setting) []byte {
+	for _, s := range settings {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(s.id))
+		dst = binary.BigEndian.AppendUint32(dst, s.value)
+	}
+	return dst
+}
+
+func parseSettings(payload []byte) ([]setting, error) {
+	if len(payload)%6 != 0 {
+		return nil, connError{ErrCodeFrameSize, "SETTINGS payload is not a multiple of 6 bytes"}
+	}
+	settings := make([]setting, 0, len(payload)/6)
+	for i := 0; i < len(payload); i += 6 {
+		settings = append(settings, setting{
+			id:    settingID(binary.BigEndian.Uint16(payload[i:])),
+			value: binary.BigEndian.Uint32(payload[i+2:]),
+		})
+	}
+	return settings, nil
+}
@@ -0,0 +1,423 @@
+// Package hpack implements HPACK, the header compression of HTTP/2 (RFC 7541).
+package hpack
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DefaultTableSize is the dynamic table size both sides start with.
+const DefaultTableSize = 4096
+
+// entryOverhead is added to the length of name and value to get the size of a
+// table entry.
+const entryOverhead = 32
+
+var (
+	ErrInvalidEncoding = errors.New("hpack: invalid encoding")
+	ErrInvalidIndex    = errors.New("hpack: invalid table index")
+	ErrTableSize       = errors.New("hpack: dynamic table size update exceeds the limit")
+	ErrStringTooLong   = errors.New("hpack: string exceeds the limit")
+)
+
+// HeaderField is a name-value pair. Sensitive fields are never added to a
+// dynamic table, by this encoder or any intermediary.
+type HeaderField struct {
+	Name      string
+	Value     string
+	Sensitive bool
+}
+
+func (f HeaderField) size() int {
+	return len(f.Name) + len(f.Value) + entryOverhead
+}
+
+var staticTable = []HeaderField{
+	{Name: ":authority"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language"},
+	{Name: "accept-ranges"},
+	{Name: "accept"},
+	{Name: "access-control-allow-origin"},
+	{Name: "age"},
+	{Name: "allow"},
+	{Name: "authorization"},
+	{Name: "cache-control"},
+	{Name: "content-disposition"},
+	{Name: "content-encoding"},
+	{Name: "content-language"},
+	{Name: "content-length"},
+	{Name: "content-location"},
+	{Name: "content-range"},
+	{Name: "content-type"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "expect"},
+	{Name: "expires"},
+	{Name: "from"},
+	{Name: "host"},
+	{Name: "if-match"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "if-range"},
+	{Name: "if-unmodified-since"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "max-forwards"},
+	{Name: "proxy-authenticate"},
+	{Name: "proxy-authorization"},
+	{Name: "range"},
+	{Name: "referer"},
+	{Name: "refresh"},
+	{Name: "retry-after"},
+	{Name: "server"},
+	{Name: "set-cookie"},
+	{Name: "strict-transport-security"},
+	{Name: "transfer-encoding"},
+	{Name: "user-agent"},
+	{Name: "vary"},
+	{Name: "via"},
+	{Name: "www-authenticate"},
+}
+
+// dynamicTable holds the entries header blocks added, oldest first.
+type dynamicTable struct {
+	entries []HeaderField
+	size    int
+	maxSize int
+}
+
+func (t *dynamicTable) add(f HeaderField) {
+	if f.size() > t.maxSize {
+		t.entries = t.entries[:0]
+		t.size = 0
+		return
+	}
+	t.evict(t.maxSize - f.size())
+	t.entries = append(t.entries, f)
+	t.size += f.size()
+}
+
+func (t *dynamicTable) setMaxSize(n int) {
+	t.maxSize = n
+	t.evict(n)
+}
+
+// evict drops the oldest entries until the table fits in size.
+func (t *dynamicTable) evict(size int) {
+	i := 0
+	for t.size > size {
+		t.size -= t.entries[i].size()
+		i++
+	}
+	if i > 0 {
+		t.entries = append(t.entries[:0], t.entries[i:]...)
+	}
+}
+
+// field returns the entry at index in the combined address space: static
+// entries from 1, then dynamic entries newest first.
+func (t *dynamicTable) field(index uint64) (HeaderField, error) {
+	switch {
+	case index == 0:
+		return HeaderField{}, ErrInvalidIndex
+	case index <= uint64(len(staticTable)):
+		return staticTable[index-1], nil
+	case index-uint64(len(staticTable)) <= uint64(len(t.entries)):
+		return t.entries[len(t.entries)-int(index-uint64(len(staticTable)))], nil
+	default:
+		return HeaderField{}, fmt.Errorf("%w: %d", ErrInvalidIndex, index)
+	}
+}
+
+// search returns the index of an entry matching f by name and value, or else
+// of one matching its name only, and whether both matched. 0 means no match.
+func (t *dynamicTable) search(f HeaderField) (uint64, bool) {
+	var nameIndex uint64
+	for i, e := range staticTable {
+		if e.Name != f.Name {
+			continue
+		}
+		if e.Value == f.Value {
+			return uint64(i + 1), true
+		}
+		if nameIndex == 0 {
+			nameIndex = uint64(i + 1)
+		}
+	}
+	for i := len(t.entries) - 1; i >= 0; i-- {
+		e := t.entries[i]
+		if e.Name != f.Name {
+			continue
+		}
+		index := uint64(len(staticTable) + len(t.entries) - i)
+		if e.Value == f.Value {
+			return index, true
+		}
+		if nameIndex == 0 {
+			nameIndex = index
+		}
+	}
+	return nameIndex, false
+}
+
+// Decoder decodes header blocks, keeping the dynamic table between them. It
+// must see every block of a connection in order.
+type Decoder struct {
+	table        dynamicTable
+	maxTableSize int
+	// MaxStringLength bounds each decoded name and value. Zero means no limit.
+	MaxStringLength int
+}
+
+// NewDecoder creates a Decoder accepting dynamic tables of up to
+// maxTableSize bytes, the SETTINGS_HEADER_TABLE_SIZE advertised to the peer.
+func NewDecoder(maxTableSize int) *Decoder {
+	return &Decoder{
+		table:        dynamicTable{maxSize: maxTableSize},
+		maxTableSize: maxTableSize,
+	}
+}
+
+// Decode decodes a complete header block.
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	sizeUpdateAllowed := true
+	for len(block) > 0 {
+		b := block[0]
+		switch {
+		case b&0x80 != 0:
+			// indexed field
+			index, n, err := readInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			block = block[n:]
+			f, err := d.table.field(index)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, f)
+		case b&0xc0 == 0x40:
+			// literal with incremental indexing
+			f, n, err := d.readLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			block = block[n:]
+			d.table.add(f)
+			fields = append(fields, f)
+		case b&0xe0 == 0x20:
+			if !sizeUpdateAllowed {
+				return nil, fmt.Errorf("%w: table size update after the first field", ErrInvalidEncoding)
+			}
+			size, n, err := readInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			block = block[n:]
+			if size > uint64(d.maxTableSize) {
+				return nil, fmt.Errorf("%w: %d", ErrTableSize, size)
+			}
+			d.table.setMaxSize(int(size))
+			continue
+		default:
+			// literal without indexing, or never indexed
+			f, n, err := d.readLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			block = block[n:]
+			f.Sensitive = b&0xf0 == 0x10
+			fields = append(fields, f)
+		}
+		sizeUpdateAllowed = false
+	}
+	return fields, nil
+}
+
+func (d *Decoder) readLiteral(block []byte, prefix uint8) (HeaderField, int, error) {
+	index, n, err := readInt(block, prefix)
+	if err != nil {
+		return HeaderField{}, 0, err
+	}
+	var f HeaderField
+	if index > 0 {
+		named, err := d.table.field(index)
+		if err != nil {
+			return HeaderField{}, 0, err
+		}
+		f.Name = named.Name
+	} else {
+		name, m, err := d.readString(block[n:])
+		if err != nil {
+			return HeaderField{}, 0, err
+		}
+		f.Name = name
+		n += m
+	}
+	value, m, err := d.readString(block[n:])
+	if err != nil {
+		return HeaderField{}, 0, err
+	}
+	f.Value = value
+	return f, n + m, nil
+}
+
+func (d *Decoder) readString(block []byte) (string, int, error) {
+	if len(block) == 0 {
+		return "", 0, fmt.Errorf("%w: truncated string", ErrInvalidEncoding)
+	}
+	huffman := block[0]&0x80 != 0
+	length, n, err := readInt(block, 7)
+	if err != nil {
+		return "", 0, err
+	}
+	if uint64(len(block)-n) < length {
+		return "", 0, fmt.Errorf("%w: truncated string", ErrInvalidEncoding)
+	}
+	raw := block[n : n+int(length)]
+	if !huffman {
+		if d.MaxStringLength > 0 && len(raw) > d.MaxStringLength {
+			return "", 0, ErrStringTooLong
+		}
+		return string(raw), n + int(length), nil
+	}
+	decoded, err := huffmanDecode(make([]byte, 0, len(raw)*8/5), raw)
+	if err != nil {
+		return "", 0, err
+	}
+	if d.MaxStringLength > 0 && len(decoded) > d.MaxStringLength {
+		return "", 0, ErrStringTooLong
+	}
+	return string(decoded), n + int(length), nil
+}
+
+// readInt decodes an integer with an N-bit prefix, returning it and the number
+// of bytes it took.
+func readInt(block []byte, prefix uint8) (uint64, int, error) {
+	if len(block) == 0 {
+		return 0, 0, fmt.Errorf("%w: truncated integer", ErrInvalidEncoding)
+	}
+	max := uint64(1)<<prefix - 1
+	value := uint64(block[0]) & max
+	if value < max {
+		return value, 1, nil
+	}
+	var shift uint
+	for i := 1; i < len(block); i++ {
+		b := block[i]
+		value += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value, i + 1, nil
+		}
+		shift += 7
+		if shift > 56 {
+			return 0, 0, fmt.Errorf("%w: integer overflow", ErrInvalidEncoding)
+		}
+	}
+	return 0, 0, fmt.Errorf("%w: truncated integer", ErrInvalidEncoding)
+}
+
+// appendInt encodes value with an N-bit prefix, keeping the bits of first
+// above the prefix.
+func appendInt(dst []byte, first byte, prefix uint8, value uint64) []byte {
+	max := uint64(1)<<prefix - 1
+	if value < max {
+		return append(dst, first|byte(value))
+	}
+	dst = append(dst, first|byte(max))
+	value -= max
+	for value >= 0x80 {
+		dst = append(dst, byte(value)|0x80)
+		value >>= 7
+	}
+	return append(dst, byte(value))
+}
+
+// appendString encodes s, Huffman-coded when that is shorter.
+func appendString(dst []byte, s string) []byte {
+	if n := huffmanLen(s); n < len(s) {
+		dst = appendInt(dst, 0x80, 7, uint64(n))
+		return huffmanEncode(dst, s)
+	}
+	dst = appendInt(dst, 0, 7, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// Encoder encodes header blocks, keeping the dynamic table between them. Its
+// output must reach the peer in the order it was produced.
+type Encoder struct {
+	table dynamicTable
+	// minSize is the smallest table size set since the last block, or -1
+	minSize int
+}
+
+func NewEncoder() *Encoder {
+	return &Encoder{
+		table:   dynamicTable{maxSize: DefaultTableSize},
+		minSize: -1,
+	}
+}
+
+// SetMaxTableSize applies the peer's SETTINGS_HEADER_TABLE_SIZE. The encoder
+// never uses more than DefaultTableSize; the change is announced at the start
+// of the next block.
+func (e *Encoder) SetMaxTableSize(n int) {
+	n = min(n, DefaultTableSize)
+	if n == e.table.maxSize {
+		return
+	}
+	if e.minSize == -1 || n < e.minSize {
+		e.minSize = n
+	}
+	e.table.setMaxSize(n)
+}
+
+// Encode appends the header block for fields to dst.
+func (e *Encoder) Encode(dst []byte, fields []HeaderField) []byte {
+	if e.minSize != -1 {
+		if e.minSize < e.table.maxSize {
+			dst = appendInt(dst, 0x20, 5, uint64(e.minSize))
+		}
+		dst = appendInt(dst, 0x20, 5, uint64(e.table.maxSize))
+		e.minSize = -1
+	}
+	for _, f := range fields {
+		index, full := e.table.search(f)
+		switch {
+		case full && !f.Sensitive:
+			dst = appendInt(dst, 0x80, 7, index)
+		case f.Sensitive:
+			dst = appendInt(dst, 0x10, 4, index)
+			if index == 0 {
+				dst = appendString(dst, f.Name)
+			}
+			dst = appendString(dst, f.Value)
+		default:
+			dst = appendInt(dst, 0x40, 6, index)
+			if index == 0 {
+				dst = appendString(dst, f.Name)
+			}
+			dst = appendString(dst, f.Value)
+			e.table.add(f)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,142 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+func TestDecodeRFCExamples(t *testing.T) {
+	first := []HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: "www.example.com"},
+	}
+	second := append(first[:3:3], HeaderField{Name: ":authority", Value: "www.example.com"}, HeaderField{Name: "cache-control", Value: "no-cache"})
+	third := []HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":path", Value: "/index.html"},
+		{Name: ":authority", Value: "www.example.com"},
+		{Name: "custom-key", Value: "custom-value"},
+	}
+
+	// Test: Requests without Huffman coding (RFC 7541 C.3)
+	d := NewDecoder(DefaultTableSize)
+	fields, err := d.Decode(decodeHex(t, "8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d"))
+	require.NoError(t, err)
+	assert.Equal(t, first, fields)
+	fields, err = d.Decode(decodeHex(t, "8286 84be 5808 6e6f 2d63 6163 6865"))
+	require.NoError(t, err)
+	assert.Equal(t, second, fields)
+	fields, err = d.Decode(decodeHex(t, "8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65"))
+	require.NoError(t, err)
+	assert.Equal(t, third, fields)
+	assert.Equal(t, 164, d.table.size)
+
+	// Test: Requests with Huffman coding (RFC 7541 C.4)
+	d = NewDecoder(DefaultTableSize)
+	fields, err = d.Decode(decodeHex(t, "8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff"))
+	require.NoError(t, err)
+	assert.Equal(t, first, fields)
+	fields, err = d.Decode(decodeHex(t, "8286 84be 5886 a8eb 1064 9cbf"))
+	require.NoError(t, err)
+	assert.Equal(t, second, fields)
+	fields, err = d.Decode(decodeHex(t, "8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf"))
+	require.NoError(t, err)
+	assert.Equal(t, third, fields)
+
+	// Test: Responses with eviction from a 256 byte table (RFC 7541 C.6)
+	d = NewDecoder(256)
+	d.table.setMaxSize(256)
+	fields, err = d.Decode(decodeHex(t, "4882 6402 5885 aec3 771a 4b61 96d0 7abe 9410 54d4 44a8 2005 9504 0b81 66e0 82a6 2d1b ff6e 919d 29ad 1718 63c7 8f0b 97c8 e9ae 82ae 43d3"))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{
+		{Name: ":status", Value: "302"},
+		{Name: "cache-control", Value: "private"},
+		{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+		{Name: "location", Value: "https://www.example.com"},
+	}, fields)
+	fields, err = d.Decode(decodeHex(t, "4883 640e ffc1 c0bf"))
+	require.NoError(t, err)
+	assert.Equal(t, HeaderField{Name: ":status", Value: "307"}, fields[0])
+	assert.Equal(t, 4, len(d.table.entries))
+	assert.Equal(t, 222, d.table.size)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	// Test: Index beyond both tables
+	_, err := NewDecoder(DefaultTableSize).Decode([]byte{0xbe})
+	assert.ErrorIs(t, err, ErrInvalidIndex)
+
+	// Test: Truncated string
+	_, err = NewDecoder(DefaultTableSize).Decode(decodeHex(t, "4005 6162"))
+	assert.ErrorIs(t, err, ErrInvalidEncoding)
+
+	// Test: Table size update above the advertised limit
+	_, err = NewDecoder(100).Decode(decodeHex(t, "3f46"))
+	assert.ErrorIs(t, err, ErrTableSize)
+
+	// Test: Table size update after a field
+	_, err = NewDecoder(DefaultTableSize).Decode(decodeHex(t, "8220"))
+	assert.ErrorIs(t, err, ErrInvalidEncoding)
+
+	// Test: Huffman padding that is not EOS, and padding longer than 7 bits
+	_, err = NewDecoder(DefaultTableSize).Decode(decodeHex(t, "0081 00"))
+	assert.ErrorIs(t, err, ErrInvalidHuffman)
+	_, err = NewDecoder(DefaultTableSize).Decode(decodeHex(t, "0082 ffff"))
+	assert.ErrorIs(t, err, ErrInvalidHuffman)
+
+	// Test: Strings over the limit
+	d := NewDecoder(DefaultTableSize)
+	d.MaxStringLength = 3
+	_, err = d.Decode(decodeHex(t, "0004 6162 6364 00"))
+	assert.ErrorIs(t, err, ErrStringTooLong)
+}
+
+func TestEncode(t *testing.T) {
+	fields := []HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "content-type", Value: "text/html; charset=utf-8"},
+		{Name: "x-custom", Value: strings.Repeat("a", 200)},
+		{Name: "set-cookie", Value: "session=secret", Sensitive: true},
+	}
+	e := NewEncoder()
+	d := NewDecoder(DefaultTableSize)
+
+	// Test: Round trip, and repeated fields shrink to indexes
+	first := e.Encode(nil, fields)
+	decoded, err := d.Decode(first)
+	require.NoError(t, err)
+	assert.Equal(t, fields, decoded)
+	second := e.Encode(nil, fields)
+	assert.Less(t, len(second), 30)
+	decoded, err = d.Decode(second)
+	require.NoError(t, err)
+	assert.Equal(t, fields, decoded)
+
+	// Test: Static matches are a single byte, and Huffman coding is used
+	assert.Equal(t, []byte{0x88}, NewEncoder().Encode(nil, fields[:1]))
+	assert.Equal(t, decodeHex(t, "418c f1e3 c2e5 f23a 6ba0 ab90 f4ff"), NewEncoder().Encode(nil, []HeaderField{{Name: ":authority", Value: "www.example.com"}}))
+
+	// Test: A smaller table size is announced before the next block
+	e.SetMaxTableSize(0)
+	e.SetMaxTableSize(64)
+	block := e.Encode(nil, fields[1:2])
+	assert.Equal(t, []byte{0x20, 0x3f, 0x21}, block[:3])
+	decoded, err = d.Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, fields[1:2], decoded)
+	assert.Equal(t, 64, d.table.maxSize)
+}
@@ -0,0 +1,241 @@
+// Package http2 serves HTTP/2 (RFC 9113) connections, handing every stream
+// to the same handlers HTTP/1.x requests go to.
+package http2
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"github.com/alexmarian/httpfromtcp/internal/headers"
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/alexmarian/httpfromtcp/internal/response"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxConcurrentStreams = 100
+	DefaultInitialWindowSize    = 1 << 20
+	DefaultMaxHeaderListSize    = 1 << 20
+	DefaultMaxBodySize          = 10 << 20
+	DefaultMaxResetRate         = 100
+)
+
+const settingsHeader = "HTTP2-Settings"
+
+var (
+	// ErrStreamReset is the cause of a request context cancelled because the
+	// client reset the stream, and the error of writes to such a stream.
+	ErrStreamReset = errors.New("http2: stream reset")
+	// ErrConnectionClosed is the cause of request contexts cancelled because
+	// the connection ended.
+	ErrConnectionClosed = errors.New("http2: connection closed")
+	// ErrInvalidUpgrade is returned by ServeUpgrade for a request that is not
+	// an h2c upgrade.
+	ErrInvalidUpgrade = errors.New("http2: invalid h2c upgrade")
+	// ErrTooManyPushes is returned by Push while the client's limit on
+	// concurrent streams is taken up by pushed ones.
+	ErrTooManyPushes = errors.New("http2: too many pushed streams")
+)
+
+// Handler serves the request of one stream. Once it returns, a response it
+// left open is ended and a stream it never answered is reset. Returning an
+// error resets the stream whatever was sent.
+type Handler func(w *response.Writer, req *request.Request) error
+
+// Server holds the configuration shared by the connections it serves.
+type Server struct {
+	handler              Handler
+	invalidRequest       func(w *response.Writer, err error)
+	maxConcurrentStreams uint32
+	initialWindowSize    uint32
+	maxHeaderListSize    uint32
+	maxBodySize          int64
+	maxResetRate         int
+	idleTimeout          time.Duration
+	requestOpts          []request.Option
+	push                 bool
+
+	mu           sync.Mutex
+	conns        map[*serverConn]struct{}
+	shuttingDown bool
+}
+
+type Option func(*Server)
+
+// WithMaxConcurrentStreams limits how many streams a client may have open at
+// once. A stream counts until its handler returns, even when the client
+// reset it earlier. Further streams are refused.
+func WithMaxConcurrentStreams(n uint32) Option {
+	return func(s *Server) {
+		s.maxConcurrentStreams = n
+	}
+}
+
+// WithInitialWindowSize sets how many request body bytes a client may send on
+// each stream, and on the connection, before waiting for a WINDOW_UPDATE.
+func WithInitialWindowSize(n uint32) Option {
+	return func(s *Server) {
+		s.initialWindowSize = min(n, maxWindowSize)
+	}
+}
+
+// WithMaxHeaderListSize limits the decoded size of a request's header fields.
+func WithMaxHeaderListSize(n uint32) Option {
+	return func(s *Server) {
+		s.maxHeaderListSize = n
+	}
+}
+
+// WithMaxBodySize limits the request body a stream may buffer. Streams that
+// announce or send a larger body are reset with CANCEL.
+func WithMaxBodySize(n int64) Option {
+	return func(s *Server) {
+		s.maxBodySize = n
+	}
+}
+
+// WithMaxResetRate limits how many open streams a client may reset per
+// second. A client resetting more, as in the Rapid Reset attack, is sent
+// GOAWAY with ENHANCE_YOUR_CALM.
+func WithMaxResetRate(n int) Option {
+	return func(s *Server) {
+		s.maxResetRate = n
+	}
+}
+
+// WithIdleTimeout closes connections that had no open stream for d.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = d
+	}
+}
+
+// WithRequestOptions sets the options requests are validated with.
+func WithRequestOptions(opts ...request.Option) Option {
+	return func(s *Server) {
+		s.requestOpts = append(s.requestOpts, opts...)
+	}
+}
+
+// WithPush lets handlers push responses with Writer.Push to clients that
+// have not disabled it.
+func WithPush() Option {
+	return func(s *Server) {
+		s.push = true
+	}
+}
+
+// WithInvalidRequestHandler lets f answer requests that were well framed but
+// failed validation, such as an unsupported method. By default their streams
+// are reset.
+func WithInvalidRequestHandler(f func(w *response.Writer, err error)) Option {
+	return func(s *Server) {
+		s.invalidRequest = f
+	}
+}
+
+func NewServer(handler Handler, opts ...Option) *Server {
+	s := &Server{
+		handler:              handler,
+		maxConcurrentStreams: DefaultMaxConcurrentStreams,
+		initialWindowSize:    DefaultInitialWindowSize,
+		maxHeaderListSize:    DefaultMaxHeaderListSize,
+		maxBodySize:          DefaultMaxBodySize,
+		maxResetRate:         DefaultMaxResetRate,
+		conns:                make(map[*serverConn]struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// ServeConn serves HTTP/2 on conn until the client or ctx ends it. reader
+// supplies the connection's bytes, starting with the client preface; it
+// differs from conn when bytes were read ahead. For a *tls.Conn that already
+// completed its handshake, requests carry the TLS session. conn is closed on
+// return.
+func (s *Server) ServeConn(ctx context.Context, conn net.Conn, reader io.Reader) error {
+	sc := newServerConn(ctx, s, conn, reader)
+	return sc.serve(nil, nil)
+}
+
+// Shutdown sends GOAWAY on every connection, each of which closes once the
+// streams it already accepted are done. Connections served afterwards are
+// sent GOAWAY right after their SETTINGS.
+func (s *Server) Shutdown() {
+	s.mu.Lock()
+	s.shuttingDown = true
+	conns := make([]*serverConn, 0, len(s.conns))
+	for sc := range s.conns {
+		conns = append(conns, sc)
+	}
+	s.mu.Unlock()
+	for _, sc := range conns {
+		sc.goAway()
+	}
+}
+
+// track adds sc to the connections Shutdown reaches, or removes it, and
+// reports whether the server is shutting down.
+func (s *Server) track(sc *serverConn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		s.conns[sc] = struct{}{}
+	} else {
+		delete(s.conns, sc)
+	}
+	return s.shuttingDown
+}
+
+// IsUpgrade reports whether req asks to switch to HTTP/2 over cleartext with
+// "Upgrade: h2c" and carries valid HTTP2-Settings.
+func IsUpgrade(req *request.Request) bool {
+	_, err := upgradeSettings(req)
+	return err == nil
+}
+
+func upgradeSettings(req *request.Request) ([]setting, error) {
+	if !req.ProtoAtLeast(1, 1) || !req.HasConnectionOption("upgrade") || !req.HasConnectionOption(settingsHeader) {
+		return nil, ErrInvalidUpgrade
+	}
+	upgrade, _ := req.Headers.Get("Upgrade")
+	found := false
+	for _, protocol := range strings.Split(upgrade, ",") {
+		found = found || strings.EqualFold(strings.TrimSpace(protocol), "h2c")
+	}
+	encoded, present := req.Headers.Get(settingsHeader)
+	if !found || !present || strings.Contains(encoded, ",") {
+		return nil, ErrInvalidUpgrade
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return nil, ErrInvalidUpgrade
+	}
+	settings, err := parseSettings(payload)
+	if err != nil {
+		return nil, ErrInvalidUpgrade
+	}
+	return settings, nil
+}
+
+// ServeUpgrade switches conn to HTTP/2 after req asked for it with IsUpgrade.
+// It answers 101 Switching Protocols and serves req on stream 1, followed by
+// whatever the client sends next. req must have been read in full.
+func (s *Server) ServeUpgrade(ctx context.Context, conn net.Conn, reader io.Reader, req *request.Request) error {
+	settings, err := upgradeSettings(req)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	sc := newServerConn(ctx, s, conn, reader)
+	for _, name := range []string{headers.ConnectionHeader, "Upgrade", settingsHeader} {
+		req.Headers.Remove(name)
+	}
+	return sc.serve(settings, req)
+}
@@ -0,0 +1,576 @@
+package http2
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexmarian/httpfromtcp/internal/headers"
+	"github.com/alexmarian/httpfromtcp/internal/http2/hpack"
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/alexmarian/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClient speaks raw HTTP/2 frames to a server.
+type testClient struct {
+	t       *testing.T
+	conn    net.Conn
+	encoder *hpack.Encoder
+	decoder *hpack.Decoder
+	// fields holds the decoded block of the last HEADERS frame read
+	fields []hpack.HeaderField
+}
+
+type testResponse struct {
+	status  string
+	headers map[string]string
+	body    string
+}
+
+// echo answers with the method, path and body of the request.
+func echo(w *response.Writer, req *request.Request) error {
+	body := []byte(req.RequestLine.Method + " " + req.RequestLine.RequestTarget + " " + string(req.Body))
+	w.WriteStatusLine(response.SUCCESS)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+	return nil
+}
+
+// listen serves every accepted connection with serve and returns the address.
+func listen(t *testing.T, serve func(conn net.Conn)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func dialClient(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testClient{t: t, conn: conn, encoder: hpack.NewEncoder(), decoder: hpack.NewDecoder(hpack.DefaultTableSize)}
+}
+
+// newTestClient connects with prior knowledge and sends the preface and
+// settings.
+func newTestClient(t *testing.T, s *Server, settings ...setting) *testClient {
+	addr := listen(t, func(conn net.Conn) {
+		s.ServeConn(context.Background(), conn, conn)
+	})
+	c := dialClient(t, addr)
+	_, err := io.WriteString(c.conn, ClientPreface)
+	require.NoError(t, err)
+	c.writeFrame(frameSettings, 0, 0, appendSettings(nil, settings...))
+	return c
+}
+
+func (c *testClient) writeFrame(typ frameType, flags uint8, streamID uint32, payload []byte) {
+	_, err := c.conn.Write(appendFrame(nil, typ, flags, streamID, payload))
+	require.NoError(c.t, err)
+}
+
+// writeHeaders sends a HEADERS frame with fields given as name, value pairs.
+func (c *testClient) writeHeaders(streamID uint32, endStream bool, fields ...string) {
+	var hf []hpack.HeaderField
+	for i := 0; i < len(fields); i += 2 {
+		hf = append(hf, hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	flags := uint8(flagEndHeaders)
+	if endStream {
+		flags |= flagEndStream
+	}
+	c.writeFrame(frameHeaders, flags, streamID, c.encoder.Encode(nil, hf))
+}
+
+func (c *testClient) get(streamID uint32, path string) {
+	c.writeHeaders(streamID, true, ":method", "GET", ":scheme", "http", ":path", path, ":authority", "localhost")
+}
+
+// readFrame returns the next frame other than SETTINGS, WINDOW_UPDATE and
+// PING, acknowledging the server's SETTINGS and decoding the header blocks of
+// HEADERS and PUSH_PROMISE into fields.
+func (c *testClient) readFrame() (frameHeader, []byte) {
+	for {
+		h, payload, err := readFrame(c.conn, nil, maxFrameSizeLimit)
+		require.NoError(c.t, err)
+		switch {
+		case h.typ == frameSettings && !h.has(flagAck):
+			c.writeFrame(frameSettings, flagAck, 0, nil)
+		case h.typ == frameSettings, h.typ == frameWindowUpdate, h.typ == framePing:
+		case h.typ == frameHeaders:
+			c.fields, err = c.decoder.Decode(payload)
+			require.NoError(c.t, err)
+			return h, payload
+		case h.typ == framePushPromise:
+			c.fields, err = c.decoder.Decode(payload[4:])
+			require.NoError(c.t, err)
+			return h, payload
+		default:
+			return h, payload
+		}
+	}
+}
+
+// readResponses reads frames until n streams have ended.
+func (c *testClient) readResponses(n int) map[uint32]*testResponse {
+	responses := map[uint32]*testResponse{}
+	for ended := 0; ended < n; {
+		h, payload := c.readFrame()
+		resp := responses[h.streamID]
+		if resp == nil {
+			resp = &testResponse{headers: map[string]string{}}
+			responses[h.streamID] = resp
+		}
+		switch h.typ {
+		case frameHeaders:
+			for _, f := range c.fields {
+				if f.Name == ":status" {
+					resp.status = f.Value
+				} else {
+					resp.headers[f.Name] = f.Value
+				}
+			}
+		case frameData:
+			resp.body += string(payload)
+		default:
+			c.t.Fatalf("unexpected frame type %d on stream %d", h.typ, h.streamID)
+		}
+		if h.has(flagEndStream) {
+			ended++
+		}
+	}
+	return responses
+}
+
+// expect reads the next frame and checks it is a RST_STREAM or GOAWAY with
+// code.
+func (c *testClient) expect(typ frameType, code ErrCode) {
+	h, payload := c.readFrame()
+	require.Equal(c.t, typ, h.typ)
+	switch typ {
+	case frameRSTStream:
+		assert.Equal(c.t, code, ErrCode(binary.BigEndian.Uint32(payload)))
+	case frameGoAway:
+		assert.Equal(c.t, code, ErrCode(binary.BigEndian.Uint32(payload[4:])))
+	}
+}
+
+func TestPriorKnowledge(t *testing.T) {
+	c := newTestClient(t, NewServer(echo))
+
+	// Test: The server opens with its SETTINGS
+	h, payload, err := readFrame(c.conn, nil, maxFrameSizeLimit)
+	require.NoError(t, err)
+	assert.Equal(t, frameSettings, h.typ)
+	settings, err := parseSettings(payload)
+	require.NoError(t, err)
+	assert.Contains(t, settings, setting{settingMaxConcurrentStreams, DefaultMaxConcurrentStreams})
+
+	// Test: GET
+	c.get(1, "/hello")
+	resp := c.readResponses(1)[1]
+	assert.Equal(t, "200", resp.status)
+	assert.Equal(t, "GET /hello ", resp.body)
+	assert.Equal(t, "11", resp.headers["content-length"])
+	assert.NotContains(t, resp.headers, "connection")
+
+	// Test: POST with a body split over DATA frames
+	c.writeHeaders(3, false, ":method", "POST", ":scheme", "http", ":path", "/echo", ":authority", "localhost")
+	c.writeFrame(frameData, 0, 3, []byte("hello "))
+	c.writeFrame(frameData, flagEndStream, 3, []byte("world"))
+	resp = c.readResponses(1)[3]
+	assert.Equal(t, "POST /echo hello world", resp.body)
+
+	// Test: PING is acknowledged
+	c.writeFrame(framePing, 0, 0, []byte("12345678"))
+	for {
+		h, payload, err := readFrame(c.conn, nil, maxFrameSizeLimit)
+		require.NoError(t, err)
+		if h.typ == framePing {
+			assert.True(t, h.has(flagAck))
+			assert.Equal(t, "12345678", string(payload))
+			break
+		}
+	}
+}
+
+func TestMultiplexing(t *testing.T) {
+	release := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) error {
+		if req.RequestLine.RequestTarget == "/slow" {
+			<-release
+		} else {
+			close(release)
+		}
+		return echo(w, req)
+	}
+	c := newTestClient(t, NewServer(handler))
+
+	// Test: A later stream is answered while an earlier one is still running
+	c.get(1, "/slow")
+	c.get(3, "/fast")
+	h, _ := c.readFrame()
+	assert.Equal(t, uint32(3), h.streamID)
+	responses := c.readResponses(2)
+	assert.Equal(t, "GET /fast ", responses[3].body)
+	assert.Equal(t, "GET /slow ", responses[1].body)
+}
+
+func TestFlowControl(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	handler := func(w *response.Writer, req *request.Request) error {
+		w.WriteStatusLine(response.SUCCESS)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody([]byte(body))
+		return nil
+	}
+	c := newTestClient(t, NewServer(handler), setting{settingInitialWindowSize, 10})
+
+	// Test: The response stops at the client's window
+	c.get(1, "/")
+	h, _ := c.readFrame()
+	require.Equal(t, frameHeaders, h.typ)
+	h, payload := c.readFrame()
+	require.Equal(t, frameData, h.typ)
+	assert.Len(t, payload, 10)
+	c.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err := readFrame(c.conn, nil, maxFrameSizeLimit)
+	var ne net.Error
+	require.ErrorAs(t, err, &ne)
+	assert.True(t, ne.Timeout())
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// Test: WINDOW_UPDATE lets the rest through
+	c.writeFrame(frameWindowUpdate, 0, 1, binary.BigEndian.AppendUint32(nil, 90))
+	resp := c.readResponses(1)[1]
+	assert.Len(t, resp.body, 90)
+
+	// Test: A body larger than the window the server granted
+	c = newTestClient(t, NewServer(echo, WithInitialWindowSize(100)))
+	c.writeHeaders(1, false, ":method", "POST", ":scheme", "http", ":path", "/", ":authority", "localhost")
+	c.writeFrame(frameData, flagEndStream, 1, make([]byte, 101))
+	c.expect(frameRSTStream, ErrCodeFlowControl)
+}
+
+func TestStreamErrors(t *testing.T) {
+	c := newTestClient(t, NewServer(echo))
+
+	// Test: Missing :path resets the stream only
+	c.writeHeaders(1, true, ":method", "GET", ":scheme", "http")
+	c.expect(frameRSTStream, ErrCodeProtocol)
+
+	// Test: Uppercase field names are malformed
+	c.writeHeaders(3, true, ":method", "GET", ":scheme", "http", ":path", "/", "X-Upper", "1")
+	c.expect(frameRSTStream, ErrCodeProtocol)
+
+	// Test: Connection-specific fields are malformed
+	c.writeHeaders(5, true, ":method", "GET", ":scheme", "http", ":path", "/", "connection", "close")
+	c.expect(frameRSTStream, ErrCodeProtocol)
+
+	// Test: A body that does not match content-length
+	c.writeHeaders(7, false, ":method", "POST", ":scheme", "http", ":path", "/", "content-length", "3")
+	c.writeFrame(frameData, flagEndStream, 7, []byte("ab"))
+	c.expect(frameRSTStream, ErrCodeProtocol)
+
+	// Test: The connection is still usable
+	c.get(9, "/ok")
+	assert.Equal(t, "GET /ok ", c.readResponses(1)[9].body)
+
+	// Test: A stream id that does not increase
+	c.get(5, "/again")
+	c.expect(frameRSTStream, ErrCodeStreamClosed)
+
+	// Test: A client-opened even stream ends the connection
+	c.get(10, "/")
+	c.expect(frameGoAway, ErrCodeProtocol)
+
+	// Test: A connection that does not start with SETTINGS
+	addr := listen(t, func(conn net.Conn) {
+		NewServer(echo).ServeConn(context.Background(), conn, conn)
+	})
+	c = dialClient(t, addr)
+	_, err := io.WriteString(c.conn, ClientPreface)
+	require.NoError(t, err)
+	c.writeFrame(framePing, 0, 0, make([]byte, 8))
+	c.expect(frameGoAway, ErrCodeProtocol)
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	release := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) error {
+		<-release
+		return echo(w, req)
+	}
+	c := newTestClient(t, NewServer(handler, WithMaxConcurrentStreams(1)))
+
+	// Test: Streams past the limit are refused
+	c.get(1, "/first")
+	c.get(3, "/second")
+	c.expect(frameRSTStream, ErrCodeRefusedStream)
+	close(release)
+	assert.Equal(t, "GET /first ", c.readResponses(1)[1].body)
+}
+
+func TestRapidReset(t *testing.T) {
+	release := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) error {
+		switch req.RequestLine.RequestTarget {
+		case "/again":
+			return echo(w, req)
+		case "/stuck":
+			<-release
+		}
+		<-req.Context().Done()
+		return nil
+	}
+	c := newTestClient(t, NewServer(handler, WithMaxConcurrentStreams(1)))
+
+	// Test: A reset stream counts against the limit until its handler returns
+	c.get(1, "/stuck")
+	c.writeFrame(frameRSTStream, 0, 1, binary.BigEndian.AppendUint32(nil, uint32(ErrCodeCancel)))
+	c.get(3, "/next")
+	c.expect(frameRSTStream, ErrCodeRefusedStream)
+	close(release)
+	// the slot frees up once the handler has returned
+	for id := uint32(5); ; id += 2 {
+		require.Less(t, id, uint32(200))
+		c.get(id, "/again")
+		h, _ := c.readFrame()
+		if h.typ == frameHeaders {
+			break
+		}
+		require.Equal(t, frameRSTStream, h.typ)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Test: HEADERS and RST_STREAM in a loop end with ENHANCE_YOUR_CALM
+	c = newTestClient(t, NewServer(handler, WithMaxResetRate(10)))
+	var out []byte
+	for id := uint32(1); id <= 21; id += 2 {
+		block := c.encoder.Encode(nil, []hpack.HeaderField{
+			{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"},
+			{Name: ":path", Value: "/"}, {Name: ":authority", Value: "localhost"},
+		})
+		out = appendFrame(out, frameHeaders, flagEndHeaders|flagEndStream, id, block)
+		out = appendFrame(out, frameRSTStream, 0, id, binary.BigEndian.AppendUint32(nil, uint32(ErrCodeCancel)))
+	}
+	_, err := c.conn.Write(out)
+	require.NoError(t, err)
+	c.expect(frameGoAway, ErrCodeEnhanceYourCalm)
+}
+
+func TestMaxBodySize(t *testing.T) {
+	c := newTestClient(t, NewServer(echo, WithMaxBodySize(10)))
+
+	// Test: A body growing past the limit resets the stream
+	c.writeHeaders(1, false, ":method", "POST", ":scheme", "http", ":path", "/", ":authority", "localhost")
+	c.writeFrame(frameData, 0, 1, make([]byte, 6))
+	c.writeFrame(frameData, flagEndStream, 1, make([]byte, 6))
+	c.expect(frameRSTStream, ErrCodeCancel)
+
+	// Test: So does a content-length announcing it
+	c.writeHeaders(3, false, ":method", "POST", ":scheme", "http", ":path", "/", ":authority", "localhost", "content-length", "11")
+	c.expect(frameRSTStream, ErrCodeCancel)
+	c.writeFrame(frameData, flagEndStream, 3, make([]byte, 11))
+
+	// Test: Bodies within the limit are served
+	c.writeHeaders(5, false, ":method", "POST", ":scheme", "http", ":path", "/", ":authority", "localhost")
+	c.writeFrame(frameData, flagEndStream, 5, []byte("0123456789"))
+	assert.Equal(t, "POST / 0123456789", c.readResponses(1)[5].body)
+}
+
+func TestHandlerOutcomes(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) error {
+		switch req.RequestLine.RequestTarget {
+		case "/silent":
+			return nil
+		case "/fail":
+			w.WriteStatusLine(response.SUCCESS)
+			w.WriteHeaders(response.GetDefaultHeaders(0))
+			return fmt.Errorf("gave up")
+		case "/trailers":
+			h := headers.NewHeaders()
+			h.Set("Transfer-Encoding", "chunked")
+			h.Set("Trailer", "X-Checksum")
+			w.WriteStatusLine(response.SUCCESS)
+			w.WriteHeaders(h)
+			w.WriteChunkedBody([]byte("data"))
+			w.WriteChunkedBodyDone()
+			trailers := headers.NewHeaders()
+			trailers.Set("X-Checksum", "abc")
+			w.WriteTrailers(trailers)
+			return nil
+		}
+		return echo(w, req)
+	}
+	c := newTestClient(t, NewServer(handler))
+
+	// Test: A handler that never answers has its stream reset
+	c.get(1, "/silent")
+	c.expect(frameRSTStream, ErrCodeInternal)
+
+	// Test: A handler that returns an error has its stream reset
+	c.get(3, "/fail")
+	h, _ := c.readFrame()
+	assert.Equal(t, frameHeaders, h.typ)
+	c.expect(frameRSTStream, ErrCodeInternal)
+
+	// Test: Trailers end the stream in a HEADERS frame
+	c.get(5, "/trailers")
+	resp := c.readResponses(1)[5]
+	assert.Equal(t, "data", resp.body)
+	assert.Equal(t, "abc", resp.headers["x-checksum"])
+	assert.NotContains(t, resp.headers, "transfer-encoding")
+}
+
+func TestUpgrade(t *testing.T) {
+	s := NewServer(echo)
+	addr := listen(t, func(conn net.Conn) {
+		req, err := request.RequestFromReader(conn)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		s.ServeUpgrade(context.Background(), conn, io.MultiReader(bytes.NewReader(req.Buffered()), conn), req)
+	})
+	c := dialClient(t, addr)
+	settings := base64.RawURLEncoding.EncodeToString(appendSettings(nil, setting{settingInitialWindowSize, 1 << 16}))
+
+	// Test: The upgrade request is answered on stream 1 after the 101
+	_, err := io.WriteString(c.conn, "POST /up HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\n"+
+		"Upgrade: h2c\r\nHTTP2-Settings: "+settings+"\r\nContent-Length: 4\r\n\r\nbody")
+	require.NoError(t, err)
+	status := make([]byte, len("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"))
+	_, err = io.ReadFull(c.conn, status)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(status), "HTTP/1.1 101 Switching Protocols\r\n"))
+	_, err = io.WriteString(c.conn, ClientPreface)
+	require.NoError(t, err)
+	c.writeFrame(frameSettings, 0, 0, nil)
+	assert.Equal(t, "POST /up body", c.readResponses(1)[1].body)
+
+	// Test: Further requests use HTTP/2
+	c.get(3, "/next")
+	assert.Equal(t, "GET /next ", c.readResponses(1)[3].body)
+
+	// Test: Invalid upgrades are recognised
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"))
+	require.NoError(t, err)
+	assert.False(t, IsUpgrade(req))
+	req, err = request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\n" +
+		"Upgrade: h2c\r\nHTTP2-Settings: AAMAAABk\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, IsUpgrade(req))
+}
+
+func TestPush(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) error {
+		if req.RequestLine.RequestTarget != "/" {
+			return echo(w, req)
+		}
+		h := headers.NewHeaders()
+		h.Set("Accept", "text/css")
+		err := w.Push("/style.css", h)
+		body := []byte(fmt.Sprint(err))
+		w.WriteStatusLine(response.SUCCESS)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+		return nil
+	}
+
+	// Test: The promise comes before the response and the pushed stream is served
+	c := newTestClient(t, NewServer(handler, WithPush()))
+	c.get(1, "/")
+	h, payload := c.readFrame()
+	require.Equal(t, framePushPromise, h.typ)
+	assert.Equal(t, uint32(1), h.streamID)
+	assert.Equal(t, uint32(2), binary.BigEndian.Uint32(payload))
+	assert.Contains(t, c.fields, hpack.HeaderField{Name: ":path", Value: "/style.css"})
+	assert.Contains(t, c.fields, hpack.HeaderField{Name: ":authority", Value: "localhost"})
+	assert.Contains(t, c.fields, hpack.HeaderField{Name: "accept", Value: "text/css"})
+	responses := c.readResponses(2)
+	assert.Equal(t, "<nil>", responses[1].body)
+	assert.Equal(t, "GET /style.css ", responses[2].body)
+
+	// Test: Clients can disable push
+	c = newTestClient(t, NewServer(handler, WithPush()), setting{settingEnablePush, 0})
+	c.get(1, "/")
+	assert.Equal(t, response.ErrPushNotSupported.Error(), c.readResponses(1)[1].body)
+
+	// Test: Push is off unless enabled
+	c = newTestClient(t, NewServer(handler))
+	c.get(1, "/")
+	assert.Equal(t, response.ErrPushNotSupported.Error(), c.readResponses(1)[1].body)
+
+	// Test: The client's stream limit applies to pushes
+	c = newTestClient(t, NewServer(handler, WithPush()), setting{settingMaxConcurrentStreams, 0})
+	c.get(1, "/")
+	assert.Equal(t, ErrTooManyPushes.Error(), c.readResponses(1)[1].body)
+}
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) error {
+		<-release
+		return echo(w, req)
+	}
+	s := NewServer(handler)
+	c := newTestClient(t, s)
+	c.get(1, "/inflight")
+	// wait for the stream to be accepted
+	c.writeFrame(framePing, 0, 0, make([]byte, 8))
+	for {
+		h, _, err := readFrame(c.conn, nil, maxFrameSizeLimit)
+		require.NoError(t, err)
+		if h.typ == framePing {
+			break
+		}
+	}
+
+	// Test: GOAWAY names the last stream that will still be served
+	s.Shutdown()
+	h, payload := c.readFrame()
+	require.Equal(t, frameGoAway, h.typ)
+	assert.Equal(t, uint32(1), binary.BigEndian.Uint32(payload))
+	assert.Equal(t, ErrCodeNo, ErrCode(binary.BigEndian.Uint32(payload[4:])))
+
+	// Test: Later streams are refused, earlier ones complete
+	c.get(3, "/late")
+	c.expect(frameRSTStream, ErrCodeRefusedStream)
+	close(release)
+	assert.Equal(t, "GET /inflight ", c.readResponses(1)[1].body)
+
+	// Test: The connection closes once its streams are done
+	_, _, err := readFrame(c.conn, nil, maxFrameSizeLimit)
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Connections served after the shutdown are sent away at once
+	addr := listen(t, func(conn net.Conn) {
+		s.ServeConn(context.Background(), conn, conn)
+	})
+	c = dialClient(t, addr)
+	for h = (frameHeader{}); h.typ != frameGoAway; {
+		h, _, err = readFrame(c.conn, nil, maxFrameSizeLimit)
+		require.NoError(t, err)
+		require.Contains(t, []frameType{frameSettings, frameWindowUpdate, frameGoAway}, h.typ)
+	}
+}
@@ -0,0 +1,359 @@
+package http2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/alexmarian/httpfromtcp/internal/headers"
+	"github.com/alexmarian/httpfromtcp/internal/http2/hpack"
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/alexmarian/httpfromtcp/internal/response"
+	"strconv"
+	"strings"
+)
+
+// stream is one request-response exchange. It is the response.Framer of the
+// Writer its handler gets.
+type stream struct {
+	sc     *serverConn
+	id     uint32
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	// only touched by the read loop
+	head       requestHead
+	body       []byte
+	trailers   headers.Headers
+	recvWindow int64
+
+	// guarded by sc.mu
+	sendWindow   int64
+	remoteClosed bool
+	localClosed  bool
+	headersSent  bool
+	reset        bool
+	running      bool
+}
+
+var errStreamClosed = errors.New("http2: stream already ended")
+
+// connectionSpecific lists fields that must not appear in HTTP/2 messages.
+var connectionSpecific = []string{"connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade"}
+
+func isConnectionSpecific(name string) bool {
+	for _, n := range connectionSpecific {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// requestHead holds the validated header section of a request.
+type requestHead struct {
+	method        string
+	scheme        string
+	path          string
+	authority     string
+	headers       headers.Headers
+	contentLength int64
+}
+
+// requestFields validates the pseudo-header and regular fields of a request.
+func requestFields(fields []hpack.HeaderField) (requestHead, error) {
+	head := requestHead{headers: headers.NewHeaders(), contentLength: -1}
+	seen := map[string]bool{}
+	regular := false
+	for _, f := range fields {
+		if err := checkField(f); err != nil {
+			return head, err
+		}
+		if strings.HasPrefix(f.Name, ":") {
+			if regular {
+				return head, fmt.Errorf("pseudo-header %s after regular fields", f.Name)
+			}
+			if seen[f.Name] {
+				return head, fmt.Errorf("duplicate pseudo-header %s", f.Name)
+			}
+			seen[f.Name] = true
+			switch f.Name {
+			case ":method":
+				head.method = f.Value
+			case ":scheme":
+				head.scheme = f.Value
+			case ":path":
+				head.path = f.Value
+			case ":authority":
+				head.authority = f.Value
+			default:
+				return head, fmt.Errorf("unknown pseudo-header %s", f.Name)
+			}
+			continue
+		}
+		regular = true
+		switch f.Name {
+		case "te":
+			if f.Value != "trailers" {
+				return head, fmt.Errorf("te: %q", f.Value)
+			}
+		case "content-length":
+			n, err := strconv.ParseInt(f.Value, 10, 64)
+			if err != nil || n < 0 || (head.contentLength >= 0 && n != head.contentLength) {
+				return head, fmt.Errorf("invalid content-length %q", f.Value)
+			}
+			head.contentLength = n
+		case "cookie":
+			// crumbs are joined back into one field (RFC 9113 section 8.2.3)
+			if existing, present := head.headers.Get(f.Name); present {
+				head.headers.Override(f.Name, existing+"; "+f.Value)
+				continue
+			}
+		}
+		head.headers.Set(f.Name, f.Value)
+	}
+	if head.method == "" {
+		return head, errors.New("missing :method")
+	}
+	if head.method == "CONNECT" {
+		if head.scheme != "" || head.path != "" || head.authority == "" {
+			return head, errors.New("CONNECT must only carry :method and :authority")
+		}
+		return head, nil
+	}
+	if head.scheme == "" || head.path == "" {
+		return head, errors.New("missing :scheme or :path")
+	}
+	return head, nil
+}
+
+// trailerFields validates the fields of a trailer section.
+func trailerFields(fields []hpack.HeaderField) (headers.Headers, error) {
+	h := headers.NewHeaders()
+	for _, f := range fields {
+		if err := checkField(f); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(f.Name, ":") {
+			return nil, fmt.Errorf("pseudo-header %s in trailers", f.Name)
+		}
+		h.Set(f.Name, f.Value)
+	}
+	return h, nil
+}
+
+func checkField(f hpack.HeaderField) error {
+	name := strings.TrimPrefix(f.Name, ":")
+	if !headers.IsToken(name) || strings.ToLower(name) != name {
+		return fmt.Errorf("invalid field name %q", f.Name)
+	}
+	if isConnectionSpecific(f.Name) {
+		return fmt.Errorf("connection-specific field %s", f.Name)
+	}
+	if strings.ContainsAny(f.Value, "\r\n\x00") {
+		return fmt.Errorf("invalid value for %s", f.Name)
+	}
+	return nil
+}
+
+// request builds the Request handlers see. Its target is the :path, or the
+// :authority for CONNECT.
+func (head requestHead) request(body []byte, opts []request.Option) (*request.Request, error) {
+	target := head.path
+	if head.method == "CONNECT" {
+		target = head.authority
+	}
+	return request.NewRequest(head.method, target, "2.0", head.authority, head.headers, body, opts...)
+}
+
+// Push promises a GET for target on st and serves it on a new stream, with
+// the scheme and authority of st's request.
+func (st *stream) Push(target string, h headers.Headers) error {
+	sc := st.sc
+	if !strings.HasPrefix(target, "/") {
+		return fmt.Errorf("push target %q is not a path", target)
+	}
+	head := requestHead{
+		method:        "GET",
+		scheme:        st.head.scheme,
+		path:          target,
+		authority:     st.head.authority,
+		headers:       headers.NewHeaders(),
+		contentLength: -1,
+	}
+	fields := []hpack.HeaderField{
+		{Name: ":method", Value: head.method},
+		{Name: ":scheme", Value: head.scheme},
+		{Name: ":path", Value: head.path},
+		{Name: ":authority", Value: head.authority},
+	}
+	for name, lines := range h {
+		name = strings.ToLower(name)
+		if isConnectionSpecific(name) {
+			continue
+		}
+		head.headers[name] = lines
+		for _, line := range lines {
+			fields = append(fields, hpack.HeaderField{Name: name, Value: line})
+		}
+	}
+	req, err := head.request(nil, sc.srv.requestOpts)
+	if err != nil {
+		return err
+	}
+
+	sc.mu.Lock()
+	err = st.writable()
+	switch {
+	case err != nil:
+	case !sc.srv.push || !sc.peerPush || sc.goingAway || st.id%2 == 0:
+		err = response.ErrPushNotSupported
+	case uint32(sc.pushes) >= sc.peerMaxStreams:
+		err = ErrTooManyPushes
+	}
+	if err != nil {
+		sc.mu.Unlock()
+		return err
+	}
+	id := sc.nextPushID
+	sc.nextPushID += 2
+	sc.pushes++
+	pushed := &stream{
+		sc:           sc,
+		id:           id,
+		head:         head,
+		sendWindow:   sc.peerInitialWindow,
+		remoteClosed: true,
+	}
+	pushed.ctx, pushed.cancel = context.WithCancelCause(sc.ctx)
+	sc.streams[id] = pushed
+	sc.mu.Unlock()
+
+	// the promise goes out before the pushed stream's frames
+	if err := sc.writePushPromise(st.id, id, fields); err != nil {
+		return err
+	}
+	req.TLS = sc.tls
+	sc.dispatch(pushed, req, nil)
+	return nil
+}
+
+// writable fails once the response was ended or the stream is gone. Called
+// with sc.mu held.
+func (st *stream) writable() error {
+	switch {
+	case st.sc.closed:
+		return ErrConnectionClosed
+	case st.reset:
+		return ErrStreamReset
+	case st.localClosed:
+		return errStreamClosed
+	}
+	return nil
+}
+
+func (st *stream) WriteHeader(statusCode response.StatusCode, h headers.Headers) error {
+	fields := []hpack.HeaderField{{Name: ":status", Value: strconv.Itoa(int(statusCode))}}
+	for name, lines := range h {
+		name = strings.ToLower(name)
+		if isConnectionSpecific(name) {
+			continue
+		}
+		for _, line := range lines {
+			fields = append(fields, hpack.HeaderField{Name: name, Value: line})
+		}
+	}
+	st.sc.mu.Lock()
+	err := st.writable()
+	st.sc.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := st.sc.writeHeaders(st.id, fields, false); err != nil {
+		return err
+	}
+	if statusCode >= 200 {
+		st.sc.mu.Lock()
+		st.headersSent = true
+		st.sc.mu.Unlock()
+	}
+	return nil
+}
+
+// WriteData sends p in as many DATA frames as flow control and the peer's
+// frame size require, waiting for window when there is none.
+func (st *stream) WriteData(p []byte) error {
+	for len(p) > 0 {
+		n, err := st.reserve(len(p))
+		if err != nil {
+			return err
+		}
+		if err := st.sc.writeFrame(frameData, 0, st.id, p[:n]); err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+// reserve takes up to want bytes of send window from the stream and the
+// connection.
+func (st *stream) reserve(want int) (int, error) {
+	sc := st.sc
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for {
+		if err := st.writable(); err != nil {
+			return 0, err
+		}
+		n := min(int64(want), st.sendWindow, sc.sendWindow, int64(sc.peerMaxFrameSize))
+		if n > 0 {
+			st.sendWindow -= n
+			sc.sendWindow -= n
+			return int(n), nil
+		}
+		sc.cond.Wait()
+	}
+}
+
+func (st *stream) Close(trailers headers.Headers) error {
+	st.sc.mu.Lock()
+	err := st.writable()
+	st.sc.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if len(trailers) > 0 {
+		fields := make([]hpack.HeaderField, 0, len(trailers))
+		for name, lines := range trailers {
+			for _, line := range lines {
+				fields = append(fields, hpack.HeaderField{Name: strings.ToLower(name), Value: line})
+			}
+		}
+		err = st.sc.writeHeaders(st.id, fields, true)
+	} else {
+		err = st.sc.writeFrame(frameData, flagEndStream, st.id, nil)
+	}
+	st.sc.mu.Lock()
+	st.localClosed = true
+	if st.remoteClosed {
+		st.sc.closeStream(st, nil)
+	}
+	st.sc.mu.Unlock()
+	return err
+}
+
+// finish runs after the handler returned: a response left open is ended and
+// a stream that got no response at all is reset.
+func (st *stream) finish() {
+	st.sc.mu.Lock()
+	done := st.localClosed || st.reset || st.sc.closed
+	headersSent := st.headersSent
+	st.sc.mu.Unlock()
+	switch {
+	case done:
+	case headersSent:
+		st.Close(nil)
+	default:
+		st.sc.resetStream(st.id, ErrCodeInternal)
+	}
+}
@@ -0,0 +1,497 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/alexmarian/httpfromtcp/internal/headers"
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/alexmarian/httpfromtcp/internal/response"
+	"github.com/alexmarian/httpfromtcp/internal/server"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultIdleTimeout = 5 * time.Minute
+	DefaultDialTimeout = 10 * time.Second
+	copyBufferSize     = 32 * 1024
+)
+
+// hopByHopHeaders only apply to a single connection and are never forwarded.
+var hopByHopHeaders = []string{
+	headers.ConnectionHeader,
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	headers.TrailerHeader,
+	headers.TransferEncodingHeader,
+	"Upgrade",
+}
+
+// PrivateNetworks are the loopback, private, link-local and unspecified
+// address ranges. Denying them keeps a proxy open to the internet from
+// reaching the machine it runs on or the network behind it.
+var PrivateNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+var errDeniedAddress = errors.New("destination address is denied")
+
+// Proxy is a forward proxy. It tunnels CONNECT requests and relays
+// absolute-form requests ("GET http://host/path") to their origin. Destinations
+// are checked against host and port allow and deny lists before dialling, and
+// the addresses they resolve to against the deny list while dialling.
+type Proxy struct {
+	allowedHosts []string
+	deniedHosts  []string
+	allowedPorts []int
+	deniedPorts  []int
+	idleTimeout  time.Duration
+	dialTimeout  time.Duration
+}
+
+type Option func(*Proxy)
+
+// WithAllowedHosts only lets requests through to matching hosts. Patterns are
+// exact hostnames, "*.example.com" for any subdomain, IP addresses, prefixes
+// such as "10.0.0.0/8", or "*". Addresses and prefixes match IP literals.
+func WithAllowedHosts(patterns ...string) Option {
+	return func(p *Proxy) {
+		p.allowedHosts = append(p.allowedHosts, patterns...)
+	}
+}
+
+// WithDeniedHosts rejects requests to matching hosts, even if they are also
+// allowed. Patterns use the WithAllowedHosts syntax; addresses and prefixes
+// are also checked against every address a hostname resolves to, so a name
+// pointing at a denied address is refused too.
+func WithDeniedHosts(patterns ...string) Option {
+	return func(p *Proxy) {
+		p.deniedHosts = append(p.deniedHosts, patterns...)
+	}
+}
+
+// WithAllowedPorts only lets requests through to the given ports.
+func WithAllowedPorts(ports ...int) Option {
+	return func(p *Proxy) {
+		p.allowedPorts = append(p.allowedPorts, ports...)
+	}
+}
+
+// WithDeniedPorts rejects requests to the given ports, even if they are also
+// allowed.
+func WithDeniedPorts(ports ...int) Option {
+	return func(p *Proxy) {
+		p.deniedPorts = append(p.deniedPorts, ports...)
+	}
+}
+
+// WithIdleTimeout closes a tunnel or relayed response once no bytes moved in
+// either direction for d. Zero disables it.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(p *Proxy) {
+		p.idleTimeout = d
+	}
+}
+
+// WithDialTimeout bounds how long connecting to the destination may take.
+func WithDialTimeout(d time.Duration) Option {
+	return func(p *Proxy) {
+		p.dialTimeout = d
+	}
+}
+
+// New creates a Proxy. Without allow lists every destination that is not
+// denied is reachable.
+func New(opts ...Option) *Proxy {
+	p := &Proxy{
+		idleTimeout: DefaultIdleTimeout,
+		dialTimeout: DefaultDialTimeout,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// IsProxyRequest reports whether req is meant for a forward proxy: a CONNECT
+// or a request with an absolute-form target.
+func IsProxyRequest(req *request.Request) bool {
+	return req.RequestLine.Method == "CONNECT" || !strings.HasPrefix(req.RequestLine.RequestTarget, "/") && strings.Contains(req.RequestLine.RequestTarget, "://")
+}
+
+// Middleware serves proxy requests and passes every other request to next.
+func (p *Proxy) Middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) *response.HandlerError {
+		if IsProxyRequest(req) {
+			return p.Serve(w, req)
+		}
+		return next(w, req)
+	}
+}
+
+// Allowed reports whether the lists let a request through to host and port.
+// The addresses host resolves to are only checked when dialling.
+func (p *Proxy) Allowed(host string, port int) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if matchHost(p.deniedHosts, host) || containsPort(p.deniedPorts, port) {
+		return false
+	}
+	if len(p.allowedHosts) > 0 && !matchHost(p.allowedHosts, host) {
+		return false
+	}
+	return len(p.allowedPorts) == 0 || containsPort(p.allowedPorts, port)
+}
+
+func matchHost(patterns []string, host string) bool {
+	addr, err := netip.ParseAddr(host)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+		switch {
+		case pattern == "*", pattern == host:
+			return true
+		case strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]):
+			return true
+		case err == nil && matchAddr(pattern, addr):
+			return true
+		}
+	}
+	return false
+}
+
+// matchAddr reports whether pattern is addr or a prefix containing it.
+func matchAddr(pattern string, addr netip.Addr) bool {
+	addr = addr.WithZone("").Unmap()
+	if prefix, err := netip.ParsePrefix(pattern); err == nil {
+		return prefix.Contains(addr)
+	}
+	patternAddr, err := netip.ParseAddr(pattern)
+	return err == nil && patternAddr.Unmap() == addr
+}
+
+// checkAddress is the dialer's Control hook. It runs for every address the
+// destination resolved to, right before connecting to it.
+func (p *Proxy) checkAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	for _, pattern := range p.deniedHosts {
+		if matchAddr(strings.ToLower(pattern), addr) {
+			return fmt.Errorf("%w: %s", errDeniedAddress, addr)
+		}
+	}
+	return nil
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// Serve handles a single proxy request. Both kinds take over the connection,
+// which is closed once the tunnel or the relayed response ends. Either also
+// stops when the request context is cancelled.
+func (p *Proxy) Serve(w *response.Writer, req *request.Request) *response.HandlerError {
+	if req.RequestLine.Method == "CONNECT" {
+		return p.serveConnect(w, req)
+	}
+	return p.serveAbsolute(w, req)
+}
+
+func (p *Proxy) serveConnect(w *response.Writer, req *request.Request) *response.HandlerError {
+	upstream, hErr := p.dial(req.Context(), req.Host, req.Port)
+	if hErr != nil {
+		return hErr
+	}
+	client, buffered, err := w.Hijack()
+	if err != nil {
+		upstream.Close()
+		return &response.HandlerError{StatusCode: response.INTERNAL_SERVER_ERROR, Message: "Connection cannot be tunnelled"}
+	}
+	stop := context.AfterFunc(req.Context(), func() {
+		client.Close()
+		upstream.Close()
+	})
+	defer stop()
+
+	version := req.RequestLine.HttpVersion
+	if _, err := fmt.Fprintf(client, "HTTP/%s 200 Connection Established\r\n\r\n", version); err != nil {
+		client.Close()
+		upstream.Close()
+		return nil
+	}
+	// the client may start talking, e.g. a TLS ClientHello, before it sees
+	// the 200
+	if len(buffered) > 0 {
+		if _, err := upstream.Write(buffered); err != nil {
+			client.Close()
+			upstream.Close()
+			return nil
+		}
+	}
+	p.tunnel(client, upstream)
+	return nil
+}
+
+func (p *Proxy) serveAbsolute(w *response.Writer, req *request.Request) *response.HandlerError {
+	scheme, rest, _ := strings.Cut(req.RequestLine.RequestTarget, "://")
+	if !strings.EqualFold(scheme, "http") {
+		return &response.HandlerError{StatusCode: response.BAD_REQUEST, Message: fmt.Sprintf("Cannot proxy %q requests", scheme)}
+	}
+	authority, path := rest, "/"
+	if i := strings.IndexAny(rest, "/?"); i != -1 {
+		authority, path = rest[:i], rest[i:]
+		if path[0] == '?' {
+			path = "/" + path
+		}
+	}
+	port := req.Port
+	if port == 0 {
+		port = 80
+	}
+	body, err := req.ReadBody()
+	if err != nil {
+		return &response.HandlerError{StatusCode: response.BAD_REQUEST, Message: err.Error()}
+	}
+
+	upstream, hErr := p.dial(req.Context(), req.Host, port)
+	if hErr != nil {
+		return hErr
+	}
+	stop := context.AfterFunc(req.Context(), func() { upstream.Close() })
+	defer stop()
+	defer upstream.Close()
+	upstream.SetDeadline(p.deadline())
+	if err := writeRequest(upstream, req, authority, path, body); err != nil {
+		return &response.HandlerError{StatusCode: response.BAD_GATEWAY, Message: err.Error()}
+	}
+
+	// Everything after the head is relayed byte for byte, whatever its
+	// framing, so the client connection is closed afterwards instead of being
+	// handed back to the server.
+	reader := bufio.NewReader(upstream)
+	head, err := readResponseHead(reader)
+	if err != nil {
+		return &response.HandlerError{StatusCode: response.BAD_GATEWAY, Message: err.Error()}
+	}
+	client, _, err := w.Hijack()
+	if err != nil {
+		return &response.HandlerError{StatusCode: response.INTERNAL_SERVER_ERROR, Message: "Connection cannot be taken over"}
+	}
+	stopClient := context.AfterFunc(req.Context(), func() { client.Close() })
+	defer stopClient()
+	defer client.Close()
+	client.SetWriteDeadline(p.deadline())
+	if _, err := io.WriteString(client, head); err != nil {
+		return nil
+	}
+	p.copy(client, reader, upstream)
+	return nil
+}
+
+// writeRequest sends req in origin-form with the hop-by-hop headers removed,
+// asking the origin to close the connection after responding.
+func writeRequest(conn net.Conn, req *request.Request, authority, path string, body []byte) error {
+	out := headers.NewHeaders()
+	for name, lines := range req.Headers {
+		if !isHopByHop(req, name) {
+			out[name] = lines
+		}
+	}
+	out.Override(headers.HostHeader, authority)
+	out.Override(headers.ConnectionHeader, "close")
+	if len(body) > 0 {
+		out.Override(headers.ContentLengthHeader, strconv.Itoa(len(body)))
+	}
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\n", req.RequestLine.Method, path)
+	for name, lines := range out {
+		for _, line := range lines {
+			fmt.Fprintf(&b, "%s: %s\r\n", name, line)
+		}
+	}
+	b.WriteString("\r\n")
+	b.Write(body)
+	_, err := io.WriteString(conn, b.String())
+	return err
+}
+
+func isHopByHop(req *request.Request, name string) bool {
+	for _, h := range hopByHopHeaders {
+		if strings.EqualFold(h, name) {
+			return true
+		}
+	}
+	return req.HasConnectionOption(name)
+}
+
+// readResponseHead reads the status line and header section of the origin's
+// response, including any interim 1xx responses, and rewrites them to close
+// the client connection after the body.
+func readResponseHead(reader *bufio.Reader) (string, error) {
+	b := strings.Builder{}
+	for {
+		status, err := reader.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("reading response from origin: %w", err)
+		}
+		fields := strings.Fields(status)
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/1.") {
+			return "", fmt.Errorf("invalid status line from origin: %q", status)
+		}
+		final := !strings.HasPrefix(fields[1], "1") || fields[1] == "101"
+		b.WriteString(status)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return "", fmt.Errorf("reading response from origin: %w", err)
+			}
+			if line == "\r\n" || line == "\n" {
+				break
+			}
+			name, _, _ := strings.Cut(line, ":")
+			name = strings.TrimSpace(name)
+			if final && (strings.EqualFold(name, headers.ConnectionHeader) || strings.EqualFold(name, "Keep-Alive")) {
+				continue
+			}
+			b.WriteString(line)
+		}
+		if final {
+			b.WriteString("Connection: close\r\n\r\n")
+			return b.String(), nil
+		}
+		b.WriteString("\r\n")
+	}
+}
+
+func (p *Proxy) dial(ctx context.Context, host string, port int) (net.Conn, *response.HandlerError) {
+	if host == "" || port == 0 {
+		return nil, &response.HandlerError{StatusCode: response.BAD_REQUEST, Message: "Missing destination host or port"}
+	}
+	if !p.Allowed(host, port) {
+		return nil, &response.HandlerError{StatusCode: response.FORBIDDEN, Message: fmt.Sprintf("Proxying to %s is not allowed", net.JoinHostPort(host, strconv.Itoa(port)))}
+	}
+	dialer := net.Dialer{Timeout: p.dialTimeout, Control: p.checkAddress}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		if errors.Is(err, errDeniedAddress) {
+			return nil, &response.HandlerError{StatusCode: response.FORBIDDEN, Message: fmt.Sprintf("Proxying to %s is not allowed", net.JoinHostPort(host, strconv.Itoa(port)))}
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, &response.HandlerError{StatusCode: response.GATEWAY_TIMEOUT, Message: err.Error()}
+		}
+		return nil, &response.HandlerError{StatusCode: response.BAD_GATEWAY, Message: err.Error()}
+	}
+	return conn, nil
+}
+
+func (p *Proxy) deadline() time.Time {
+	if p.idleTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(p.idleTimeout)
+}
+
+// tunnel copies bytes both ways until both sides finished sending, an error
+// occurs or neither side sent anything for the idle timeout.
+func (p *Proxy) tunnel(client, upstream net.Conn) {
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		p.pipe(upstream, client, &lastActive)
+	}()
+	go func() {
+		defer wg.Done()
+		p.pipe(client, upstream, &lastActive)
+	}()
+	wg.Wait()
+	client.Close()
+	upstream.Close()
+}
+
+// pipe copies src to dst. A clean EOF is passed on as a half close so the
+// other direction can finish; anything else tears down both connections.
+func (p *Proxy) pipe(dst, src net.Conn, lastActive *atomic.Int64) {
+	buf := make([]byte, copyBufferSize)
+	for {
+		if p.idleTimeout > 0 {
+			src.SetReadDeadline(time.Unix(0, lastActive.Load()).Add(p.idleTimeout))
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			lastActive.Store(time.Now().UnixNano())
+			dst.SetWriteDeadline(p.deadline())
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				break
+			}
+		}
+		if err == nil {
+			continue
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && time.Since(time.Unix(0, lastActive.Load())) < p.idleTimeout {
+			// the other direction was active in the meantime
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			if cw, ok := dst.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+				return
+			}
+		}
+		break
+	}
+	dst.Close()
+	src.Close()
+}
+
+// copy relays the rest of a response from the origin to the client, resetting
+// the idle timeout whenever bytes arrive.
+func (p *Proxy) copy(dst net.Conn, src io.Reader, conn net.Conn) {
+	buf := make([]byte, copyBufferSize)
+	for {
+		conn.SetReadDeadline(p.deadline())
+		n, err := src.Read(buf)
+		if n > 0 {
+			dst.SetWriteDeadline(p.deadline())
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
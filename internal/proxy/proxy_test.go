@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/alexmarian/httpfromtcp/internal/response"
+	"github.com/alexmarian/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startEcho starts a TCP server echoing everything back and returns its port.
+func startEcho(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func notProxied(w *response.Writer, req *request.Request) *response.HandlerError {
+	w.WriteContent(response.SUCCESS, response.TextContentType, []byte("served locally"))
+	return nil
+}
+
+func startProxy(t *testing.T, opts ...Option) net.Conn {
+	t.Helper()
+	s, err := server.Serve(0, New(opts...).Middleware(notProxied))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func TestConnect(t *testing.T) {
+	port := strconv.Itoa(startEcho(t))
+
+	// Test: Tunnel carries bytes both ways, including bytes sent with the request
+	conn := startProxy(t)
+	reader := bufio.NewReader(conn)
+	_, err := io.WriteString(conn, "CONNECT 127.0.0.1:"+port+" HTTP/1.1\r\nHost: 127.0.0.1:"+port+"\r\n\r\nearly\n")
+	require.NoError(t, err)
+	status, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 Connection Established\r\n", status)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "\r\n", line)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "early\n", line)
+	_, err = io.WriteString(conn, "later\n")
+	require.NoError(t, err)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "later\n", line)
+
+	// Test: Half close reaches the destination and the tunnel winds down
+	require.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Empty(t, rest)
+
+	// Test: Unreachable destination
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+	conn = startProxy(t)
+	_, err = io.WriteString(conn, "CONNECT 127.0.0.1:"+closed+" HTTP/1.1\r\nHost: 127.0.0.1:"+closed+"\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 502 Bad Gateway\r\n"))
+}
+
+func TestAbsoluteForm(t *testing.T) {
+	origin, err := server.Serve(0, func(w *response.Writer, req *request.Request) *response.HandlerError {
+		_, proxyConnection := req.Headers.Get("Proxy-Connection")
+		body := req.RequestLine.Method + " " + req.RequestLine.RequestTarget + " " + string(req.Body) +
+			" close=" + strconv.FormatBool(!req.KeepAlive()) + " proxy-connection=" + strconv.FormatBool(proxyConnection)
+		h := response.GetDefaultHeaders(len(body))
+		h.Set("X-Origin", "yes")
+		w.WriteStatusLine(response.SUCCESS)
+		w.WriteHeaders(h)
+		w.WriteBody([]byte(body))
+		return nil
+	})
+	require.NoError(t, err)
+	defer origin.Close()
+	authority := origin.Addr().String()
+
+	// Test: Request is forwarded in origin-form without hop-by-hop headers
+	conn := startProxy(t)
+	_, err = io.WriteString(conn, "POST http://"+authority+"/path?q=1 HTTP/1.1\r\nHost: "+authority+"\r\nProxy-Connection: keep-alive\r\nContent-Length: 4\r\n\r\nping")
+	require.NoError(t, err)
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, string(out), "x-origin: yes\r\n")
+	assert.Contains(t, string(out), "Connection: close\r\n")
+	assert.Equal(t, 1, strings.Count(strings.ToLower(string(out)), "connection:"))
+	assert.True(t, strings.HasSuffix(string(out), "\r\n\r\nPOST /path?q=1 ping close=true proxy-connection=false"))
+
+	// Test: Other schemes are refused
+	conn = startProxy(t)
+	_, err = io.WriteString(conn, "GET https://"+authority+"/ HTTP/1.1\r\nHost: "+authority+"\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	out, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 400 Bad Request\r\n"))
+
+	// Test: Origin-form requests reach the wrapped handler
+	conn = startProxy(t)
+	_, err = io.WriteString(conn, "GET /local HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	out, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(string(out), "served locally"))
+}
+
+func TestAccessLists(t *testing.T) {
+	// Test: Allow and deny lists, deny wins
+	p := New(WithAllowedHosts("*.example.com", "127.0.0.1"), WithDeniedHosts("secret.example.com"), WithAllowedPorts(443, 8443), WithDeniedPorts(8443))
+	assert.True(t, p.Allowed("api.example.com", 443))
+	assert.True(t, p.Allowed("API.Example.com.", 443))
+	assert.True(t, p.Allowed("127.0.0.1", 443))
+	assert.False(t, p.Allowed("example.com", 443))
+	assert.False(t, p.Allowed("secret.example.com", 443))
+	assert.False(t, p.Allowed("api.example.com", 80))
+	assert.False(t, p.Allowed("api.example.com", 8443))
+	assert.True(t, New().Allowed("anything", 1))
+
+	// Test: Addresses and prefixes match IP literals
+	p = New(WithDeniedHosts(PrivateNetworks...))
+	assert.False(t, p.Allowed("10.1.2.3", 80))
+	assert.False(t, p.Allowed("::ffff:192.168.0.1", 80))
+	assert.False(t, p.Allowed("fe80::1%eth0", 80))
+	assert.True(t, p.Allowed("93.184.215.14", 80))
+	assert.True(t, p.Allowed("localhost", 80))
+
+	// Test: Denied destinations are answered with 403 without dialling
+	port := strconv.Itoa(startEcho(t))
+	conn := startProxy(t, WithAllowedHosts("localhost"))
+	_, err := io.WriteString(conn, "CONNECT 127.0.0.1:"+port+" HTTP/1.1\r\nHost: 127.0.0.1:"+port+"\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 403 Forbidden\r\n"))
+
+	// Test: A name resolving to a denied address is refused while dialling
+	for _, denied := range [][]string{{"127.0.0.1", "::1"}, PrivateNetworks} {
+		conn = startProxy(t, WithDeniedHosts(denied...))
+		_, err = io.WriteString(conn, "CONNECT localhost:"+port+" HTTP/1.1\r\nHost: localhost:"+port+"\r\nConnection: close\r\n\r\n")
+		require.NoError(t, err)
+		out, err = io.ReadAll(conn)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(string(out), "HTTP/1.1 403 Forbidden\r\n"), string(out))
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	port := strconv.Itoa(startEcho(t))
+	conn := startProxy(t, WithIdleTimeout(100*time.Millisecond))
+	reader := bufio.NewReader(conn)
+	_, err := io.WriteString(conn, "CONNECT 127.0.0.1:"+port+" HTTP/1.1\r\nHost: 127.0.0.1:"+port+"\r\n\r\n")
+	require.NoError(t, err)
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			break
+		}
+	}
+
+	// Test: Traffic keeps the tunnel open past the timeout
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		_, err = io.WriteString(conn, "tick\n")
+		require.NoError(t, err)
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "tick\n", line)
+	}
+	assert.Greater(t, time.Since(start), 150*time.Millisecond)
+
+	// Test: Idle tunnel is closed
+	start = time.Now()
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,277 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/alexmarian/httpfromtcp/internal/headers"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidContentLength        = errors.New("invalid Content-Length")
+	ErrAmbiguousFraming            = errors.New("ambiguous message framing")
+	ErrInvalidTransferEncoding     = errors.New("invalid Transfer-Encoding")
+	ErrUnsupportedTransferEncoding = errors.New("unsupported transfer coding")
+	ErrInvalidChunk                = errors.New("invalid chunked encoding")
+)
+
+type bodyFraming int
+
+const (
+	framingNone bodyFraming = iota
+	framingContentLength
+	framingChunked
+)
+
+type chunkState int
+
+const (
+	chunkStateSize chunkState = iota
+	chunkStateData
+	chunkStateDataEnd
+	chunkStateTrailers
+)
+
+// maxChunkLineLength bounds a chunk-size line, extensions included.
+const maxChunkLineLength = 4096
+
+// maxContentLengthDigits keeps Content-Length within an int64.
+const maxContentLengthDigits = 18
+
+// determineFraming decides how the body is delimited, following RFC 9112
+// section 6.3, and rejects every combination that two parsers could read
+// differently.
+func (r *Request) determineFraming() error {
+	te, hasTE := r.Headers.Get(headers.TransferEncodingHeader)
+	cl, hasCL := r.Headers.Get(headers.ContentLengthHeader)
+	if hasTE {
+		if hasCL {
+			if r.cfg.hardened {
+				return fmt.Errorf("%w: both Transfer-Encoding and Content-Length present", ErrAmbiguousFraming)
+			}
+			// Transfer-Encoding overrides Content-Length, but the connection
+			// cannot be trusted afterwards
+			r.Headers.Remove(headers.ContentLengthHeader)
+			r.closeAfter = true
+		}
+		if !r.ProtoAtLeast(1, 1) {
+			if r.cfg.hardened {
+				return fmt.Errorf("%w: Transfer-Encoding in an HTTP/1.0 request", ErrAmbiguousFraming)
+			}
+			r.closeAfter = true
+		}
+		if err := validateTransferEncoding(te); err != nil {
+			return err
+		}
+		r.framing = framingChunked
+		r.trailerParser = headers.Parser{Policy: r.cfg.headerPolicy}
+		r.Trailers = headers.NewHeaders()
+		return nil
+	}
+	if hasCL {
+		length, err := parseContentLength(cl, r.contentLengthCount, r.cfg.hardened)
+		if err != nil {
+			return err
+		}
+		if r.bodyLimit > 0 && length > r.bodyLimit {
+			return fmt.Errorf("%w: Content-Length %d", ErrBodyTooLarge, length)
+		}
+		r.framing = framingContentLength
+		r.bodyRemaining = length
+		r.Body = make([]byte, 0, min(length, maxBodyPrealloc))
+		return nil
+	}
+	r.framing = framingNone
+	return nil
+}
+
+// validateTransferEncoding accepts a coding list whose final and only coding is
+// chunked. Other codings are understood but not supported.
+func validateTransferEncoding(te string) error {
+	codings := strings.Split(te, ",")
+	for i, coding := range codings {
+		coding = strings.ToLower(strings.Trim(coding, " \t"))
+		name, _, _ := strings.Cut(coding, ";")
+		name = strings.Trim(name, " \t")
+		if !headers.IsToken(name) {
+			return fmt.Errorf("%w: %q", ErrInvalidTransferEncoding, te)
+		}
+		if name == "chunked" {
+			if i != len(codings)-1 || coding != "chunked" {
+				return fmt.Errorf("%w: chunked must be applied once and last: %q", ErrInvalidTransferEncoding, te)
+			}
+			continue
+		}
+		return fmt.Errorf("%w: %s", ErrUnsupportedTransferEncoding, name)
+	}
+	return nil
+}
+
+// parseContentLength accepts 1*DIGIT. A list of identical values, from one or
+// several field lines, is tolerated unless hardened is set.
+func parseContentLength(value string, lines int, hardened bool) (int64, error) {
+	values := strings.Split(value, ",")
+	if hardened && (lines > 1 || len(values) > 1) {
+		return 0, fmt.Errorf("%w: multiple Content-Length values %q", ErrAmbiguousFraming, value)
+	}
+	length := int64(-1)
+	for _, v := range values {
+		v = strings.Trim(v, " \t")
+		if v == "" || len(v) > maxContentLengthDigits {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidContentLength, value)
+		}
+		for i := 0; i < len(v); i++ {
+			if !isDigit(v[i]) {
+				return 0, fmt.Errorf("%w: %q", ErrInvalidContentLength, value)
+			}
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidContentLength, value)
+		}
+		if length != -1 && n != length {
+			return 0, fmt.Errorf("%w: conflicting Content-Length values %q", ErrAmbiguousFraming, value)
+		}
+		length = n
+	}
+	return length, nil
+}
+
+func (r *Request) parseBody(data []byte) (int, error) {
+	switch r.framing {
+	case framingContentLength:
+		n := int64(len(data))
+		if n > r.bodyRemaining {
+			n = r.bodyRemaining
+		}
+		if err := r.parseRequestBody(data[:n]); err != nil {
+			return 0, err
+		}
+		r.bodyRemaining -= n
+		if r.bodyRemaining == 0 {
+			r.state = requestStateDone
+		}
+		return int(n), nil
+	case framingChunked:
+		return r.parseChunked(data)
+	default:
+		// a request without Content-Length or Transfer-Encoding has no body
+		r.state = requestStateDone
+		return 0, nil
+	}
+}
+
+func (r *Request) parseChunked(data []byte) (int, error) {
+	switch r.chunkState {
+	case chunkStateSize:
+		idx := bytes.IndexByte(data, '\n')
+		if idx == -1 {
+			if len(data) > maxChunkLineLength {
+				return 0, fmt.Errorf("%w: chunk-size line too long", ErrInvalidChunk)
+			}
+			return 0, nil
+		}
+		if idx == 0 || data[idx-1] != '\r' {
+			return 0, fmt.Errorf("%w: chunk-size line not terminated by CRLF", ErrInvalidChunk)
+		}
+		size, err := parseChunkSize(data[:idx-1], r.cfg.hardened)
+		if err != nil {
+			return 0, err
+		}
+		if size == 0 {
+			r.chunkState = chunkStateTrailers
+		} else {
+			r.bodyRemaining = size
+			r.chunkState = chunkStateData
+		}
+		return idx + 1, nil
+	case chunkStateData:
+		n := int64(len(data))
+		if n > r.bodyRemaining {
+			n = r.bodyRemaining
+		}
+		if err := r.parseRequestBody(data[:n]); err != nil {
+			return 0, err
+		}
+		r.bodyRemaining -= n
+		if r.bodyRemaining == 0 {
+			r.chunkState = chunkStateDataEnd
+		}
+		return int(n), nil
+	case chunkStateDataEnd:
+		if len(data) < 2 {
+			return 0, nil
+		}
+		if data[0] != '\r' || data[1] != '\n' {
+			return 0, fmt.Errorf("%w: chunk data not followed by CRLF", ErrInvalidChunk)
+		}
+		r.chunkState = chunkStateSize
+		return 2, nil
+	default:
+		_, n, done, err := r.trailerParser.Parse(r.Trailers, data)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %w", ErrInvalidChunk, err)
+		}
+		if done {
+			r.state = requestStateDone
+		}
+		return n, nil
+	}
+}
+
+// parseChunkSize parses "1*HEXDIG *chunk-ext". Extensions are ignored, but in
+// hardened mode they must follow the RFC 9112 grammar.
+func parseChunkSize(line []byte, hardened bool) (int64, error) {
+	end := 0
+	for end < len(line) && isHex(line[end]) {
+		end++
+	}
+	if end == 0 || end > 16 {
+		return 0, fmt.Errorf("%w: chunk size %q", ErrInvalidChunk, line)
+	}
+	size, err := strconv.ParseInt(string(line[:end]), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: chunk size %q", ErrInvalidChunk, line)
+	}
+	ext := strings.TrimLeft(string(line[end:]), " \t")
+	if ext == "" {
+		if end < len(line) && hardened {
+			return 0, fmt.Errorf("%w: trailing whitespace after chunk size", ErrInvalidChunk)
+		}
+		return size, nil
+	}
+	if ext[0] != ';' {
+		return 0, fmt.Errorf("%w: chunk size %q", ErrInvalidChunk, line)
+	}
+	for i := 0; i < len(ext); i++ {
+		if ext[i] != '\t' && (ext[i] < 0x20 || ext[i] == 0x7f) {
+			return 0, fmt.Errorf("%w: control character in chunk extension", ErrInvalidChunk)
+		}
+	}
+	if hardened && !validChunkExtensions(ext) {
+		return 0, fmt.Errorf("%w: chunk extension %q", ErrInvalidChunk, ext)
+	}
+	return size, nil
+}
+
+// validChunkExtensions checks *( BWS ";" BWS name [ BWS "=" BWS value ] ) where
+// value is a token or a quoted-string without semicolons.
+func validChunkExtensions(ext string) bool {
+	for _, part := range strings.Split(ext, ";")[1:] {
+		name, value, hasValue := strings.Cut(part, "=")
+		if !headers.IsToken(strings.Trim(name, " \t")) {
+			return false
+		}
+		if !hasValue {
+			continue
+		}
+		value = strings.Trim(value, " \t")
+		quoted := len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"'
+		if !quoted && !headers.IsToken(value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package request
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/alexmarian/httpfromtcp/internal/headers"
+	"io"
+	"mime"
+	"strings"
+)
+
+var (
+	ErrNotJSON      = errors.New("request body is not JSON")
+	ErrInvalidJSON  = errors.New("invalid JSON body")
+	ErrBodyTooLarge = errors.New("request body too large")
+)
+
+// DefaultJSONLimit is the body size limit of DecodeJSON without WithJSONLimit.
+const DefaultJSONLimit = 1 << 20
+
+type jsonConfig struct {
+	limit        int64
+	allowUnknown bool
+}
+
+// JSONOption configures DecodeJSON.
+type JSONOption func(*jsonConfig)
+
+// WithJSONLimit sets the largest body DecodeJSON accepts. Defaults to
+// DefaultJSONLimit.
+func WithJSONLimit(n int64) JSONOption {
+	return func(c *jsonConfig) {
+		c.limit = n
+	}
+}
+
+// AllowUnknownFields makes DecodeJSON ignore object members that have no
+// matching struct field instead of failing.
+func AllowUnknownFields() JSONOption {
+	return func(c *jsonConfig) {
+		c.allowUnknown = true
+	}
+}
+
+// DecodeJSON decodes the body into v. The Content-Type must be
+// application/json or a +json type, the body must hold exactly one JSON value
+// and, unless AllowUnknownFields is given, no member may be unknown to v. The
+// limit is enforced with ReadBodyLimit, so a deferred body is never read past
+// it.
+func (r *Request) DecodeJSON(v any, opts ...JSONOption) error {
+	cfg := jsonConfig{limit: DefaultJSONLimit}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	contentType, _ := r.Headers.Get(headers.ContentTypeHeader)
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+		return fmt.Errorf("%w: content type %q", ErrNotJSON, contentType)
+	}
+	body, err := r.ReadBodyLimit(cfg.limit)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if !cfg.allowUnknown {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidJSON, err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return fmt.Errorf("%w: trailing data after JSON value", ErrInvalidJSON)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package request
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func jsonRequest(t *testing.T, contentType, body string) *Request {
+	raw := fmt.Sprintf("POST /items HTTP/1.1\r\nHost: localhost\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n%s",
+		contentType, len(body), body)
+	r, err := RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	return r
+}
+
+type item struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func TestDecodeJSON(t *testing.T) {
+	// Test: Valid body, with charset and +json types
+	var v item
+	require.NoError(t, jsonRequest(t, "application/json; charset=utf-8", `{"name":"a","count":2}`).DecodeJSON(&v))
+	assert.Equal(t, item{Name: "a", Count: 2}, v)
+	require.NoError(t, jsonRequest(t, "application/vnd.api+json", `{"name":"b"}`).DecodeJSON(&v))
+	assert.Equal(t, "b", v.Name)
+
+	// Test: Unknown fields are rejected unless allowed
+	err := jsonRequest(t, "application/json", `{"name":"a","extra":1}`).DecodeJSON(&v)
+	assert.ErrorIs(t, err, ErrInvalidJSON)
+	require.NoError(t, jsonRequest(t, "application/json", `{"name":"a","extra":1}`).DecodeJSON(&v, AllowUnknownFields()))
+
+	// Test: Wrong or missing content type
+	assert.ErrorIs(t, jsonRequest(t, "text/plain", `{}`).DecodeJSON(&v), ErrNotJSON)
+	assert.ErrorIs(t, jsonRequest(t, "", `{}`).DecodeJSON(&v), ErrNotJSON)
+
+	// Test: Malformed, trailing data, wrong types
+	assert.ErrorIs(t, jsonRequest(t, "application/json", `{"name":`).DecodeJSON(&v), ErrInvalidJSON)
+	assert.ErrorIs(t, jsonRequest(t, "application/json", `{} {}`).DecodeJSON(&v), ErrInvalidJSON)
+	assert.ErrorIs(t, jsonRequest(t, "application/json", `{"count":"x"}`).DecodeJSON(&v), ErrInvalidJSON)
+
+	// Test: Size limit
+	assert.ErrorIs(t, jsonRequest(t, "application/json", `{"name":"abcdefghij"}`).DecodeJSON(&v, WithJSONLimit(10)), ErrBodyTooLarge)
+
+	// Test: An oversized deferred body is refused without sending 100 Continue
+	raw := "POST /items HTTP/1.1\r\nHost: localhost\r\nContent-Type: application/json\r\nExpect: 100-continue\r\nContent-Length: 100\r\n\r\n"
+	r, err := RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	continued := false
+	r.OnContinue(func() error {
+		continued = true
+		return nil
+	})
+	assert.ErrorIs(t, r.DecodeJSON(&v, WithJSONLimit(10)), ErrBodyTooLarge)
+	assert.False(t, continued)
+
+	// Test: A deferred chunked body is abandoned once it passes the limit
+	raw = "POST /items HTTP/1.1\r\nHost: localhost\r\nContent-Type: application/json\r\nExpect: 100-continue\r\n" +
+		"Transfer-Encoding: chunked\r\n\r\n8\r\n{\"name\":\r\n8\r\n\"abcdef\"\r\n1\r\n}\r\n0\r\n\r\n"
+	r, err = RequestFromReader(&chunkReader{data: raw, numBytesPerRead: 4})
+	require.NoError(t, err)
+	assert.ErrorIs(t, r.DecodeJSON(&v, WithJSONLimit(10)), ErrBodyTooLarge)
+	assert.True(t, r.BodyPending())
+	assert.LessOrEqual(t, len(r.Body), 10)
+}
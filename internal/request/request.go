@@ -2,13 +2,17 @@ package request
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/alexmarian/httpfromtcp/internal/headers"
 	"io"
+	"net"
+	"slices"
 	"strconv"
 	"strings"
-	"unicode"
+	"sync"
 )
 
 type requestState int
@@ -21,11 +25,42 @@ const (
 )
 
 type Request struct {
-	RequestLine  RequestLine
-	Headers      headers.Headers
-	Body         []byte
-	readBodySize int
-	state        requestState
+	RequestLine RequestLine
+	Headers     headers.Headers
+	Body        []byte
+	// Host and Port identify the target authority, taken from an absolute-form
+	// or authority-form target or else from the Host header. Port is 0 when none was given.
+	Host string
+	Port int
+	// Trailers holds the trailer section of a chunked body.
+	Trailers headers.Headers
+	// ID identifies the request in logs and error pages. The server assigns it.
+	ID string
+	// TLS describes the TLS session the request arrived over, or is nil for a
+	// plain TCP connection. The server sets it.
+	TLS                *tls.ConnectionState
+	ctx                context.Context
+	readBodySize       int
+	headSize           int
+	bodyLimit          int64
+	state              requestState
+	cfg                config
+	fieldParser        headers.Parser
+	hostCount          int
+	contentLengthCount int
+	framing            bodyFraming
+	bodyRemaining      int64
+	chunkState         chunkState
+	trailerParser      headers.Parser
+	closeAfter         bool
+
+	reader       io.Reader
+	pooled       *[]byte
+	buf          []byte
+	start, end   int
+	deferBody    bool
+	streamBody   bool
+	continueFunc func() error
 }
 
 type RequestLine struct {
@@ -34,98 +69,647 @@ type RequestLine struct {
 	Method        string
 }
 
-const crlf = "\r\n"
-const bufferSize = 8
+// initialBufferSize holds a typical request head in a single read.
+const initialBufferSize = 4096
+
+// maxPooledBufferSize keeps buffers grown for unusually large heads out of the
+// pool.
+const maxPooledBufferSize = 64 << 10
+
+// DefaultMaxHeadSize is the limit on the request line and header section
+// without WithMaxHeadSize.
+const DefaultMaxHeadSize = 1 << 20
+
+// maxBodyPrealloc bounds the capacity reserved up front for a Content-Length
+// body, so a large declared length cannot allocate before the bytes arrive.
+const maxBodyPrealloc = 64 << 10
+
+const continueExpectation = "100-continue"
+const lastEventIDHeader = "Last-Event-ID"
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, initialBufferSize)
+		return &buf
+	},
+}
+
+var (
+	ErrInvalidRequestLine   = errors.New("invalid request line")
+	ErrInvalidMethod        = errors.New("invalid method")
+	ErrMethodNotImplemented = errors.New("method not implemented")
+	ErrInvalidTarget        = errors.New("invalid request target")
+	ErrInvalidVersion       = errors.New("invalid HTTP version")
+	ErrVersionNotSupported  = errors.New("HTTP version not supported")
+	ErrMissingHost          = errors.New("missing Host header")
+	ErrDuplicateHost        = errors.New("duplicate Host header")
+	ErrInvalidHost          = errors.New("invalid Host header")
+	ErrHeadersTooLarge      = errors.New("request header fields too large")
+)
+
+// DefaultMethods are the methods accepted when no WithAllowedMethods option is
+// given.
+var DefaultMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH"}
+
+type config struct {
+	allowedMethods []string
+	headerPolicy   headers.Policy
+	hardened       bool
+	maxBodySize    int64
+	maxHeadSize    int
+}
+
+// Option configures how requests are parsed.
+type Option func(*config)
+
+// WithAllowedMethods replaces DefaultMethods. Requests using any other
+// syntactically valid method fail with ErrMethodNotImplemented.
+func WithAllowedMethods(methods ...string) Option {
+	return func(c *config) {
+		c.allowedMethods = methods
+	}
+}
+
+// WithHeaderPolicy sets how obsolete line folding and bare LF line endings are
+// handled. By default both are rejected.
+func WithHeaderPolicy(policy headers.Policy) Option {
+	return func(c *config) {
+		c.headerPolicy = policy
+	}
+}
+
+// WithMaxBodySize fails requests whose body is larger than n bytes with
+// ErrBodyTooLarge: as soon as Content-Length announces it, or once a chunked
+// body grows past it.
+func WithMaxBodySize(n int64) Option {
+	return func(c *config) {
+		c.maxBodySize = n
+	}
+}
+
+// WithMaxHeadSize fails requests whose request line and header section
+// together pass n bytes, with ErrInvalidRequestLine while the request line is
+// still incomplete and ErrHeadersTooLarge afterwards. Defaults to
+// DefaultMaxHeadSize.
+func WithMaxHeadSize(n int) Option {
+	return func(c *config) {
+		c.maxHeadSize = n
+	}
+}
+
+// WithHardenedParsing rejects every input whose framing another parser could
+// read differently: request lines not separated by single spaces, obsolete
+// folding, bare LF, repeated Content-Length
+// values, Transfer-Encoding together with Content-Length or in HTTP/1.0, and
+// malformed chunk extensions. It overrides WithHeaderPolicy.
+func WithHardenedParsing() Option {
+	return func(c *config) {
+		c.hardened = true
+	}
+}
+
+// Unreader is implemented by readers that take back the bytes read past the
+// end of a request, so that the next request read from them starts with those
+// bytes. Connections read through an Unreader can carry pipelined requests. p
+// belongs to a pooled buffer, so Unread must copy what it keeps.
+type Unreader interface {
+	io.Reader
+	Unread(p []byte)
+}
+
+// RequestFromReader reads a full request from reader. When the request carries
+// "Expect: 100-continue" reading stops after the headers and the body is only
+// read once ReadBody is called. If reader is an Unreader, whatever was read
+// past the end of the request is handed back to it.
+func RequestFromReader(reader io.Reader, opts ...Option) (*Request, error) {
+	cfg := config{
+		allowedMethods: DefaultMethods,
+		maxHeadSize:    DefaultMaxHeadSize,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.hardened {
+		cfg.headerPolicy = headers.Policy{}
+	}
+	req := &Request{
+		cfg:         cfg,
+		fieldParser: headers.Parser{Policy: cfg.headerPolicy},
+		state:       requestStateInitialized,
+		bodyLimit:   cfg.maxBodySize,
+		Headers:     headers.NewHeaders(),
+		Body:        make([]byte, 0),
+		reader:      reader,
+		pooled:      bufferPool.Get().(*[]byte),
+	}
+	req.buf = *req.pooled
+	if err := req.read(); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
 
-func RequestFromReader(reader io.Reader) (*Request, error) {
-	buf := make([]byte, bufferSize, bufferSize)
-	readToIndex := 0
+// NewRequest builds a complete request from parts a framed protocol such as
+// HTTP/2 delivers separately, validating them like RequestFromReader. A
+// non-empty authority replaces the Host header. version is "major.minor".
+func NewRequest(method, target, version, authority string, h headers.Headers, body []byte, opts ...Option) (*Request, error) {
+	cfg := config{
+		allowedMethods: DefaultMethods,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if !headers.IsToken(method) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidMethod, method)
+	}
+	if !slices.Contains(cfg.allowedMethods, method) {
+		return nil, fmt.Errorf("%w: %s", ErrMethodNotImplemented, method)
+	}
+	if err := validateTarget(method, target); err != nil {
+		return nil, err
+	}
+	if body == nil {
+		body = make([]byte, 0)
+	}
 	req := &Request{
-		state:   requestStateInitialized,
-		Headers: headers.NewHeaders(),
-		Body:    make([]byte, 0),
+		cfg:   cfg,
+		state: requestStateDone,
+		RequestLine: RequestLine{
+			Method:        method,
+			RequestTarget: target,
+			HttpVersion:   version,
+		},
+		Headers:      h,
+		Body:         body,
+		readBodySize: len(body),
+	}
+	if authority != "" {
+		h.Override(headers.HostHeader, authority)
+	}
+	if _, present := h.Get(headers.HostHeader); present {
+		req.hostCount = 1
+	}
+	if err := req.parseHost(); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// read parses the unparsed bytes of buf[start:end] and reads more until the
+// request, or its head when the body is deferred, is complete. Unparsed bytes
+// are only moved to the front of buf once it is full.
+func (r *Request) read() error {
+	err := r.readMore()
+	if err == nil && r.state == requestStateDone {
+		r.unreadRest()
 	}
-	for req.state != requestStateDone {
-		if readToIndex >= len(buf) {
-			newBuf := make([]byte, len(buf)*2)
-			copy(newBuf, buf)
-			buf = newBuf
+	if err != nil || r.state == requestStateDone {
+		r.release()
+	}
+	return err
+}
+
+func (r *Request) readMore() error {
+	for {
+		numBytesParsed, err := r.parse(r.buf[r.start:r.end])
+		if err != nil {
+			return err
+		}
+		r.start += numBytesParsed
+		if r.start == r.end {
+			r.start, r.end = 0, 0
+		}
+		if err := r.checkHeadSize(); err != nil {
+			return err
+		}
+		if r.state == requestStateDone || r.deferBody || (r.streamBody && len(r.Body) > 0) {
+			return nil
 		}
 
-		numBytesRead, err := reader.Read(buf[readToIndex:])
+		if r.end == len(r.buf) {
+			r.makeRoom()
+		}
+
+		numBytesRead, err := r.reader.Read(r.buf[r.end:])
+		r.end += numBytesRead
 		if err != nil {
-			if errors.Is(io.EOF, err) {
-				if req.state != requestStateDone {
-					return nil, fmt.Errorf("incomplete request, in state: %d, read n bytes on EOF: %d", req.state, numBytesRead)
+			if errors.Is(err, io.EOF) {
+				if numBytesRead > 0 {
+					continue
+				}
+				if r.state == requestStateInitialized && r.start == r.end {
+					// the peer closed the connection before starting a request
+					return io.EOF
 				}
-				break
+				return fmt.Errorf("incomplete request, in state: %d, read n bytes on EOF: %d", r.state, numBytesRead)
 			}
-			return nil, err
+			return err
 		}
-		readToIndex += numBytesRead
+	}
+}
 
-		numBytesParsed, err := req.parse(buf[:readToIndex])
-		if err != nil {
-			return nil, err
+// checkHeadSize fails once the head parsed so far, together with the unparsed
+// bytes of a head still incomplete, passes the limit.
+func (r *Request) checkHeadSize() error {
+	size := r.headSize
+	if r.state < requestStateParsingBody {
+		size += r.end - r.start
+	}
+	if size <= r.cfg.maxHeadSize {
+		return nil
+	}
+	if r.state == requestStateInitialized {
+		return fmt.Errorf("%w: longer than %d bytes", ErrInvalidRequestLine, r.cfg.maxHeadSize)
+	}
+	return fmt.Errorf("%w: more than %d bytes", ErrHeadersTooLarge, r.cfg.maxHeadSize)
+}
+
+// makeRoom frees space at the end of a full buffer, by moving the unparsed
+// bytes to the front or, when they fill it, by doubling it.
+func (r *Request) makeRoom() {
+	if r.start > 0 {
+		r.end = copy(r.buf, r.buf[r.start:r.end])
+		r.start = 0
+		return
+	}
+	newBuf := make([]byte, len(r.buf)*2)
+	copy(newBuf, r.buf)
+	r.buf = newBuf
+}
+
+// release returns the read buffer to the pool once the request is read or
+// failed. Bytes read past the request are kept for Buffered.
+func (r *Request) release() {
+	if r.pooled == nil {
+		return
+	}
+	rest := slices.Clone(r.buf[r.start:r.end])
+	if len(r.buf) <= maxPooledBufferSize {
+		*r.pooled = r.buf
+		bufferPool.Put(r.pooled)
+	}
+	r.pooled = nil
+	r.buf, r.start, r.end = rest, 0, len(rest)
+}
+
+// ExpectsContinue reports whether the client sent "Expect: 100-continue" and
+// is waiting for an interim response before sending the body. The expectation
+// is ignored for HTTP/1.0 requests.
+func (r *Request) ExpectsContinue() bool {
+	expect, present := r.Headers.Get(headers.ExpectHeader)
+	return present && strings.EqualFold(expect, continueExpectation) && r.ProtoAtLeast(1, 1)
+}
+
+// Protocol names the protocol the request arrived over by its ALPN
+// identifier: "h2", "h2c", "http/1.1" or "http/1.0".
+func (r *Request) Protocol() string {
+	if r.RequestLine.HttpVersion == "2.0" {
+		if r.TLS != nil {
+			return "h2"
 		}
+		return "h2c"
+	}
+	return "http/" + r.RequestLine.HttpVersion
+}
+
+// ProtoAtLeast reports whether the request version is at least major.minor.
+func (r *Request) ProtoAtLeast(major, minor int) bool {
+	reqMajor, reqMinor := r.RequestLine.Version()
+	return reqMajor > major || (reqMajor == major && reqMinor >= minor)
+}
+
+// Version returns the numeric major and minor HTTP version.
+func (rl RequestLine) Version() (int, int) {
+	majorStr, minorStr, _ := strings.Cut(rl.HttpVersion, ".")
+	major, _ := strconv.Atoi(majorStr)
+	minor, _ := strconv.Atoi(minorStr)
+	return major, minor
+}
 
-		copy(buf, buf[numBytesParsed:])
-		readToIndex -= numBytesParsed
+// KeepAlive reports whether the client wants the connection to persist after
+// this request: by default for HTTP/1.1 unless "Connection: close" was sent, and
+// only on "Connection: keep-alive" for HTTP/1.0. Requests with dubious framing
+// always close the connection.
+func (r *Request) KeepAlive() bool {
+	if r.closeAfter || r.HasConnectionOption("close") {
+		return false
 	}
-	return req, nil
+	if r.ProtoAtLeast(1, 1) {
+		return true
+	}
+	return r.HasConnectionOption("keep-alive")
+}
+
+// HasConnectionOption reports whether option is listed in the Connection header.
+func (r *Request) HasConnectionOption(option string) bool {
+	value, present := r.Headers.Get(headers.ConnectionHeader)
+	if !present {
+		return false
+	}
+	for _, token := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(token), option) {
+			return true
+		}
+	}
+	return false
+}
+
+// Context returns the request's context. The server cancels it when the client
+// goes away, the server shuts down or the request times out.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// SetContext replaces the request's context. Middleware attaches
+// request-scoped values by deriving the new context from Context().
+func (r *Request) SetContext(ctx context.Context) {
+	r.ctx = ctx
+}
+
+// LastEventID returns the Last-Event-ID header an EventSource sends when it
+// reconnects, so a stream can resume after the last event the client saw.
+func (r *Request) LastEventID() string {
+	id, _ := r.Headers.Get(lastEventIDHeader)
+	return id
+}
+
+// Buffered returns bytes already read from the connection past the end of the
+// request, such as the start of a deferred body or of a protocol spoken after
+// an upgrade. It is empty once a request read from an Unreader is complete,
+// as those bytes went back to the reader.
+func (r *Request) Buffered() []byte {
+	return slices.Clone(r.buf[r.start:r.end])
+}
+
+// unreadRest hands the bytes read past the end of the request back to an
+// Unreader.
+func (r *Request) unreadRest() {
+	u, ok := r.reader.(Unreader)
+	if !ok || r.start == r.end {
+		return
+	}
+	u.Unread(r.buf[r.start:r.end])
+	r.start, r.end = 0, 0
+}
+
+// OnContinue registers the function invoked right before a deferred body is
+// read, typically writing the "100 Continue" interim response.
+func (r *Request) OnContinue(f func() error) {
+	r.continueFunc = f
+}
+
+// BodyPending reports whether the body has not been read in full, because the
+// client is waiting for "100 Continue" or reading it failed. The rest of it is
+// still on the wire.
+func (r *Request) BodyPending() bool {
+	return r.state != requestStateDone
+}
+
+// ReadBody returns the request body, reading it from the connection first if it
+// was deferred by "Expect: 100-continue".
+func (r *Request) ReadBody() ([]byte, error) {
+	if !r.deferBody {
+		return r.Body, nil
+	}
+	if err := r.startBody(); err != nil {
+		return nil, err
+	}
+	if err := r.read(); err != nil {
+		return nil, err
+	}
+	return r.Body, nil
+}
+
+// ReadBodyLimit behaves like ReadBody but fails with ErrBodyTooLarge when the
+// body holds more than n bytes. A deferred body announced as larger is
+// rejected without asking the client for it, and one read in chunks is
+// abandoned once it passes n, so no more than n bytes of it are held.
+func (r *Request) ReadBodyLimit(n int64) ([]byte, error) {
+	if !r.deferBody {
+		if int64(len(r.Body)) > n {
+			return nil, ErrBodyTooLarge
+		}
+		return r.Body, nil
+	}
+	if err := r.limitBody(n); err != nil {
+		return nil, err
+	}
+	return r.ReadBody()
+}
+
+// limitBody lowers the size limit of a deferred body to n, failing when the
+// body is already announced as larger.
+func (r *Request) limitBody(n int64) error {
+	if r.framing == framingContentLength && r.bodyRemaining > n {
+		return ErrBodyTooLarge
+	}
+	if r.bodyLimit == 0 || n < r.bodyLimit {
+		r.bodyLimit = n
+	}
+	return nil
+}
+
+// startBody lets the client send a deferred body.
+func (r *Request) startBody() error {
+	if r.continueFunc != nil {
+		if err := r.continueFunc(); err != nil {
+			return err
+		}
+	}
+	r.deferBody = false
+	return nil
+}
+
+// BodyReader returns a reader over the body that fails with ErrBodyTooLarge
+// when it holds more than n bytes. A body deferred by "Expect: 100-continue"
+// is rejected like in ReadBodyLimit when announced as larger, and otherwise
+// streamed from the connection as it is read instead of being collected in
+// Body.
+func (r *Request) BodyReader(n int64) (io.Reader, error) {
+	if !r.deferBody {
+		if int64(len(r.Body)) > n {
+			return nil, ErrBodyTooLarge
+		}
+		return bytes.NewReader(r.Body), nil
+	}
+	if err := r.limitBody(n); err != nil {
+		return nil, err
+	}
+	if err := r.startBody(); err != nil {
+		return nil, err
+	}
+	r.streamBody = true
+	return &bodyReader{r: r}, nil
 }
 
-func parseRequestLine(data []byte) (*RequestLine, int, error) {
-	idx := bytes.Index(data, []byte(crlf))
+// bodyReader hands out the body bytes parsed into Body by each read from the
+// connection, then reuses Body for the next ones.
+type bodyReader struct {
+	r   *Request
+	off int
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	r := b.r
+	for b.off == len(r.Body) {
+		if b.err != nil {
+			return 0, b.err
+		}
+		if r.state == requestStateDone {
+			return 0, io.EOF
+		}
+		r.Body, b.off = r.Body[:0], 0
+		b.err = r.read()
+	}
+	n := copy(p, r.Body[b.off:])
+	b.off += n
+	return n, nil
+}
+
+func parseRequestLine(data []byte, cfg config) (RequestLine, int, error) {
+	idx := bytes.IndexByte(data, '\n')
 	if idx == -1 {
-		return nil, 0, nil
+		return RequestLine{}, 0, nil
 	}
-	requestLineText := string(data[:idx])
-	requestLine, err := requestLineFromString(requestLineText)
+	lineEnd := idx
+	if idx > 0 && data[idx-1] == '\r' {
+		lineEnd = idx - 1
+	} else if cfg.headerPolicy.BareLF != headers.BareLFAccept {
+		return RequestLine{}, 0, fmt.Errorf("%w: %w", ErrInvalidRequestLine, headers.ErrBareLF)
+	}
+	requestLine, err := requestLineFromString(string(data[:lineEnd]), cfg)
 	if err != nil {
-		return nil, 0, err
+		return RequestLine{}, 0, err
 	}
-	return requestLine, idx + 2, nil
+	return requestLine, idx + 1, nil
 }
 
-func (r *Request) parseRequestBody(data []byte) {
+func (r *Request) parseRequestBody(data []byte) error {
+	if r.bodyLimit > 0 && int64(r.readBodySize+len(data)) > r.bodyLimit {
+		return fmt.Errorf("%w: more than %d bytes", ErrBodyTooLarge, r.bodyLimit)
+	}
 	r.Body = append(r.Body, data...)
 	r.readBodySize += len(data)
+	return nil
 }
 
-func requestLineFromString(requestLine string) (*RequestLine, error) {
-	requestLineParts := strings.Split(requestLine, " ")
-	if len(requestLineParts) != 3 {
-		return nil, errors.New("invalid request line")
+// requestLineFromString parses "method SP request-target SP HTTP-version".
+// Following RFC 9112 section 3, any run of SP, HTAB, VT, FF or bare CR is
+// accepted as the separator unless parsing is hardened. The parts are
+// substrings of requestLine, which is the only string allocated.
+func requestLineFromString(requestLine string, cfg config) (RequestLine, error) {
+	parts, ok := splitRequestLine(requestLine, cfg.hardened)
+	if !ok {
+		return RequestLine{}, fmt.Errorf("%w: %q", ErrInvalidRequestLine, requestLine)
+	}
+	method := parts[0]
+	if !headers.IsToken(method) {
+		return RequestLine{}, fmt.Errorf("%w: %q", ErrInvalidMethod, method)
 	}
-	method := requestLineParts[0]
-	if !isAllUppercase(method) {
-		return nil, errors.New("invalid method")
+	if !slices.Contains(cfg.allowedMethods, method) {
+		return RequestLine{}, fmt.Errorf("%w: %s", ErrMethodNotImplemented, method)
 	}
-	target := requestLineParts[1]
-	if requestLineParts[2] != "HTTP/1.1" {
-		return nil, errors.New("invalid HTTP version")
+	target := parts[1]
+	if err := validateTarget(method, target); err != nil {
+		return RequestLine{}, err
 	}
-	version := strings.Split(requestLineParts[2], "/")[1]
-	return &RequestLine{
+	version, err := parseVersion(parts[2])
+	if err != nil {
+		return RequestLine{}, err
+	}
+	return RequestLine{
 		Method:        method,
 		RequestTarget: target,
 		HttpVersion:   version,
 	}, nil
 }
 
-func isAllUppercase(s string) bool {
-	for _, r := range s {
-		if !unicode.IsLetter(r) || !unicode.IsUpper(r) {
-			return false
+// splitRequestLine splits line into exactly three non-empty parts, separated
+// by single spaces when hardened and by runs of whitespace otherwise.
+func splitRequestLine(line string, hardened bool) (parts [3]string, ok bool) {
+	if hardened {
+		method, rest, _ := strings.Cut(line, " ")
+		target, version, found := strings.Cut(rest, " ")
+		parts = [3]string{method, target, version}
+		return parts, found && method != "" && target != "" && version != "" && strings.IndexByte(version, ' ') == -1
+	}
+	n := 0
+	for i := 0; i < len(line); {
+		if isRequestLineWhitespace(line[i]) {
+			i++
+			continue
 		}
+		start := i
+		for i < len(line) && !isRequestLineWhitespace(line[i]) {
+			i++
+		}
+		if n == len(parts) {
+			return parts, false
+		}
+		parts[n] = line[start:i]
+		n++
 	}
-	return true
+	return parts, n == len(parts)
+}
+
+// parseVersion validates "HTTP/" DIGIT "." DIGIT and returns "major.minor".
+// Only major version 1 is supported; higher minor versions are served with
+// HTTP/1.1 semantics.
+func parseVersion(httpVersion string) (string, error) {
+	version, found := strings.CutPrefix(httpVersion, "HTTP/")
+	if !found || len(version) != 3 || !isDigit(version[0]) || version[1] != '.' || !isDigit(version[2]) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidVersion, httpVersion)
+	}
+	if version[0] != '1' {
+		return "", fmt.Errorf("%w: %s", ErrVersionNotSupported, httpVersion)
+	}
+	return version, nil
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+func isRequestLineWhitespace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\v' || c == '\f' || c == '\r'
+}
+
+// validateTarget accepts the origin-form ("/path?query"), the absolute-form
+// ("http://host/path"), for OPTIONS only the asterisk-form and, for CONNECT
+// only, the authority-form ("host:port").
+func validateTarget(method, target string) error {
+	for i := 0; i < len(target); i++ {
+		if target[i] <= ' ' || target[i] >= 0x7f {
+			return fmt.Errorf("%w: %q", ErrInvalidTarget, target)
+		}
+	}
+	if method == "CONNECT" {
+		host, port, err := splitAuthority(target)
+		if err != nil || host == "" || port == 0 {
+			return fmt.Errorf("%w: CONNECT requires host:port, got %q", ErrInvalidTarget, target)
+		}
+		return nil
+	}
+	switch {
+	case target == "*":
+		if method != "OPTIONS" {
+			return fmt.Errorf("%w: asterisk-form is only allowed for OPTIONS", ErrInvalidTarget)
+		}
+	case strings.HasPrefix(target, "/"):
+	case strings.Contains(target, "://"):
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidTarget, target)
+	}
+	return nil
 }
 
 func (r *Request) parse(data []byte) (int, error) {
 	totalBytesParsed := 0
-	for r.state != requestStateDone {
+	for r.state != requestStateDone && !r.deferBody {
 		n, err := r.parseSingle(data[totalBytesParsed:])
 		if err != nil {
 			return 0, err
@@ -141,7 +725,7 @@ func (r *Request) parse(data []byte) (int, error) {
 func (r *Request) parseSingle(data []byte) (int, error) {
 	switch r.state {
 	case requestStateInitialized:
-		requestLine, n, err := parseRequestLine(data)
+		requestLine, n, err := parseRequestLine(data, r.cfg)
 		if err != nil {
 			// something actually went wrong
 			return 0, err
@@ -150,39 +734,138 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 			// just need more data
 			return 0, nil
 		}
-		r.RequestLine = *requestLine
+		if n > r.cfg.maxHeadSize {
+			return 0, fmt.Errorf("%w: longer than %d bytes", ErrInvalidRequestLine, r.cfg.maxHeadSize)
+		}
+		r.RequestLine = requestLine
 		r.state = requestStateParsingHeaders
+		r.headSize = n
 		return n, nil
 	case requestStateParsingHeaders:
-		n, done, err := r.Headers.Parse(data)
+		name, n, done, err := r.fieldParser.Parse(r.Headers, data)
 		if err != nil {
 			return 0, err
 		}
+		r.headSize += n
+		switch {
+		case strings.EqualFold(name, headers.HostHeader):
+			r.hostCount++
+		case strings.EqualFold(name, headers.ContentLengthHeader):
+			r.contentLengthCount++
+		}
 		if done {
+			if err := r.parseHost(); err != nil {
+				return 0, err
+			}
+			if err := r.determineFraming(); err != nil {
+				return 0, err
+			}
 			r.state = requestStateParsingBody
+			r.deferBody = r.ExpectsContinue() && r.framing != framingNone
 		}
 		return n, nil
 	case requestStateParsingBody:
-		contentLenStr, present := r.Headers.Get(headers.ContentLengthHeader)
-		if !present {
-			r.state = requestStateDone
-			return len(data), nil
-		}
-		expectedBodySize, err := strconv.Atoi(contentLenStr)
-		if err != nil {
-			return 0, err
-		}
-		r.parseRequestBody(data)
-		if r.readBodySize > expectedBodySize {
-			return 0, fmt.Errorf("expected body size %d, actual body size %d", expectedBodySize, r.readBodySize)
-		}
-		if r.readBodySize == expectedBodySize {
-			r.state = requestStateDone
-		}
-		return len(data), nil
+		return r.parseBody(data)
 	case requestStateDone:
 		return 0, fmt.Errorf("error: trying to read data in a done state")
 	default:
 		return 0, fmt.Errorf("unknown state")
 	}
 }
+
+// parseHost enforces that HTTP/1.1 requests carry exactly one Host header and
+// resolves Host and Port, preferring the authority of an absolute-form or
+// authority-form target.
+func (r *Request) parseHost() error {
+	if r.hostCount > 1 {
+		return ErrDuplicateHost
+	}
+	if r.hostCount == 0 && r.ProtoAtLeast(1, 1) {
+		return ErrMissingHost
+	}
+	authority, _ := r.Headers.Get(headers.HostHeader)
+	if r.RequestLine.Method == "CONNECT" {
+		authority = r.RequestLine.RequestTarget
+	} else if scheme, rest, found := strings.Cut(r.RequestLine.RequestTarget, "://"); found && scheme != "" {
+		authority, _, _ = strings.Cut(rest, "/")
+		authority, _, _ = strings.Cut(authority, "?")
+	}
+	host, port, err := splitAuthority(authority)
+	if err != nil {
+		return err
+	}
+	r.Host = host
+	r.Port = port
+	return nil
+}
+
+// splitAuthority splits "host[:port]" per RFC 3986, returning the lower-cased
+// host without IPv6 brackets.
+func splitAuthority(authority string) (string, int, error) {
+	if authority == "" {
+		return "", 0, nil
+	}
+	host, portStr := authority, ""
+	if strings.HasPrefix(authority, "[") {
+		end := strings.Index(authority, "]")
+		if end == -1 {
+			return "", 0, fmt.Errorf("%w: %q", ErrInvalidHost, authority)
+		}
+		host = authority[1:end]
+		if net.ParseIP(host) == nil {
+			return "", 0, fmt.Errorf("%w: %q", ErrInvalidHost, authority)
+		}
+		rest := authority[end+1:]
+		if rest != "" {
+			if rest[0] != ':' {
+				return "", 0, fmt.Errorf("%w: %q", ErrInvalidHost, authority)
+			}
+			portStr = rest[1:]
+		}
+	} else {
+		if i := strings.LastIndex(authority, ":"); i != -1 {
+			host, portStr = authority[:i], authority[i+1:]
+		}
+		if host == "" || !isRegName(host) {
+			return "", 0, fmt.Errorf("%w: %q", ErrInvalidHost, authority)
+		}
+	}
+	port := 0
+	if portStr != "" {
+		for i := 0; i < len(portStr); i++ {
+			if !isDigit(portStr[i]) {
+				return "", 0, fmt.Errorf("%w: %q", ErrInvalidHost, authority)
+			}
+		}
+		n, err := strconv.Atoi(portStr)
+		if err != nil || n > 65535 {
+			return "", 0, fmt.Errorf("%w: %q", ErrInvalidHost, authority)
+		}
+		port = n
+	}
+	return strings.ToLower(host), port, nil
+}
+
+// isRegName reports whether host only uses reg-name characters: unreserved,
+// percent-encoded and sub-delims. IPv4 addresses are a subset of it.
+func isRegName(host string) bool {
+	for i := 0; i < len(host); i++ {
+		c := host[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', isDigit(c):
+		case strings.IndexByte("-._~!$&'()*+,;=", c) != -1:
+		case c == '%':
+			if i+2 >= len(host) || !isHex(host[i+1]) || !isHex(host[i+2]) {
+				return false
+			}
+			i += 2
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func isHex(b byte) bool {
+	return isDigit(b) || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F')
+}
@@ -2,8 +2,10 @@ package request
 
 import (
 	"io"
+	"strings"
 	"testing"
 
+	"github.com/alexmarian/httpfromtcp/internal/headers"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -70,6 +72,196 @@ func TestRequestLineParse(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestRequestLineGrammar(t *testing.T) {
+	parse := func(line string, opts ...Option) (*Request, error) {
+		return RequestFromReader(&chunkReader{
+			data:            line + "\r\nHost: localhost:42069\r\n\r\n",
+			numBytesPerRead: 4,
+		}, opts...)
+	}
+
+	// Test: Token methods with non-letters are valid when allowed
+	r, err := parse("M-SEARCH /devices HTTP/1.1", WithAllowedMethods("M-SEARCH"))
+	require.NoError(t, err)
+	assert.Equal(t, "M-SEARCH", r.RequestLine.Method)
+
+	// Test: Valid token outside the allowed set
+	_, err = parse("M-SEARCH /devices HTTP/1.1")
+	require.ErrorIs(t, err, ErrMethodNotImplemented)
+
+	// Test: Non-ASCII uppercase letters are not a token
+	_, err = parse("GÉT / HTTP/1.1")
+	require.ErrorIs(t, err, ErrInvalidMethod)
+
+	// Test: Separators are not allowed in a method
+	_, err = parse("GE(T / HTTP/1.1")
+	require.ErrorIs(t, err, ErrInvalidMethod)
+
+	// Test: Runs of whitespace separate the parts
+	r, err = parse("GET  \t/coffee   HTTP/1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "/coffee", r.RequestLine.RequestTarget)
+
+	// Test: Asterisk-form is only valid for OPTIONS
+	r, err = parse("OPTIONS * HTTP/1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "*", r.RequestLine.RequestTarget)
+	_, err = parse("GET * HTTP/1.1")
+	require.ErrorIs(t, err, ErrInvalidTarget)
+
+	// Test: Absolute-form target
+	r, err = parse("GET http://localhost:42069/coffee HTTP/1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:42069/coffee", r.RequestLine.RequestTarget)
+
+	// Test: Authority-form is only valid for CONNECT and needs a port
+	r, err = parse("CONNECT example.com:443 HTTP/1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "example.com:443", r.RequestLine.RequestTarget)
+	for _, line := range []string{"GET example.com:443 HTTP/1.1", "CONNECT example.com HTTP/1.1", "CONNECT / HTTP/1.1", "CONNECT http://example.com:443/ HTTP/1.1"} {
+		_, err = parse(line)
+		require.ErrorIs(t, err, ErrInvalidTarget, line)
+	}
+
+	// Test: Relative target
+	_, err = parse("GET coffee HTTP/1.1")
+	require.ErrorIs(t, err, ErrInvalidTarget)
+
+	// Test: Too many parts
+	_, err = parse("GET / extra HTTP/1.1")
+	require.ErrorIs(t, err, ErrInvalidRequestLine)
+
+	// Test: Invalid version
+	_, err = parse("GET / HTTP/x")
+	require.ErrorIs(t, err, ErrInvalidVersion)
+}
+
+func TestHTTPVersion(t *testing.T) {
+	parse := func(data string) (*Request, error) {
+		return RequestFromReader(&chunkReader{data: data, numBytesPerRead: 4})
+	}
+
+	// Test: HTTP/1.0 closes by default
+	r, err := parse("GET / HTTP/1.0\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+	assert.False(t, r.ProtoAtLeast(1, 1))
+	assert.False(t, r.KeepAlive())
+
+	// Test: HTTP/1.0 keep-alive on request
+	r, err = parse("GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+
+	// Test: HTTP/1.1 persists unless asked to close
+	r, err = parse("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+	r, err = parse("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: foo, close\r\n\r\n")
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+
+	// Test: HTTP/1.0 ignores Expect
+	r, err = parse("POST / HTTP/1.0\r\nExpect: 100-continue\r\nContent-Length: 2\r\n\r\nhi")
+	require.NoError(t, err)
+	assert.False(t, r.ExpectsContinue())
+	assert.Equal(t, "hi", string(r.Body))
+
+	// Test: Higher minor versions are accepted
+	r, err = parse("GET / HTTP/1.2\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, r.ProtoAtLeast(1, 1))
+
+	// Test: Unsupported major version
+	_, err = parse("GET / HTTP/2.0\r\n\r\n")
+	require.ErrorIs(t, err, ErrVersionNotSupported)
+
+	// Test: Malformed version
+	_, err = parse("GET / HTTP/1.10\r\n\r\n")
+	require.ErrorIs(t, err, ErrInvalidVersion)
+
+	// Test: Connection closed before any request byte
+	_, err = parse("")
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestHostParse(t *testing.T) {
+	parse := func(data string) (*Request, error) {
+		return RequestFromReader(&chunkReader{data: data, numBytesPerRead: 5})
+	}
+
+	// Test: Host with port
+	r, err := parse("GET / HTTP/1.1\r\nHost: LocalHost:42069\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "localhost", r.Host)
+	assert.Equal(t, 42069, r.Port)
+
+	// Test: IPv6 literal
+	r, err = parse("GET / HTTP/1.1\r\nHost: [::1]:8080\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "::1", r.Host)
+	assert.Equal(t, 8080, r.Port)
+
+	// Test: Empty Host is allowed
+	r, err = parse("GET / HTTP/1.1\r\nHost:\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "", r.Host)
+
+	// Test: Absolute-form target overrides Host
+	r, err = parse("GET http://example.com:8080/path HTTP/1.1\r\nHost: other\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", r.Host)
+	assert.Equal(t, 8080, r.Port)
+
+	// Test: Authority-form target overrides Host
+	r, err = parse("CONNECT [::1]:8443 HTTP/1.1\r\nHost: other\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "::1", r.Host)
+	assert.Equal(t, 8443, r.Port)
+
+	// Test: HTTP/1.0 without Host
+	r, err = parse("GET / HTTP/1.0\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, "", r.Host)
+
+	// Test: Missing Host
+	_, err = parse("GET / HTTP/1.1\r\nAccept: */*\r\n\r\n")
+	require.ErrorIs(t, err, ErrMissingHost)
+
+	// Test: Duplicate Host
+	_, err = parse("GET / HTTP/1.1\r\nHost: localhost:42069\r\nhost: duplicate:8080\r\n\r\n")
+	require.ErrorIs(t, err, ErrDuplicateHost)
+
+	// Test: Invalid Host values
+	for _, host := range []string{"local host", "example.com:port", "example.com:99999", "[::1", "[nothost]", "exa/mple.com", ":80"} {
+		_, err = parse("GET / HTTP/1.1\r\nHost: " + host + "\r\n\r\n")
+		require.ErrorIs(t, err, ErrInvalidHost, host)
+	}
+}
+
+func TestHeaderPolicy(t *testing.T) {
+	bareLF := "GET / HTTP/1.1\nHost: localhost\nX-Folded: a\n b\n\n"
+
+	// Test: Bare LF rejected by default
+	_, err := RequestFromReader(&chunkReader{data: bareLF, numBytesPerRead: 3})
+	require.ErrorIs(t, err, headers.ErrBareLF)
+
+	// Test: Bare LF accepted, obs-fold still rejected
+	_, err = RequestFromReader(&chunkReader{data: bareLF, numBytesPerRead: 3},
+		WithHeaderPolicy(headers.Policy{BareLF: headers.BareLFAccept}))
+	require.ErrorIs(t, err, headers.ErrObsFold)
+
+	// Test: Both accepted
+	r, err := RequestFromReader(&chunkReader{data: bareLF, numBytesPerRead: 3},
+		WithHeaderPolicy(headers.Policy{BareLF: headers.BareLFAccept, ObsFold: headers.ObsFoldReplace}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a b"}, r.Headers["x-folded"])
+
+	// Test: NUL in a value
+	_, err = RequestFromReader(&chunkReader{data: "GET / HTTP/1.1\r\nHost: local\x00host\r\n\r\n", numBytesPerRead: 3})
+	require.ErrorIs(t, err, headers.ErrInvalidFieldValue)
+}
+
 func TestHeadersParse(t *testing.T) {
 	// Test: Standard Headers
 	reader := &chunkReader{
@@ -79,13 +271,13 @@ func TestHeadersParse(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, []string{"localhost:42069"}, r.Headers["host"])
+	assert.Equal(t, []string{"curl/7.81.0"}, r.Headers["user-agent"])
+	assert.Equal(t, []string{"*/*"}, r.Headers["accept"])
 
 	// Test: Empty Headers
 	reader = &chunkReader{
-		data:            "GET / HTTP/1.1\r\n\r\n",
+		data:            "GET / HTTP/1.0\r\n\r\n",
 		numBytesPerRead: 3,
 	}
 	r, err = RequestFromReader(reader)
@@ -103,13 +295,13 @@ func TestHeadersParse(t *testing.T) {
 
 	// Test: Duplicate Headers
 	reader = &chunkReader{
-		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nHost: duplicate:8080\r\n\r\n",
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nAccept: text/html\r\nAccept: */*\r\n\r\n",
 		numBytesPerRead: 3,
 	}
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069, duplicate:8080", r.Headers["host"])
+	assert.Equal(t, []string{"text/html, */*"}, r.Headers["accept"])
 
 	// Test: Case Insensitive Headers
 	reader = &chunkReader{
@@ -119,8 +311,8 @@ func TestHeadersParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
+	assert.Equal(t, []string{"localhost:42069"}, r.Headers["host"])
+	assert.Equal(t, []string{"curl/7.81.0"}, r.Headers["user-agent"])
 
 	// Test: Missing End of Headers
 	reader = &chunkReader{
@@ -196,6 +388,283 @@ func TestBodyParse(t *testing.T) {
 
 }
 
+func TestMaxBodySize(t *testing.T) {
+	// Test: Content-Length over the limit fails before the body is read
+	_, err := RequestFromReader(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 6\r\n\r\n",
+		numBytesPerRead: 3,
+	}, WithMaxBodySize(5))
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: A chunked body fails once it passes the limit
+	_, err = RequestFromReader(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n3\r\ndef\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}, WithMaxBodySize(5))
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: A body of exactly the limit is read
+	r, err := RequestFromReader(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}, WithMaxBodySize(5))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(r.Body))
+
+	// Test: ReadBodyLimit on a body already read
+	body, err := r.ReadBodyLimit(5)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	_, err = r.ReadBodyLimit(4)
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+}
+
+func TestMaxHeadSize(t *testing.T) {
+	head := "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+
+	// Test: A head of exactly the limit is read
+	_, err := RequestFromReader(&chunkReader{data: head, numBytesPerRead: 7}, WithMaxHeadSize(len(head)))
+	require.NoError(t, err)
+	_, err = RequestFromReader(strings.NewReader(head), WithMaxHeadSize(len(head)-1))
+	assert.ErrorIs(t, err, ErrHeadersTooLarge)
+
+	// Test: Header fields fail once they pass the limit
+	_, err = RequestFromReader(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost\r\nX-Big: " + strings.Repeat("a", 200) + "\r\n\r\n",
+		numBytesPerRead: 7,
+	}, WithMaxHeadSize(100))
+	assert.ErrorIs(t, err, ErrHeadersTooLarge)
+
+	// Test: An overlong request line is invalid, complete or not
+	_, err = RequestFromReader(strings.NewReader("GET /"+strings.Repeat("a", 200)+" HTTP/1.1\r\nHost: localhost\r\n\r\n"), WithMaxHeadSize(100))
+	assert.ErrorIs(t, err, ErrInvalidRequestLine)
+	assert.NotErrorIs(t, err, ErrHeadersTooLarge)
+	_, err = RequestFromReader(&chunkReader{data: "GET /" + strings.Repeat("a", 200), numBytesPerRead: 7}, WithMaxHeadSize(100))
+	assert.ErrorIs(t, err, ErrInvalidRequestLine)
+
+	// Test: The default stops a head that never ends without reading all of it
+	reader := &endlessReader{line: []byte("X-Filler: " + strings.Repeat("a", 4000) + "\r\n")}
+	_, err = RequestFromReader(io.MultiReader(strings.NewReader("GET / HTTP/1.1\r\n"), reader))
+	assert.ErrorIs(t, err, ErrHeadersTooLarge)
+	assert.Less(t, reader.n, DefaultMaxHeadSize+initialBufferSize)
+}
+
+// endlessReader repeats line forever, counting the bytes handed out.
+type endlessReader struct {
+	line []byte
+	pos  int
+	n    int
+}
+
+func (e *endlessReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], e.line[e.pos:])
+		e.pos = (e.pos + c) % len(e.line)
+		n += c
+	}
+	e.n += n
+	return n, nil
+}
+
+func TestExpectContinue(t *testing.T) {
+	// Test: Body deferred until ReadBody
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 13\r\n" +
+			"Expect: 100-continue\r\n" +
+			"\r\n" +
+			"hello world!\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.True(t, r.ExpectsContinue())
+	assert.True(t, r.BodyPending())
+	assert.Equal(t, "", string(r.Body))
+	continued := false
+	r.OnContinue(func() error {
+		continued = true
+		return nil
+	})
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.True(t, continued)
+	assert.False(t, r.BodyPending())
+	assert.Equal(t, "hello world!\n", string(body))
+
+	// Test: Failing continue hook aborts the body read
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 13\r\n" +
+			"Expect: 100-Continue\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	r.OnContinue(func() error {
+		return io.ErrClosedPipe
+	})
+	_, err = r.ReadBody()
+	require.Error(t, err)
+
+	// Test: BodyReader streams a deferred chunked body without collecting it
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Expect: 100-continue\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	continued = false
+	r.OnContinue(func() error {
+		continued = true
+		return nil
+	})
+	stream, err := r.BodyReader(11)
+	require.NoError(t, err)
+	assert.True(t, continued)
+	streamed, err := io.ReadAll(stream)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(streamed))
+	assert.LessOrEqual(t, len(r.Body), 3)
+	assert.False(t, r.BodyPending())
+
+	// Test: BodyReader enforces its limit while streaming
+	reader = &chunkReader{data: reader.data, numBytesPerRead: 3}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	stream, err = r.BodyReader(10)
+	require.NoError(t, err)
+	_, err = io.ReadAll(stream)
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+	assert.True(t, r.BodyPending())
+
+	// Test: Without Expect the body is read eagerly
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.False(t, r.BodyPending())
+	body, err = r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestPipelining(t *testing.T) {
+	pipeline := "GET /one HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"POST /two HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello" +
+		"POST /three HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n" +
+		"GET /four HTTP/1.1\r\nHost: localhost\r\n\r\n"
+
+	// Test: Requests read from an Unreader leave the next one intact
+	for _, n := range []int{1, 7, 64, len(pipeline)} {
+		reader := &unreadReader{chunkReader: chunkReader{data: pipeline, numBytesPerRead: n}}
+		var targets, bodies []string
+		for {
+			r, err := RequestFromReader(reader)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err, "%d bytes per read", n)
+			assert.Empty(t, r.Buffered())
+			targets = append(targets, r.RequestLine.RequestTarget)
+			bodies = append(bodies, string(r.Body))
+		}
+		assert.Equal(t, []string{"/one", "/two", "/three", "/four"}, targets, "%d bytes per read", n)
+		assert.Equal(t, []string{"", "hello", "abc", ""}, bodies, "%d bytes per read", n)
+	}
+
+	// Test: A deferred body hands back what follows it once read
+	reader := &unreadReader{chunkReader: chunkReader{
+		data: "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n" +
+			"helloGET /next HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 16,
+	}}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.True(t, r.BodyPending())
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+}
+
+func TestReadBuffer(t *testing.T) {
+	// Test: A head larger than the initial buffer grows it
+	long := strings.Repeat("v", 3*initialBufferSize)
+	reader := &chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost\r\nX-Long: " + long + "\r\n\r\n",
+		numBytesPerRead: 1000,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	value, _ := r.Headers.Get("X-Long")
+	assert.Equal(t, long, value)
+
+	// Test: Nothing parsed from a pooled buffer changes once it is reused
+	reader = &chunkReader{
+		data:            "POST /first HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhelloextra",
+		numBytesPerRead: 64,
+	}
+	first, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		reader = &chunkReader{
+			data:            "PUT /other HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nworldXXXXX",
+			numBytesPerRead: 64,
+		}
+		_, err = RequestFromReader(reader)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, "/first", first.RequestLine.RequestTarget)
+	host, _ := first.Headers.Get("Host")
+	assert.Equal(t, "localhost", host)
+	assert.Equal(t, "hello", string(first.Body))
+	assert.Equal(t, "extra", string(first.Buffered()))
+}
+
+// unreadReader is a chunkReader that takes back bytes read too far.
+type unreadReader struct {
+	chunkReader
+	pending []byte
+	spare   []byte
+}
+
+func (ur *unreadReader) Read(p []byte) (int, error) {
+	if len(ur.pending) > 0 {
+		n := copy(p, ur.pending)
+		ur.pending = ur.pending[n:]
+		return n, nil
+	}
+	return ur.chunkReader.Read(p)
+}
+
+func (ur *unreadReader) Unread(p []byte) {
+	if len(ur.pending) > 0 {
+		ur.pending = append(append([]byte(nil), p...), ur.pending...)
+		return
+	}
+	ur.spare = append(ur.spare[:0], p...)
+	ur.pending = ur.spare
+}
+
 type chunkReader struct {
 	data            string
 	numBytesPerRead int
@@ -218,3 +687,61 @@ func (cr *chunkReader) Read(p []byte) (n int, err error) {
 	}
 	return n, nil
 }
+
+var benchmarkRequests = map[string]string{
+	"get": "GET /index.html?page=2 HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"User-Agent: Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0\r\n" +
+		"Accept: text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8\r\n" +
+		"Accept-Language: en-US,en;q=0.5\r\n" +
+		"Accept-Encoding: gzip, deflate, br\r\n" +
+		"Connection: keep-alive\r\n" +
+		"Cookie: session=3f9a2c; theme=dark\r\n" +
+		"Upgrade-Insecure-Requests: 1\r\n" +
+		"\r\n",
+	"post": "POST /api/items HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Content-Type: application/json\r\n" +
+		"Content-Length: 1024\r\n" +
+		"\r\n" + strings.Repeat("x", 1024),
+	"chunked": "POST /upload HTTP/1.1\r\n" +
+		"Host: localhost:42069\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"\r\n" + strings.Repeat("100\r\n"+strings.Repeat("y", 256)+"\r\n", 8) + "0\r\n\r\n",
+}
+
+func BenchmarkRequestFromReader(b *testing.B) {
+	for _, name := range []string{"get", "post", "chunked"} {
+		data := benchmarkRequests[name]
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			reader := strings.NewReader(data)
+			for i := 0; i < b.N; i++ {
+				reader.Reset(data)
+				if _, err := RequestFromReader(reader); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPipelined(b *testing.B) {
+	data := strings.Repeat(benchmarkRequests["get"], 16)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	reader := &unreadReader{}
+	for i := 0; i < b.N; i++ {
+		reader.chunkReader = chunkReader{data: data, numBytesPerRead: len(data)}
+		for {
+			_, err := RequestFromReader(reader)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package request
+
+import (
+	"testing"
+
+	"github.com/alexmarian/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// smugglingCases are request framings known to be read differently by
+// different HTTP implementations. A nil error means the request must parse
+// and yield body.
+var smugglingCases = []struct {
+	name     string
+	raw      string
+	lenient  error
+	hardened error
+	body     string
+}{
+	{
+		name: "content-length",
+		raw:  "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello",
+		body: "hello",
+	},
+	{
+		name: "content-length with OWS",
+		raw:  "POST / HTTP/1.1\r\nHost: a\r\nContent-Length:  5 \r\n\r\nhello",
+		body: "hello",
+	},
+	{
+		name: "body beyond content-length is left unread",
+		raw:  "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhelloGET /smuggled HTTP/1.1\r\n\r\n",
+		body: "hello",
+	},
+	{
+		name:     "duplicate identical content-length lines",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello",
+		hardened: ErrAmbiguousFraming,
+		body:     "hello",
+	},
+	{
+		name:     "identical content-length list",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5, 5\r\n\r\nhello",
+		hardened: ErrAmbiguousFraming,
+		body:     "hello",
+	},
+	{
+		name:     "conflicting content-length lines",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello!",
+		lenient:  ErrAmbiguousFraming,
+		hardened: ErrAmbiguousFraming,
+	},
+	{
+		name:     "conflicting content-length list",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 6, 5\r\n\r\nhello!",
+		lenient:  ErrAmbiguousFraming,
+		hardened: ErrAmbiguousFraming,
+	},
+	{
+		name:     "signed content-length",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: +5\r\n\r\nhello",
+		lenient:  ErrInvalidContentLength,
+		hardened: ErrInvalidContentLength,
+	},
+	{
+		name:     "negative content-length",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: -1\r\n\r\n",
+		lenient:  ErrInvalidContentLength,
+		hardened: ErrInvalidContentLength,
+	},
+	{
+		name:     "hex content-length",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 0x5\r\n\r\nhello",
+		lenient:  ErrInvalidContentLength,
+		hardened: ErrInvalidContentLength,
+	},
+	{
+		name:     "content-length with inner whitespace",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 1 2\r\n\r\nhello world!",
+		lenient:  ErrInvalidContentLength,
+		hardened: ErrInvalidContentLength,
+	},
+	{
+		name:     "empty content-length",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nContent-Length:\r\n\r\n",
+		lenient:  ErrInvalidContentLength,
+		hardened: ErrInvalidContentLength,
+	},
+	{
+		name:     "overflowing content-length",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 99999999999999999999\r\n\r\n",
+		lenient:  ErrInvalidContentLength,
+		hardened: ErrInvalidContentLength,
+	},
+	{
+		name:     "space before colon",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nContent-Length : 5\r\n\r\nhello",
+		lenient:  headers.ErrInvalidFieldName,
+		hardened: headers.ErrInvalidFieldName,
+	},
+	{
+		name:     "tab before colon",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding\t: chunked\r\n\r\n0\r\n\r\n",
+		lenient:  headers.ErrInvalidFieldName,
+		hardened: headers.ErrInvalidFieldName,
+	},
+	{
+		name:     "vertical tab in field name",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nContent-Length\v: 5\r\n\r\nhello",
+		lenient:  headers.ErrInvalidFieldName,
+		hardened: headers.ErrInvalidFieldName,
+	},
+	{
+		name:     "bare CR in field value",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nX-Test: a\rContent-Length: 5\r\n\r\nhello",
+		lenient:  headers.ErrInvalidFieldValue,
+		hardened: headers.ErrInvalidFieldValue,
+	},
+	{
+		name:     "bare LF between headers",
+		raw:      "POST / HTTP/1.1\r\nHost: a\nContent-Length: 5\r\n\r\nhello",
+		lenient:  headers.ErrBareLF,
+		hardened: headers.ErrBareLF,
+	},
+	{
+		name:     "folded transfer-encoding",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding:\r\n chunked\r\n\r\n0\r\n\r\n",
+		lenient:  headers.ErrObsFold,
+		hardened: headers.ErrObsFold,
+	},
+	{
+		name:     "whitespace before first header",
+		raw:      "POST / HTTP/1.1\r\n Content-Length: 5\r\nHost: a\r\n\r\nhello",
+		lenient:  headers.ErrInvalidFieldName,
+		hardened: headers.ErrInvalidFieldName,
+	},
+	{
+		name:     "tab before first header",
+		raw:      "POST / HTTP/1.1\r\n\tHost: a\r\nContent-Length: 5\r\n\r\nhello",
+		lenient:  headers.ErrInvalidFieldName,
+		hardened: headers.ErrInvalidFieldName,
+	},
+	{
+		name:     "double space in request line",
+		raw:      "POST  / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello",
+		hardened: ErrInvalidRequestLine,
+		body:     "hello",
+	},
+	{
+		name:     "tab in request line",
+		raw:      "POST\t/ HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello",
+		hardened: ErrInvalidRequestLine,
+		body:     "hello",
+	},
+	{
+		name: "chunked",
+		raw:  "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n",
+		body: "hello world",
+	},
+	{
+		name: "chunked with upper-case hex and extension",
+		raw:  "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: Chunked\r\n\r\nB;name=\"v\"\r\nhello world\r\n0\r\n\r\n",
+		body: "hello world",
+	},
+	{
+		name:     "content-length and transfer-encoding",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+		hardened: ErrAmbiguousFraming,
+		body:     "hello",
+	},
+	{
+		name:     "transfer-encoding and content-length",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nContent-Length: 30\r\n\r\n0\r\n\r\nGET /smuggled HTTP/1.1\r\n\r\n",
+		hardened: ErrAmbiguousFraming,
+		body:     "",
+	},
+	{
+		name:     "transfer-encoding in HTTP/1.0",
+		raw:      "POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+		hardened: ErrAmbiguousFraming,
+		body:     "hello",
+	},
+	{
+		name:     "chunked applied twice",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		lenient:  ErrInvalidTransferEncoding,
+		hardened: ErrInvalidTransferEncoding,
+	},
+	{
+		name:     "chunked not last",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nTransfer-Encoding: chunked, identity\r\n\r\nhello",
+		lenient:  ErrInvalidTransferEncoding,
+		hardened: ErrAmbiguousFraming,
+	},
+	{
+		name:     "unknown coding",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n",
+		lenient:  ErrUnsupportedTransferEncoding,
+		hardened: ErrUnsupportedTransferEncoding,
+	},
+	{
+		name:     "look-alike coding",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: xchunked\r\n\r\n0\r\n\r\n",
+		lenient:  ErrUnsupportedTransferEncoding,
+		hardened: ErrUnsupportedTransferEncoding,
+	},
+	{
+		name:     "empty transfer-encoding",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: \r\n\r\n",
+		lenient:  ErrInvalidTransferEncoding,
+		hardened: ErrInvalidTransferEncoding,
+	},
+	{
+		name:     "hex prefix in chunk size",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n0x5\r\nhello\r\n0\r\n\r\n",
+		lenient:  ErrInvalidChunk,
+		hardened: ErrInvalidChunk,
+	},
+	{
+		name:     "signed chunk size",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n+5\r\nhello\r\n0\r\n\r\n",
+		lenient:  ErrInvalidChunk,
+		hardened: ErrInvalidChunk,
+	},
+	{
+		name:     "overflowing chunk size",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n10000000000000005\r\nhello\r\n0\r\n\r\n",
+		lenient:  ErrInvalidChunk,
+		hardened: ErrInvalidChunk,
+	},
+	{
+		name:     "bare LF after chunk size",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\nhello\r\n0\r\n\r\n",
+		lenient:  ErrInvalidChunk,
+		hardened: ErrInvalidChunk,
+	},
+	{
+		name:     "chunk longer than its size",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nhello\r\n0\r\n\r\n",
+		lenient:  ErrInvalidChunk,
+		hardened: ErrInvalidChunk,
+	},
+	{
+		name:     "bare LF after chunk data",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\n0\r\n\r\n",
+		lenient:  ErrInvalidChunk,
+		hardened: ErrInvalidChunk,
+	},
+	{
+		name:     "control character in chunk extension",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5;a\x00\r\nhello\r\n0\r\n\r\n",
+		lenient:  ErrInvalidChunk,
+		hardened: ErrInvalidChunk,
+	},
+	{
+		name:     "malformed chunk extension",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5;=x y\r\nhello\r\n0\r\n\r\n",
+		hardened: ErrInvalidChunk,
+		body:     "hello",
+	},
+	{
+		name:     "whitespace after chunk size",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5 \r\nhello\r\n0\r\n\r\n",
+		hardened: ErrInvalidChunk,
+		body:     "hello",
+	},
+	{
+		name:     "bare LF in trailer",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nX-Trailer: a\n\r\n",
+		lenient:  ErrInvalidChunk,
+		hardened: ErrInvalidChunk,
+	},
+	{
+		name:     "whitespace before first trailer",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n X-Trailer: a\r\n\r\n",
+		lenient:  headers.ErrInvalidFieldName,
+		hardened: headers.ErrInvalidFieldName,
+	},
+	{
+		name:     "folded trailer",
+		raw:      "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nX-Trailer: a\r\n b\r\n\r\n",
+		lenient:  headers.ErrObsFold,
+		hardened: headers.ErrObsFold,
+	},
+}
+
+func TestSmuggling(t *testing.T) {
+	for _, tc := range smugglingCases {
+		for _, mode := range []struct {
+			name string
+			opts []Option
+			err  error
+		}{
+			{"lenient", nil, tc.lenient},
+			{"hardened", []Option{WithHardenedParsing()}, tc.hardened},
+		} {
+			t.Run(tc.name+"/"+mode.name, func(t *testing.T) {
+				for _, numBytesPerRead := range []int{1, 7, len(tc.raw)} {
+					r, err := RequestFromReader(&chunkReader{data: tc.raw, numBytesPerRead: numBytesPerRead}, mode.opts...)
+					if mode.err != nil {
+						require.ErrorIs(t, err, mode.err)
+						continue
+					}
+					require.NoError(t, err)
+					assert.Equal(t, tc.body, string(r.Body))
+				}
+			})
+		}
+	}
+}
+
+func TestSmugglingConnectionReuse(t *testing.T) {
+	// Test: Transfer-Encoding overriding Content-Length closes the connection
+	r, err := RequestFromReader(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+	_, present := r.Headers.Get(headers.ContentLengthHeader)
+	assert.False(t, present)
+
+	// Test: Plain chunked request keeps the connection and exposes trailers
+	r, err = RequestFromReader(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nhi\r\n0\r\nX-Checksum: abc\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+	assert.Equal(t, "hi", string(r.Body))
+	assert.Equal(t, []string{"abc"}, r.Trailers["x-checksum"])
+}
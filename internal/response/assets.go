@@ -0,0 +1,182 @@
+package response
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/alexmarian/httpfromtcp/internal/headers"
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"io"
+	"io/fs"
+	"mime"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WriteFS writes the file name from fsys as a complete response, with the
+// content type derived from its extension.
+func (w *Writer) WriteFS(fsys fs.FS, name string, code StatusCode) (int, *HandlerError) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return 0, &HandlerError{
+			StatusCode: INTERNAL_SERVER_ERROR,
+			Message:    fmt.Sprintf("Failed to open %s", name),
+		}
+	}
+	defer f.Close()
+	return w.writeFile(name, f, ContentTypeByName(name), code, nil)
+}
+
+// ContentTypeByName returns the media type registered for the extension of
+// name, or application/octet-stream.
+func ContentTypeByName(name string) string {
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// Asset describes a file served by Assets.
+type Asset struct {
+	Name        string
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+	// ETag is a strong validator derived from the file contents.
+	ETag string
+}
+
+// Assets serves files from an fs.FS, which may be an embed.FS or a directory
+// opened with os.DirFS. ETags and content types are computed once per file and
+// cached; a cached entry is recomputed when the file size or modification time
+// changes, so directories can be edited while the server runs.
+type Assets struct {
+	fsys fs.FS
+
+	mu    sync.Mutex
+	files map[string]*Asset
+}
+
+func NewAssets(fsys fs.FS) *Assets {
+	return &Assets{
+		fsys:  fsys,
+		files: make(map[string]*Asset),
+	}
+}
+
+// Precompute computes the metadata of every file up front, which suits
+// embedded files that never change.
+func (a *Assets) Precompute() error {
+	return fs.WalkDir(a.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		_, err = a.Stat(name)
+		return err
+	})
+}
+
+// Stat returns the metadata of the regular file name.
+func (a *Assets) Stat(name string) (*Asset, error) {
+	f, err := a.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	asset, _, err := a.stat(name, f)
+	return asset, err
+}
+
+// stat returns the metadata of the open file f, hashing its contents when the
+// cached entry is missing or stale. hashed reports whether f was read.
+func (a *Assets) stat(name string, f fs.File) (asset *Asset, hashed bool, err error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, false, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	a.mu.Lock()
+	asset, ok := a.files[name]
+	a.mu.Unlock()
+	if ok && asset.Size == info.Size() && asset.ModTime.Equal(info.ModTime()) {
+		return asset, false, nil
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return nil, true, err
+	}
+	asset = &Asset{
+		Name:        name,
+		Size:        info.Size(),
+		ModTime:     info.ModTime(),
+		ContentType: ContentTypeByName(name),
+		ETag:        fmt.Sprintf(`"%x"`, hash.Sum(nil)[:16]),
+	}
+	a.mu.Lock()
+	a.files[name] = asset
+	a.mu.Unlock()
+	return asset, true, nil
+}
+
+// Write serves the file name, given as a slash-separated path relative to the
+// root of the file system. It answers 304 when the request's If-None-Match
+// matches the file's ETag and returns a 404 HandlerError for missing files.
+// The ETag and the body come from the same open file, which must be seekable
+// when its ETag is not cached yet.
+func (a *Assets) Write(w *Writer, req *request.Request, name string) *HandlerError {
+	name = strings.TrimPrefix(name, "/")
+	if name == "" || !fs.ValidPath(name) {
+		return &HandlerError{StatusCode: NOT_FOUND, Message: "Not found"}
+	}
+	f, err := a.fsys.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &HandlerError{StatusCode: NOT_FOUND, Message: "Not found"}
+	}
+	if err != nil {
+		return &HandlerError{StatusCode: INTERNAL_SERVER_ERROR, Message: fmt.Sprintf("Failed to open %s", name)}
+	}
+	defer f.Close()
+	asset, hashed, err := a.stat(name, f)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &HandlerError{StatusCode: NOT_FOUND, Message: "Not found"}
+	}
+	if err != nil {
+		return &HandlerError{StatusCode: INTERNAL_SERVER_ERROR, Message: fmt.Sprintf("Failed to read %s", name)}
+	}
+	h := headers.NewHeaders()
+	h.Set(headers.ETagHeader, asset.ETag)
+	if req != nil {
+		if inm, ok := req.Headers.Get(headers.IfNoneMatchHeader); ok && etagMatches(inm, asset.ETag) {
+			w.WriteStatusLine(NOT_MODIFIED)
+			w.WriteHeaders(h)
+			return nil
+		}
+	}
+	if hashed {
+		seeker, ok := f.(io.Seeker)
+		if !ok {
+			return &HandlerError{StatusCode: INTERNAL_SERVER_ERROR, Message: fmt.Sprintf("Failed to read %s", name)}
+		}
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return &HandlerError{StatusCode: INTERNAL_SERVER_ERROR, Message: fmt.Sprintf("Failed to read %s", name)}
+		}
+	}
+	_, hErr := w.writeFile(name, f, asset.ContentType, SUCCESS, h)
+	return hErr
+}
+
+// etagMatches applies the weak comparison If-None-Match calls for.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package response
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func assetRequest(t *testing.T, extra string) *request.Request {
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\n" + extra + "\r\n"))
+	require.NoError(t, err)
+	return req
+}
+
+func TestAssets(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.html":    {Data: []byte("<h1>hi</h1>")},
+		"css/site.css":  {Data: []byte("body{}")},
+		"data.unknownx": {Data: []byte{0, 1}},
+	}
+	a := NewAssets(fsys)
+	require.NoError(t, a.Precompute())
+
+	// Test: Precomputed metadata
+	asset, err := a.Stat("css/site.css")
+	require.NoError(t, err)
+	assert.Equal(t, "text/css; charset=utf-8", asset.ContentType)
+	assert.Equal(t, int64(6), asset.Size)
+	assert.Regexp(t, `^"[0-9a-f]{32}"$`, asset.ETag)
+	asset, err = a.Stat("data.unknownx")
+	require.NoError(t, err)
+	assert.Equal(t, "application/octet-stream", asset.ContentType)
+
+	// Test: Full response with ETag
+	index, err := a.Stat("index.html")
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	require.Nil(t, a.Write(NewWriter(buf), assetRequest(t, ""), "/index.html"))
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "content-type: text/html; charset=utf-8\r\n")
+	assert.Contains(t, out, "content-length: 11\r\n")
+	assert.Contains(t, out, "etag: "+index.ETag+"\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n<h1>hi</h1>"))
+
+	// Test: Conditional request
+	buf = &bytes.Buffer{}
+	require.Nil(t, a.Write(NewWriter(buf), assetRequest(t, "If-None-Match: \"other\", W/"+index.ETag+"\r\n"), "index.html"))
+	out = buf.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 304 Not Modified\r\n"))
+	assert.Contains(t, out, "etag: "+index.ETag+"\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"))
+	buf = &bytes.Buffer{}
+	require.Nil(t, a.Write(NewWriter(buf), assetRequest(t, "If-None-Match: \"other\"\r\n"), "index.html"))
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 200 OK\r\n"))
+
+	// Test: Missing files, directories and escapes
+	for _, name := range []string{"missing.html", "css", "../secret", "/"} {
+		hErr := a.Write(NewWriter(&bytes.Buffer{}), assetRequest(t, ""), name)
+		require.NotNil(t, hErr, name)
+		assert.Equal(t, NOT_FOUND, hErr.StatusCode, name)
+	}
+}
+
+func TestAssetsDirectory(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "page.html")
+	require.NoError(t, os.WriteFile(file, []byte("v1"), 0o600))
+	a := NewAssets(os.DirFS(dir))
+
+	// Test: Edits to a directory are picked up
+	first, err := a.Stat("page.html")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(file, []byte("v2"), 0o600))
+	require.NoError(t, os.Chtimes(file, time.Now(), time.Now().Add(time.Second)))
+	second, err := a.Stat("page.html")
+	require.NoError(t, err)
+	assert.NotEqual(t, first.ETag, second.ETag)
+
+	// Test: An edited file is hashed and served from the same open file
+	require.NoError(t, os.WriteFile(file, []byte("v3!"), 0o600))
+	require.NoError(t, os.Chtimes(file, time.Now(), time.Now().Add(2*time.Second)))
+	buf := &bytes.Buffer{}
+	require.Nil(t, a.Write(NewWriter(buf), assetRequest(t, ""), "page.html"))
+	third, err := a.Stat("page.html")
+	require.NoError(t, err)
+	assert.NotEqual(t, second.ETag, third.ETag)
+	assert.Contains(t, buf.String(), "etag: "+third.ETag+"\r\n")
+	assert.Contains(t, buf.String(), "content-length: 3\r\n")
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nv3!"))
+
+	// Test: WriteFS serves the same file system directly
+	buf = &bytes.Buffer{}
+	n, hErr := NewWriter(buf).WriteFS(os.DirFS(dir), "page.html", SUCCESS)
+	require.Nil(t, hErr)
+	assert.Equal(t, 3, n)
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nv3!"))
+}
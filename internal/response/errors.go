@@ -0,0 +1,139 @@
+package response
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"github.com/alexmarian/httpfromtcp/internal/headers"
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"html/template"
+	"sync"
+)
+
+//go:embed errorpages/*.html
+var errorPages embed.FS
+
+// ErrorRenderer writes the response for a HandlerError. req is nil when the
+// request could not be parsed.
+type ErrorRenderer interface {
+	RenderError(w *Writer, req *request.Request, hErr *HandlerError) error
+}
+
+// ErrorPage is the data passed to HTML error templates.
+type ErrorPage struct {
+	Status    int
+	Reason    string
+	Message   string
+	RequestID string
+}
+
+func newErrorPage(req *request.Request, hErr *HandlerError) ErrorPage {
+	page := ErrorPage{
+		Status:  int(hErr.StatusCode),
+		Reason:  ReasonPhrase(hErr.StatusCode),
+		Message: hErr.Message,
+	}
+	if req != nil {
+		page.RequestID = req.ID
+	}
+	return page
+}
+
+// HTMLErrorRenderer renders the template named after the status code, such as
+// "404.html", falling back to "error.html".
+type HTMLErrorRenderer struct {
+	templates *template.Template
+}
+
+// NewHTMLErrorRenderer uses templates, or the pages embedded in this package
+// when templates is nil.
+func NewHTMLErrorRenderer(templates *template.Template) *HTMLErrorRenderer {
+	if templates == nil {
+		templates = template.Must(template.ParseFS(errorPages, "errorpages/*.html"))
+	}
+	return &HTMLErrorRenderer{templates: templates}
+}
+
+func (r *HTMLErrorRenderer) RenderError(w *Writer, req *request.Request, hErr *HandlerError) error {
+	page := newErrorPage(req, hErr)
+	tmpl := r.templates.Lookup(fmt.Sprintf("%d.html", page.Status))
+	if tmpl == nil {
+		tmpl = r.templates.Lookup("error.html")
+	}
+	if tmpl == nil {
+		return TextErrorRenderer{}.RenderError(w, req, hErr)
+	}
+	body := bytes.Buffer{}
+	if err := tmpl.Execute(&body, page); err != nil {
+		return err
+	}
+	return w.WriteContent(hErr.StatusCode, "text/html; charset=utf-8", body.Bytes())
+}
+
+// JSONErrorRenderer writes the error as RFC 9457 problem details, carrying the
+// request ID as the "request_id" extension member.
+type JSONErrorRenderer struct{}
+
+func (JSONErrorRenderer) RenderError(w *Writer, req *request.Request, hErr *HandlerError) error {
+	p := NewProblem(hErr.StatusCode, hErr.Message)
+	if req != nil && req.ID != "" {
+		p.Extensions = map[string]any{"request_id": req.ID}
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return w.WriteContent(hErr.StatusCode, ProblemContentType, body)
+}
+
+// TextErrorRenderer writes the status, message and request ID as plain text.
+type TextErrorRenderer struct{}
+
+func (TextErrorRenderer) RenderError(w *Writer, req *request.Request, hErr *HandlerError) error {
+	page := newErrorPage(req, hErr)
+	body := fmt.Sprintf("%d %s", page.Status, page.Reason)
+	if page.Message != "" {
+		body += ": " + page.Message
+	}
+	body += "\n"
+	if page.RequestID != "" {
+		body += "Request ID: " + page.RequestID + "\n"
+	}
+	return w.WriteContent(hErr.StatusCode, TextContentType, []byte(body))
+}
+
+// NegotiatingErrorRenderer picks the HTML, JSON or text renderer the request's
+// Accept header prefers, using HTML when there is no preference.
+type NegotiatingErrorRenderer struct {
+	HTML ErrorRenderer
+	JSON ErrorRenderer
+	Text ErrorRenderer
+}
+
+// DefaultErrorRenderer negotiates between the embedded HTML pages, problem
+// details and plain text.
+func DefaultErrorRenderer() *NegotiatingErrorRenderer {
+	return &NegotiatingErrorRenderer{
+		HTML: NewHTMLErrorRenderer(nil),
+		JSON: JSONErrorRenderer{},
+		Text: TextErrorRenderer{},
+	}
+}
+
+var defaultErrorRenderer = sync.OnceValue(DefaultErrorRenderer)
+
+func (r *NegotiatingErrorRenderer) RenderError(w *Writer, req *request.Request, hErr *HandlerError) error {
+	accept := ""
+	if req != nil {
+		accept, _ = req.Headers.Get(headers.AcceptHeader)
+	}
+	switch headers.Negotiate(accept, "text/html", ProblemContentType, JSONContentType, TextContentType) {
+	case ProblemContentType, JSONContentType:
+		return r.JSON.RenderError(w, req, hErr)
+	case TextContentType:
+		return r.Text.RenderError(w, req, hErr)
+	default:
+		return r.HTML.RenderError(w, req, hErr)
+	}
+}
@@ -0,0 +1,73 @@
+package response
+
+import (
+	"bytes"
+	"html/template"
+	"strings"
+	"testing"
+
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func errorRequest(t *testing.T, accept string) *request.Request {
+	raw := "GET / HTTP/1.1\r\nHost: localhost\r\n"
+	if accept != "" {
+		raw += "Accept: " + accept + "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+	req.ID = "abc123"
+	return req
+}
+
+func render(t *testing.T, r ErrorRenderer, req *request.Request, hErr *HandlerError) string {
+	buf := &bytes.Buffer{}
+	require.NoError(t, r.RenderError(NewWriter(buf), req, hErr))
+	return buf.String()
+}
+
+func TestErrorRenderers(t *testing.T) {
+	r := DefaultErrorRenderer()
+	notFound := &HandlerError{StatusCode: NOT_FOUND, Message: "No <such> page"}
+
+	// Test: HTML by default, with escaped message and request ID
+	out := render(t, r, errorRequest(t, ""), notFound)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+	assert.Contains(t, out, "content-type: text/html; charset=utf-8\r\n")
+	assert.Contains(t, out, "<title>404 Not Found</title>")
+	assert.Contains(t, out, "<p>No &lt;such&gt; page</p>")
+	assert.Contains(t, out, "Request ID: abc123")
+
+	// Test: Status specific embedded page keeps the message
+	out = render(t, r, errorRequest(t, "text/html"), &HandlerError{StatusCode: BAD_REQUEST, Message: "Missing name"})
+	assert.Contains(t, out, "Your request honestly kinda sucked.")
+	assert.Contains(t, out, "<p>Missing name</p>")
+
+	// Test: Problem details when JSON is preferred
+	out = render(t, r, errorRequest(t, "application/json"), notFound)
+	assert.Contains(t, out, "content-type: application/problem+json\r\n")
+	assert.True(t, strings.HasSuffix(out,
+		`{"detail":"No \u003csuch\u003e page","request_id":"abc123","status":404,"title":"Not Found"}`))
+
+	// Test: Plain text when preferred
+	out = render(t, r, errorRequest(t, "text/plain, text/html;q=0.1"), notFound)
+	assert.Contains(t, out, "content-type: text/plain\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n404 Not Found: No <such> page\nRequest ID: abc123\n"))
+
+	// Test: No request to negotiate against
+	out = render(t, r, nil, &HandlerError{StatusCode: INTERNAL_SERVER_ERROR})
+	assert.Contains(t, out, "This one is on me.")
+	assert.NotContains(t, out, "Request ID")
+
+	// Test: Custom templates
+	custom := template.Must(template.New("error.html").Parse("<b>{{.Status}}: {{.Message}}</b>"))
+	out = render(t, NewHTMLErrorRenderer(custom), nil, notFound)
+	assert.True(t, strings.HasSuffix(out, "<b>404: No &lt;such&gt; page</b>"))
+
+	// Test: HandlerError.Write works without a working directory
+	buf := &bytes.Buffer{}
+	HandlerError{StatusCode: BAD_REQUEST, Message: "Bad"}.Write(NewWriter(buf))
+	assert.Contains(t, buf.String(), "<p>Bad</p>")
+}
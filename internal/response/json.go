@@ -0,0 +1,112 @@
+package response
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/alexmarian/httpfromtcp/internal/headers"
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"strings"
+)
+
+const (
+	JSONContentType    = "application/json"
+	ProblemContentType = "application/problem+json"
+	TextContentType    = "text/plain"
+)
+
+// WriteJSON writes a complete response with v encoded as the JSON body.
+func (w *Writer) WriteJSON(statusCode StatusCode, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return w.WriteContent(statusCode, JSONContentType, body)
+}
+
+// Problem is an RFC 9457 problem details object. Extensions are serialized as
+// additional members next to the standard ones.
+type Problem struct {
+	Type       string
+	Title      string
+	Status     StatusCode
+	Detail     string
+	Instance   string
+	Extensions map[string]any
+}
+
+// NewProblem returns a problem for statusCode titled with its reason phrase.
+func NewProblem(statusCode StatusCode, detail string) *Problem {
+	return &Problem{
+		Title:  ReasonPhrase(statusCode),
+		Status: statusCode,
+		Detail: detail,
+	}
+}
+
+// DecodeProblem maps an error from Request.DecodeJSON to the problem a client
+// should see: 415 for a wrong content type, 413 for an oversized body and 400
+// for anything else.
+func DecodeProblem(err error) *Problem {
+	switch {
+	case errors.Is(err, request.ErrNotJSON):
+		return NewProblem(UNSUPPORTED_MEDIA_TYPE, "Expected a JSON body")
+	case errors.Is(err, request.ErrBodyTooLarge):
+		return NewProblem(CONTENT_TOO_LARGE, err.Error())
+	default:
+		return NewProblem(BAD_REQUEST, err.Error())
+	}
+}
+
+func (p *Problem) MarshalJSON() ([]byte, error) {
+	members := make(map[string]any, len(p.Extensions)+5)
+	for name, value := range p.Extensions {
+		members[name] = value
+	}
+	// "about:blank" is the default type and is left implicit.
+	if p.Type != "" {
+		members["type"] = p.Type
+	}
+	if p.Title != "" {
+		members["title"] = p.Title
+	}
+	if p.Status != 0 {
+		members["status"] = int(p.Status)
+	}
+	if p.Detail != "" {
+		members["detail"] = p.Detail
+	}
+	if p.Instance != "" {
+		members["instance"] = p.Instance
+	}
+	return json.Marshal(members)
+}
+
+func (p *Problem) String() string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "%d %s", p.Status, p.Title)
+	if p.Detail != "" {
+		b.WriteString(": " + p.Detail)
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// WriteProblem writes p as application/problem+json, or as plain text when the
+// Accept value prefers it over JSON.
+func (w *Writer) WriteProblem(p *Problem, accept string) error {
+	status := p.Status
+	if status == 0 {
+		status = INTERNAL_SERVER_ERROR
+	}
+	switch headers.Negotiate(accept, ProblemContentType, JSONContentType, TextContentType) {
+	case TextContentType:
+		return w.WriteContent(status, TextContentType, []byte(p.String()))
+	default:
+		body, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		return w.WriteContent(status, ProblemContentType, body)
+	}
+}
@@ -0,0 +1,74 @@
+package response
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteJSON(t *testing.T) {
+	// Test: Body, content type and length
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.WriteJSON(SUCCESS, map[string]int{"count": 3}))
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "content-type: application/json\r\n")
+	assert.Contains(t, out, "content-length: 11\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n{\"count\":3}"))
+
+	// Test: Values that cannot be encoded leave the response unstarted
+	w = NewWriter(&bytes.Buffer{})
+	require.Error(t, w.WriteJSON(SUCCESS, make(chan int)))
+	assert.False(t, w.Started())
+}
+
+func TestWriteProblem(t *testing.T) {
+	p := NewProblem(NOT_FOUND, "No such order")
+	p.Instance = "/orders/42"
+	p.Extensions = map[string]any{"order": 42}
+
+	// Test: JSON by default
+	buf := &bytes.Buffer{}
+	require.NoError(t, NewWriter(buf).WriteProblem(p, ""))
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+	assert.Contains(t, out, "content-type: application/problem+json\r\n")
+	assert.True(t, strings.HasSuffix(out,
+		`{"detail":"No such order","instance":"/orders/42","order":42,"status":404,"title":"Not Found"}`))
+
+	// Test: Text when preferred
+	buf = &bytes.Buffer{}
+	require.NoError(t, NewWriter(buf).WriteProblem(p, "text/plain, application/json;q=0.5"))
+	out = buf.String()
+	assert.Contains(t, out, "content-type: text/plain\r\n")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n404 Not Found: No such order\n"))
+
+	// Test: JSON when nothing offered is acceptable
+	buf = &bytes.Buffer{}
+	require.NoError(t, NewWriter(buf).WriteProblem(p, "image/png"))
+	assert.Contains(t, buf.String(), "content-type: application/problem+json\r\n")
+}
+
+func TestDecodeProblem(t *testing.T) {
+	decode := func(contentType, body string) error {
+		raw := fmt.Sprintf("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n%s",
+			contentType, len(body), body)
+		req, err := request.RequestFromReader(strings.NewReader(raw))
+		require.NoError(t, err)
+		var v struct{ Name string }
+		return req.DecodeJSON(&v, request.WithJSONLimit(32))
+	}
+
+	// Test: Status per decode failure
+	assert.Equal(t, UNSUPPORTED_MEDIA_TYPE, DecodeProblem(decode("text/plain", "{}")).Status)
+	assert.Equal(t, CONTENT_TOO_LARGE, DecodeProblem(decode("application/json", strings.Repeat(" ", 40)+"{}")).Status)
+	p := DecodeProblem(decode("application/json", `{"nam":"x"}`))
+	assert.Equal(t, BAD_REQUEST, p.Status)
+	assert.Contains(t, p.Detail, "unknown field")
+}
@@ -1,10 +1,15 @@
 package response
 
 import (
+	"errors"
 	"fmt"
 	"github.com/alexmarian/httpfromtcp/internal/headers"
 	"io"
+	"io/fs"
+	"net"
 	"os"
+	"strconv"
+	"strings"
 )
 
 const fileBufferSize = 4096
@@ -12,11 +17,63 @@ const fileBufferSize = 4096
 type StatusCode int
 
 const (
-	SUCCESS               StatusCode = 200
-	BAD_REQUEST           StatusCode = 400
-	INTERNAL_SERVER_ERROR StatusCode = 500
+	CONTINUE                   StatusCode = 100
+	SWITCHING_PROTOCOLS        StatusCode = 101
+	PROCESSING                 StatusCode = 102
+	EARLY_HINTS                StatusCode = 103
+	SUCCESS                    StatusCode = 200
+	NO_CONTENT                 StatusCode = 204
+	NOT_MODIFIED               StatusCode = 304
+	BAD_REQUEST                StatusCode = 400
+	FORBIDDEN                  StatusCode = 403
+	NOT_FOUND                  StatusCode = 404
+	METHOD_NOT_ALLOWED         StatusCode = 405
+	CONTENT_TOO_LARGE          StatusCode = 413
+	UNSUPPORTED_MEDIA_TYPE     StatusCode = 415
+	EXPECTATION_FAILED         StatusCode = 417
+	MISDIRECTED_REQUEST        StatusCode = 421
+	UPGRADE_REQUIRED           StatusCode = 426
+	HEADER_FIELDS_TOO_LARGE    StatusCode = 431
+	INTERNAL_SERVER_ERROR      StatusCode = 500
+	NOT_IMPLEMENTED            StatusCode = 501
+	BAD_GATEWAY                StatusCode = 502
+	SERVICE_UNAVAILABLE        StatusCode = 503
+	GATEWAY_TIMEOUT            StatusCode = 504
+	HTTP_VERSION_NOT_SUPPORTED StatusCode = 505
 )
 
+var reasonPhrases = map[StatusCode]string{
+	CONTINUE:                   "Continue",
+	SWITCHING_PROTOCOLS:        "Switching Protocols",
+	PROCESSING:                 "Processing",
+	EARLY_HINTS:                "Early Hints",
+	SUCCESS:                    "OK",
+	NO_CONTENT:                 "No Content",
+	NOT_MODIFIED:               "Not Modified",
+	BAD_REQUEST:                "Bad Request",
+	FORBIDDEN:                  "Forbidden",
+	NOT_FOUND:                  "Not Found",
+	METHOD_NOT_ALLOWED:         "Method Not Allowed",
+	CONTENT_TOO_LARGE:          "Content Too Large",
+	UNSUPPORTED_MEDIA_TYPE:     "Unsupported Media Type",
+	EXPECTATION_FAILED:         "Expectation Failed",
+	MISDIRECTED_REQUEST:        "Misdirected Request",
+	UPGRADE_REQUIRED:           "Upgrade Required",
+	HEADER_FIELDS_TOO_LARGE:    "Request Header Fields Too Large",
+	INTERNAL_SERVER_ERROR:      "Internal Server Error",
+	NOT_IMPLEMENTED:            "Not Implemented",
+	BAD_GATEWAY:                "Bad Gateway",
+	SERVICE_UNAVAILABLE:        "Service Unavailable",
+	GATEWAY_TIMEOUT:            "Gateway Timeout",
+	HTTP_VERSION_NOT_SUPPORTED: "HTTP Version Not Supported",
+}
+
+// ReasonPhrase returns the standard reason phrase for code, or an empty string
+// when the code has none registered.
+func ReasonPhrase(code StatusCode) string {
+	return reasonPhrases[code]
+}
+
 type HandlerError struct {
 	StatusCode StatusCode
 	Message    string
@@ -33,65 +90,303 @@ const (
 
 type Writer struct {
 	io.Writer
-	writerState writerState
+	writerState   writerState
+	statusCode    StatusCode
+	omitBody      bool
+	version       string
+	keepAlive     bool
+	chunked       bool
+	unframed      bool
+	contentLength int
+	bodyWritten   int
+	beforeHeaders []func(headers.Headers)
+	hijacker      Hijacker
+	hijacked      bool
+	framer        Framer
 }
 
-func (he HandlerError) Write(w *Writer) {
-	switch he.StatusCode {
-	case BAD_REQUEST:
-		w.WriteFile("html/bad_request.html", "text/html", BAD_REQUEST)
-	case INTERNAL_SERVER_ERROR:
-		w.WriteFile("html/internal_server_error.html", "text/html", INTERNAL_SERVER_ERROR)
+// Framer puts a response on the wire in a protocol's own framing. Writers
+// created with NewWriter write HTTP/1.x text; NewFramedWriter hands every part
+// of the response to a Framer instead, such as an HTTP/2 stream.
+type Framer interface {
+	// WriteHeader sends a status code with its header fields. Interim 1xx
+	// responses may precede the final one.
+	WriteHeader(statusCode StatusCode, h headers.Headers) error
+	// WriteData sends body bytes.
+	WriteData(p []byte) error
+	// Close ends the response, sending trailers if h is not empty.
+	Close(trailers headers.Headers) error
+}
+
+// connectionHeaders only make sense on an HTTP/1.x connection and are dropped
+// from framed responses.
+var connectionHeaders = []string{headers.ConnectionHeader, "Keep-Alive", "Proxy-Connection", headers.TransferEncodingHeader, "Upgrade"}
+
+type framerBody struct {
+	framer Framer
+}
+
+func (b framerBody) Write(p []byte) (int, error) {
+	if err := b.framer.WriteData(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Hijacker hands the connection behind a Writer over to its caller, together
+// with bytes already read from it that the caller must consume first.
+type Hijacker func() (net.Conn, []byte, error)
+
+var (
+	ErrNotHijackable = errors.New("connection cannot be hijacked")
+	ErrHijacked      = errors.New("connection has been hijacked")
+)
+
+// SetHijacker makes Hijack available. The server sets it for every request.
+func (w *Writer) SetHijacker(h Hijacker) {
+	w.hijacker = h
+}
+
+// Hijack takes over the connection. Whatever the writer wrote so far has been
+// sent; afterwards the writer fails every write and the server neither reads
+// from, writes to nor closes the connection, which becomes the caller's to
+// close.
+func (w *Writer) Hijack() (net.Conn, []byte, error) {
+	if w.hijacked {
+		return nil, nil, ErrHijacked
+	}
+	if w.hijacker == nil {
+		return nil, nil, ErrNotHijackable
+	}
+	conn, buffered, err := w.hijacker()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	w.Writer = hijackedWriter{}
+	return conn, buffered, nil
+}
+
+// Hijacked reports whether Hijack succeeded.
+func (w *Writer) Hijacked() bool {
+	return w.hijacked
+}
+
+type hijackedWriter struct{}
+
+func (hijackedWriter) Write([]byte) (int, error) {
+	return 0, ErrHijacked
+}
+
+// BeforeHeaders registers f to run just before the response headers are
+// written, letting middleware add fields such as Set-Cookie after the handler
+// has chosen the rest of them.
+func (w *Writer) BeforeHeaders(f func(headers.Headers)) {
+	w.beforeHeaders = append(w.beforeHeaders, f)
+}
+
+// SetHTTPVersion sets the "major.minor" version written in status lines. For
+// "1.0" chunked bodies are written unframed and delimited by closing the
+// connection, and interim 1xx responses are skipped.
+func (w *Writer) SetHTTPVersion(version string) {
+	w.version = version
+}
+
+// SetKeepAlive records whether the client asked for a persistent connection.
+// Unless the handler sets "Connection: close" or the body can only be delimited
+// by closing, the response advertises the connection as kept alive.
+func (w *Writer) SetKeepAlive(keepAlive bool) {
+	w.keepAlive = keepAlive
+}
+
+// KeepAlive reports whether the connection can serve another request after
+// this response, which requires a complete, properly framed response.
+func (w *Writer) KeepAlive() bool {
+	if !w.keepAlive {
+		return false
+	}
+	switch w.writerState {
+	case writerStateHeadersWrote:
+		return !w.bodyAllowed() || w.contentLength == 0
+	case writerStateBodyDone:
+		return !w.chunked && (!w.bodyAllowed() || w.bodyWritten == w.contentLength)
+	case writerStateDone:
+		return true
 	default:
-		w.WriteStatusLine(he.StatusCode)
-		messageBytes := []byte(he.Message)
-		headers := GetDefaultHeaders(len(messageBytes))
-		w.WriteHeaders(headers)
-		w.WriteBody(messageBytes)
+		return false
 	}
+}
 
+// Finish completes a chunked response the handler left open by writing the
+// last chunk and an empty trailer section. A framed response is ended once
+// its headers were written.
+func (w *Writer) Finish() error {
+	if w.framer != nil {
+		if w.writerState == writerStateInitialized || w.writerState == writerStateResponseLineWrote || w.writerState == writerStateDone {
+			return nil
+		}
+		w.writerState = writerStateDone
+		return w.framer.Close(nil)
+	}
+	if !w.chunked {
+		return nil
+	}
+	if w.writerState == writerStateHeadersWrote {
+		if _, err := w.WriteChunkedBodyDone(); err != nil {
+			return err
+		}
+	}
+	if w.writerState == writerStateBodyDone {
+		return w.WriteTrailers(nil)
+	}
+	return nil
+}
+
+// ErrBodyNotAllowed is returned when writing body bytes for a status code that
+// must not carry a body, such as 204 or 304.
+var ErrBodyNotAllowed = errors.New("response status does not allow a body")
+
+// OmitBody makes the writer drop every body byte while still writing the status
+// line and headers unchanged, which is what a HEAD response needs.
+func (w *Writer) OmitBody() {
+	w.omitBody = true
+}
+
+func (w *Writer) bodyAllowed() bool {
+	return !w.omitBody && !statusForbidsBody(w.statusCode)
+}
+
+func statusForbidsBody(statusCode StatusCode) bool {
+	return isInformational(statusCode) || statusCode == NO_CONTENT || statusCode == NOT_MODIFIED
+}
+
+func (w *Writer) writeBodyBytes(p []byte) error {
+	if len(p) == 0 || w.omitBody {
+		return nil
+	}
+	if statusForbidsBody(w.statusCode) {
+		return ErrBodyNotAllowed
+	}
+	n, err := w.Write(p)
+	w.bodyWritten += n
+	return err
+}
+
+// Started reports whether the final status line has already been written.
+func (w *Writer) Started() bool {
+	return w.writerState != writerStateInitialized
+}
+
+// Write renders he with the default error renderer, without a request to
+// negotiate against.
+func (he HandlerError) Write(w *Writer) {
+	defaultErrorRenderer().RenderError(w, nil, &he)
 }
 
 func NewWriter(w io.Writer) *Writer {
 	return &Writer{
-		Writer:      w,
-		writerState: writerStateInitialized,
+		Writer:        w,
+		writerState:   writerStateInitialized,
+		version:       "1.1",
+		contentLength: -1,
 	}
 }
 
+// NewFramedWriter creates a Writer that sends the response through f. It is
+// never hijackable and has no HTTP/1.x connection management.
+func NewFramedWriter(f Framer) *Writer {
+	w := NewWriter(framerBody{framer: f})
+	w.framer = f
+	return w
+}
+
+// Framed reports whether the Writer was created by NewFramedWriter.
+func (w *Writer) Framed() bool {
+	return w.framer != nil
+}
+
+// Framer returns the Framer of a framed Writer, or nil.
+func (w *Writer) Framer() Framer {
+	return w.framer
+}
+
+// SetFramer makes a framed Writer send the rest of the response through f,
+// which usually wraps Framer().
+func (w *Writer) SetFramer(f Framer) {
+	w.framer = f
+	w.Writer = framerBody{framer: f}
+}
+
+// Pusher is implemented by Framers that can send responses the client has not
+// asked for yet, such as HTTP/2 streams.
+type Pusher interface {
+	// Push promises a GET request for target with the header fields h and
+	// serves it as if the client had sent it.
+	Push(target string, h headers.Headers) error
+}
+
+var ErrPushNotSupported = errors.New("server push not supported")
+
+// Push starts sending the response to a GET for target before the client
+// asks for it, typically a resource the current response refers to. It fails
+// with ErrPushNotSupported unless the Writer's Framer is a Pusher and both
+// sides allow push, and must be called before the response ends.
+func (w *Writer) Push(target string, h headers.Headers) error {
+	pusher, ok := w.framer.(Pusher)
+	if !ok {
+		return ErrPushNotSupported
+	}
+	return pusher.Push(target, h)
+}
+
 func (w *Writer) WriteFile(file, contentType string, code StatusCode) (int, *HandlerError) {
-	fstream, err := os.OpenFile(file, os.O_RDONLY, 0)
+	fstream, err := os.Open(file)
 	if err != nil {
 		return 0, &HandlerError{
 			StatusCode: INTERNAL_SERVER_ERROR,
 			Message:    fmt.Sprintf("Failed to open %s", file),
 		}
 	}
-	stat, _ := fstream.Stat()
+	defer fstream.Close()
+	return w.writeFile(file, fstream, contentType, code, nil)
+}
+
+// writeFile writes f as a complete response, adding extra to the default
+// headers.
+func (w *Writer) writeFile(name string, f fs.File, contentType string, code StatusCode, extra headers.Headers) (int, *HandlerError) {
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, &HandlerError{
+			StatusCode: INTERNAL_SERVER_ERROR,
+			Message:    fmt.Sprintf("Failed to stat %s", name),
+		}
+	}
 	w.WriteStatusLine(code)
 	defaultHeaders := GetDefaultHeaders(int(stat.Size()))
 	defaultHeaders.Override(headers.ContentTypeHeader, contentType)
+	for key, lines := range extra {
+		defaultHeaders[key] = lines
+	}
 	w.WriteHeaders(defaultHeaders)
-	defer fstream.Close()
 
 	buffer := make([]byte, fileBufferSize)
 	total := 0
 	for {
-		n, err := fstream.Read(buffer)
+		n, err := f.Read(buffer)
 		if n > 0 {
 			total += n
-			_, err := w.Write(buffer[:n])
+			err := w.writeBodyBytes(buffer[:n])
 			if err != nil {
 				return 0, &HandlerError{
 					StatusCode: INTERNAL_SERVER_ERROR,
-					Message:    fmt.Sprintf("Failed to write %s", file),
+					Message:    fmt.Sprintf("Failed to write %s", name),
 				}
 			}
 		}
 		if err != nil && err != io.EOF {
 			return 0, &HandlerError{
 				StatusCode: INTERNAL_SERVER_ERROR,
-				Message:    fmt.Sprintf("Failed to write %s", file),
+				Message:    fmt.Sprintf("Failed to write %s", name),
 			}
 		}
 		if err == io.EOF {
@@ -99,86 +394,217 @@ func (w *Writer) WriteFile(file, contentType string, code StatusCode) (int, *Han
 		}
 	}
 
-	w.Write([]byte("\r\n"))
 	w.writerState = writerStateBodyDone
 	return total, nil
 }
-func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+
+// WriteInformational writes an interim 1xx response with its own headers. Any
+// number of them may precede the final status line.
+func (w *Writer) WriteInformational(statusCode StatusCode, h headers.Headers) error {
 	if w.writerState != writerStateInitialized {
 		return fmt.Errorf("wrong state: %d, expected: %d", w.writerState, writerStateInitialized)
 	}
-	switch statusCode {
-	case SUCCESS:
-		_, err := w.Write([]byte("HTTP/1.1 200 OK\r\n"))
-		if err != nil {
-			return err
-		}
-	case BAD_REQUEST:
-		_, err := w.Write([]byte("HTTP/1.1 400 Bad Request\r\n"))
-		if err != nil {
-			return err
-		}
-	case INTERNAL_SERVER_ERROR:
-		_, err := w.Write([]byte("HTTP/1.1 500 Internal Server Error\r\n"))
-		if err != nil {
-			return err
-		}
+	if !isInformational(statusCode) {
+		return fmt.Errorf("not an informational status code: %d", statusCode)
+	}
+	if statusCode == SWITCHING_PROTOCOLS {
+		return fmt.Errorf("status code %d ends the exchange, write it with WriteStatusLine", statusCode)
+	}
+	if w.framer != nil {
+		return w.framer.WriteHeader(statusCode, h)
+	}
+	if w.version == "1.0" {
+		// HTTP/1.0 clients do not expect interim responses
+		return nil
+	}
+	if err := w.writeStatusLine(statusCode); err != nil {
+		return err
+	}
+	return w.writeFieldLines(h)
+}
 
-	default:
-		return fmt.Errorf("unsupported status code: %d", statusCode)
+// WriteEarlyHints writes a 103 Early Hints response carrying one Link header
+// value per link, e.g. "</style.css>; rel=preload; as=style".
+func (w *Writer) WriteEarlyHints(links ...string) error {
+	h := headers.NewHeaders()
+	for _, link := range links {
+		h.Set(headers.LinkHeader, link)
+	}
+	return w.WriteInformational(EARLY_HINTS, h)
+}
+
+func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	if w.writerState != writerStateInitialized {
+		return fmt.Errorf("wrong state: %d, expected: %d", w.writerState, writerStateInitialized)
 	}
+	if isInformational(statusCode) && statusCode != SWITCHING_PROTOCOLS {
+		return fmt.Errorf("informational status code %d is not a final response, use WriteInformational", statusCode)
+	}
+	if err := w.writeStatusLine(statusCode); err != nil {
+		return err
+	}
+	w.statusCode = statusCode
 	w.writerState = writerStateResponseLineWrote
 	return nil
 }
-func (w *Writer) WriteHeaders(headers headers.Headers) error {
+
+func (w *Writer) writeStatusLine(statusCode StatusCode) error {
+	if statusCode < 100 || statusCode > 599 {
+		return fmt.Errorf("unsupported status code: %d", statusCode)
+	}
+	if w.framer != nil {
+		// sent together with the headers
+		return nil
+	}
+	_, err := w.Write([]byte(fmt.Sprintf("HTTP/%s %d %s\r\n", w.version, statusCode, ReasonPhrase(statusCode))))
+	return err
+}
+
+func isInformational(statusCode StatusCode) bool {
+	return statusCode >= 100 && statusCode < 200
+}
+
+func (w *Writer) WriteHeaders(h headers.Headers) error {
 	if w.writerState != writerStateResponseLineWrote {
-		return fmt.Errorf("wrong state: %d, expected: %d", w.writerState, writerStateHeadersWrote)
+		return fmt.Errorf("wrong state: %d, expected: %d", w.writerState, writerStateResponseLineWrote)
 	}
-	for name, value := range headers {
-		_, err := w.Write([]byte(fmt.Sprintf("%s: %s\r\n", name, value)))
-		if err != nil {
-			return err
+	for _, f := range w.beforeHeaders {
+		f(h)
+	}
+	if statusForbidsBody(w.statusCode) {
+		h.Remove(headers.TransferEncodingHeader)
+		if w.statusCode != NOT_MODIFIED {
+			h.Remove(headers.ContentLengthHeader)
 		}
 	}
-	_, err := w.Write([]byte("\r\n"))
-	if err != nil {
+	if w.framer != nil {
+		return w.writeFramedHeaders(h)
+	}
+	w.prepareFraming(h)
+	if err := w.writeFieldLines(h); err != nil {
+		return err
+	}
+	w.writerState = writerStateHeadersWrote
+	return nil
+}
+
+// writeFramedHeaders records the framing the handler asked for, which the
+// Framer replaces with its own, and sends the status and headers.
+func (w *Writer) writeFramedHeaders(h headers.Headers) error {
+	if w.statusCode == SWITCHING_PROTOCOLS {
+		return fmt.Errorf("status code %d cannot be sent on a framed response", w.statusCode)
+	}
+	if te, present := h.Get(headers.TransferEncodingHeader); present && strings.Contains(strings.ToLower(te), "chunked") {
+		w.chunked = true
+	}
+	if cl, present := h.Get(headers.ContentLengthHeader); present {
+		if n, err := strconv.Atoi(cl); err == nil {
+			w.contentLength = n
+		}
+	}
+	for _, name := range connectionHeaders {
+		h.Remove(name)
+	}
+	if err := w.framer.WriteHeader(w.statusCode, h); err != nil {
 		return err
 	}
 	w.writerState = writerStateHeadersWrote
 	return nil
 }
 
+// prepareFraming records how the body is delimited and sets the Connection
+// header to match the outcome of the persistence negotiation.
+func (w *Writer) prepareFraming(h headers.Headers) {
+	if te, present := h.Get(headers.TransferEncodingHeader); present && strings.Contains(strings.ToLower(te), "chunked") {
+		if w.version == "1.0" {
+			h.Remove(headers.TransferEncodingHeader)
+			h.Remove(headers.TrailerHeader)
+			w.unframed = true
+		} else {
+			w.chunked = true
+		}
+	}
+	if cl, present := h.Get(headers.ContentLengthHeader); present {
+		if n, err := strconv.Atoi(cl); err == nil {
+			w.contentLength = n
+		}
+	}
+	if connection, present := h.Get(headers.ConnectionHeader); present && strings.Contains(strings.ToLower(connection), "close") {
+		w.keepAlive = false
+	}
+	if w.bodyAllowed() && !w.chunked && w.contentLength < 0 {
+		w.keepAlive = false
+	}
+	switch {
+	case w.statusCode == SWITCHING_PROTOCOLS:
+		w.keepAlive = false
+	case !w.keepAlive:
+		h.Override(headers.ConnectionHeader, "close")
+	case w.version == "1.0":
+		h.Override(headers.ConnectionHeader, "keep-alive")
+	}
+}
+
 func (w *Writer) WriteTrailers(h headers.Headers) error {
 	if w.writerState != writerStateBodyDone {
 		return fmt.Errorf("wrong state: %d, expected: %d", w.writerState, writerStateBodyDone)
 	}
-	for name, value := range h {
-		_, err := w.Write([]byte(fmt.Sprintf("%s: %s\r\n", name, value)))
-		if err != nil {
-			return err
+	if w.framer != nil {
+		w.writerState = writerStateDone
+		if !w.bodyAllowed() {
+			h = nil
 		}
+		return w.framer.Close(h)
 	}
-	_, err := w.Write([]byte("\r\n"))
-	if err != nil {
-		return err
+	if w.bodyAllowed() && !w.unframed {
+		if err := w.writeFieldLines(h); err != nil {
+			return err
+		}
 	}
 	w.writerState = writerStateDone
 	return nil
 }
+
+func (w *Writer) writeFieldLines(h headers.Headers) error {
+	for name, lines := range h {
+		for _, line := range lines {
+			_, err := w.Write([]byte(fmt.Sprintf("%s: %s\r\n", name, line)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err := w.Write([]byte("\r\n"))
+	return err
+}
 func (w *Writer) WriteBody(p []byte) (int, error) {
 	if w.writerState != writerStateHeadersWrote {
 		return 0, fmt.Errorf("wrong state: %d, expected: %d", w.writerState, writerStateHeadersWrote)
 	}
-	w.Write(p)
-	w.Write([]byte("\n"))
 	w.writerState = writerStateBodyDone
+	if err := w.writeBodyBytes(p); err != nil {
+		return 0, err
+	}
 	return len(p), nil
 }
 
+// WriteContent writes a complete response with body, framed by its length.
+func (w *Writer) WriteContent(statusCode StatusCode, contentType string, body []byte) error {
+	if err := w.WriteStatusLine(statusCode); err != nil {
+		return err
+	}
+	h := GetDefaultHeaders(len(body))
+	h.Override(headers.ContentTypeHeader, contentType)
+	if err := w.WriteHeaders(h); err != nil {
+		return err
+	}
+	_, err := w.WriteBody(body)
+	return err
+}
+
 func GetDefaultHeaders(contentLen int) headers.Headers {
 	header := headers.NewHeaders()
 	header.Set(headers.ContentTypeHeader, "text/plain")
-	header.Set(headers.ConnectionHeader, "close")
 	header.Set(headers.ContentLengthHeader, fmt.Sprintf("%d", contentLen))
 	return header
 }
@@ -188,14 +614,33 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 		return 0, fmt.Errorf("wrong state: %d, expected: %d", w.writerState, writerStateHeadersWrote)
 	}
 	length := len(p)
-	w.Write([]byte(fmt.Sprintf("%x\r\n", length)))
-	w.Write(p)
-	w.Write([]byte("\r\n"))
+	if w.omitBody || length == 0 {
+		return length, nil
+	}
+	if !w.bodyAllowed() {
+		return 0, ErrBodyNotAllowed
+	}
+	if w.unframed || w.framer != nil {
+		if err := w.writeBodyBytes(p); err != nil {
+			return 0, err
+		}
+		return length, nil
+	}
+	chunk := make([]byte, 0, length+20)
+	chunk = fmt.Appendf(chunk, "%x\r\n", length)
+	chunk = append(chunk, p...)
+	chunk = append(chunk, "\r\n"...)
+	if _, err := w.Write(chunk); err != nil {
+		return 0, err
+	}
 	return length, nil
 }
 
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
-	w.Write([]byte("0\r\n"))
 	w.writerState = writerStateBodyDone
+	if !w.bodyAllowed() || w.unframed || w.framer != nil {
+		return 0, nil
+	}
+	w.Write([]byte("0\r\n"))
 	return 1, nil
 }
@@ -0,0 +1,170 @@
+package response
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/alexmarian/httpfromtcp/internal/headers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteInformational(t *testing.T) {
+	// Test: Early hints followed by the final response
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	require.NoError(t, w.WriteEarlyHints("</style.css>; rel=preload; as=style"))
+	require.NoError(t, w.WriteInformational(PROCESSING, nil))
+	require.NoError(t, w.WriteStatusLine(SUCCESS))
+	assert.Equal(t, "HTTP/1.1 103 Early Hints\r\n"+
+		"link: </style.css>; rel=preload; as=style\r\n"+
+		"\r\n"+
+		"HTTP/1.1 102 Processing\r\n"+
+		"\r\n"+
+		"HTTP/1.1 200 OK\r\n", buf.String())
+
+	// Test: Informational status as final response
+	w = NewWriter(&bytes.Buffer{})
+	require.Error(t, w.WriteStatusLine(CONTINUE))
+	assert.False(t, w.Started())
+
+	// Test: Final status as informational response
+	w = NewWriter(&bytes.Buffer{})
+	require.Error(t, w.WriteInformational(SUCCESS, nil))
+	require.Error(t, w.WriteInformational(SWITCHING_PROTOCOLS, nil))
+
+	// Test: Informational response after the final one
+	w = NewWriter(&bytes.Buffer{})
+	require.NoError(t, w.WriteStatusLine(SUCCESS))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	require.Error(t, w.WriteInformational(EARLY_HINTS, nil))
+}
+
+func TestBodySuppression(t *testing.T) {
+	// Test: HEAD keeps Content-Length but drops the body
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.OmitBody()
+	require.NoError(t, w.WriteStatusLine(SUCCESS))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	n, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+	assert.Contains(t, buf.String(), "content-length: 5\r\n")
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), []byte("\r\n\r\n")))
+
+	// Test: 204 never carries a body or a Content-Length
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(NO_CONTENT))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err = w.WriteBody([]byte("hello"))
+	require.ErrorIs(t, err, ErrBodyNotAllowed)
+	assert.NotContains(t, buf.String(), "content-length")
+	assert.NotContains(t, buf.String(), "hello")
+
+	// Test: 304 drops chunked framing
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	require.NoError(t, w.WriteStatusLine(NOT_MODIFIED))
+	hs := headers.NewHeaders()
+	hs.Set(headers.TransferEncodingHeader, "chunked")
+	require.NoError(t, w.WriteHeaders(hs))
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.ErrorIs(t, err, ErrBodyNotAllowed)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 304 Not Modified\r\nconnection: close\r\n\r\n", buf.String())
+}
+
+func TestHTTP10Framing(t *testing.T) {
+	// Test: Chunked body is written unframed and closes the connection
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetHTTPVersion("1.0")
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteInformational(EARLY_HINTS, nil))
+	require.NoError(t, w.WriteStatusLine(SUCCESS))
+	hs := headers.NewHeaders()
+	hs.Set(headers.TransferEncodingHeader, "chunked")
+	hs.Set(headers.TrailerHeader, headers.XContentSHA256Trailer)
+	require.NoError(t, w.WriteHeaders(hs))
+	_, err := w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(headers.NewHeaders()))
+	assert.Equal(t, "HTTP/1.0 200 OK\r\nconnection: close\r\n\r\nhello", buf.String())
+	assert.False(t, w.KeepAlive())
+
+	// Test: Keep-alive is advertised for a framed body
+	buf = &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetHTTPVersion("1.0")
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(SUCCESS))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err = w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), "connection: keep-alive\r\n")
+	assert.True(t, w.KeepAlive())
+}
+
+func TestKeepAlive(t *testing.T) {
+	// Test: Handler asking to close
+	w := NewWriter(&bytes.Buffer{})
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(SUCCESS))
+	hs := GetDefaultHeaders(0)
+	hs.Set(headers.ConnectionHeader, "close")
+	require.NoError(t, w.WriteHeaders(hs))
+	assert.False(t, w.KeepAlive())
+
+	// Test: Short body cannot be reused
+	w = NewWriter(&bytes.Buffer{})
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(SUCCESS))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(10)))
+	_, err := w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.False(t, w.KeepAlive())
+
+	// Test: Chunked body completed by Finish
+	buf := &bytes.Buffer{}
+	w = NewWriter(buf)
+	w.SetKeepAlive(true)
+	require.NoError(t, w.WriteStatusLine(SUCCESS))
+	hs = headers.NewHeaders()
+	hs.Set(headers.TransferEncodingHeader, "chunked")
+	require.NoError(t, w.WriteHeaders(hs))
+	_, err = w.WriteChunkedBody([]byte("hello"))
+	require.NoError(t, err)
+	assert.False(t, w.KeepAlive())
+	require.NoError(t, w.Finish())
+	assert.True(t, w.KeepAlive())
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), []byte("5\r\nhello\r\n0\r\n\r\n")))
+}
+
+func TestHijack(t *testing.T) {
+	// Test: Without a hijacker
+	w := NewWriter(&bytes.Buffer{})
+	_, _, err := w.Hijack()
+	assert.ErrorIs(t, err, ErrNotHijackable)
+	assert.False(t, w.Hijacked())
+
+	// Test: Writes fail once hijacked
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	w = NewWriter(server)
+	w.SetHijacker(func() (net.Conn, []byte, error) {
+		return server, []byte("leftover"), nil
+	})
+	conn, buffered, err := w.Hijack()
+	require.NoError(t, err)
+	assert.Equal(t, server, conn)
+	assert.Equal(t, "leftover", string(buffered))
+	assert.True(t, w.Hijacked())
+	assert.ErrorIs(t, w.WriteStatusLine(SUCCESS), ErrHijacked)
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// connReader reads requests from a connection and, while a handler runs,
+// watches the connection in the background so a client that goes away can be
+// noticed. Bytes read ahead, by the watcher or past the end of a request, are
+// the start of a pipelined request and are kept for the next Read.
+type connReader struct {
+	conn net.Conn
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	inRead  bool
+	aborted bool
+	pending []byte
+	unread  []byte
+	byteBuf [1]byte
+}
+
+func newConnReader(conn net.Conn) *connReader {
+	cr := &connReader{conn: conn}
+	cr.cond = sync.NewCond(&cr.mu)
+	return cr
+}
+
+func (cr *connReader) Read(p []byte) (int, error) {
+	cr.mu.Lock()
+	if cr.inRead {
+		cr.mu.Unlock()
+		return 0, errors.New("concurrent read on connection")
+	}
+	if len(cr.pending) > 0 {
+		n := copy(p, cr.pending)
+		cr.pending = cr.pending[n:]
+		cr.mu.Unlock()
+		return n, nil
+	}
+	cr.mu.Unlock()
+	return cr.conn.Read(p)
+}
+
+// hasPrefix reports whether the connection starts with prefix, reading only as
+// far as needed to tell. Whatever it reads is kept for the next Read.
+func (cr *connReader) hasPrefix(prefix string) (bool, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	buf := make([]byte, len(prefix))
+	for len(cr.pending) < len(prefix) {
+		if !strings.HasPrefix(prefix, string(cr.pending)) {
+			return false, nil
+		}
+		n, err := cr.conn.Read(buf[:len(prefix)-len(cr.pending)])
+		cr.pending = append(cr.pending, buf[:n]...)
+		if err != nil {
+			return false, err
+		}
+	}
+	return strings.HasPrefix(string(cr.pending), prefix), nil
+}
+
+// Unread puts a copy of p back in front of the bytes the next Read returns.
+// The copy reuses the same storage from one request to the next.
+func (cr *connReader) Unread(p []byte) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if len(cr.pending) > 0 {
+		cr.pending = append(append([]byte(nil), p...), cr.pending...)
+		return
+	}
+	cr.unread = append(cr.unread[:0], p...)
+	cr.pending = cr.unread
+}
+
+// pipelined reports whether the next request has already started arriving.
+func (cr *connReader) pipelined() bool {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return len(cr.pending) > 0
+}
+
+// buffered removes and returns the bytes read ahead of the next request.
+func (cr *connReader) buffered() []byte {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	b := cr.pending
+	cr.pending, cr.unread = nil, nil
+	return b
+}
+
+// startBackgroundRead watches the connection until abortPendingRead. onClose
+// runs when the peer closes the connection or it fails.
+func (cr *connReader) startBackgroundRead(onClose func()) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.inRead || len(cr.pending) > 0 {
+		return
+	}
+	cr.inRead = true
+	cr.aborted = false
+	go cr.backgroundRead(onClose)
+}
+
+func (cr *connReader) backgroundRead(onClose func()) {
+	n, err := cr.conn.Read(cr.byteBuf[:])
+	cr.mu.Lock()
+	if n == 1 {
+		cr.pending = append(cr.pending, cr.byteBuf[0])
+	}
+	closed := err != nil && !(cr.aborted && errors.Is(err, os.ErrDeadlineExceeded))
+	cr.inRead = false
+	cr.cond.Broadcast()
+	cr.mu.Unlock()
+	if closed {
+		onClose()
+	}
+}
+
+// abortPendingRead stops the background read and waits for it to finish.
+func (cr *connReader) abortPendingRead() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if !cr.inRead {
+		return
+	}
+	cr.aborted = true
+	cr.conn.SetReadDeadline(time.Unix(1, 0))
+	for cr.inRead {
+		cr.cond.Wait()
+	}
+	cr.conn.SetReadDeadline(time.Time{})
+}
@@ -0,0 +1,98 @@
+//go:build go1.24
+
+// The interop test needs the HTTP/2 support net/http gained in Go 1.24.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/alexmarian/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestH2C(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		if req.RequestLine.RequestTarget == "/missing" {
+			return &response.HandlerError{StatusCode: response.NOT_FOUND, Message: "no such page"}
+		}
+		body := []byte(req.RequestLine.HttpVersion + " " + req.RequestLine.Method + " " + req.RequestLine.RequestTarget + " " + string(req.Body))
+		w.WriteStatusLine(response.SUCCESS)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+		return nil
+	}
+	s, err := Serve(0, handler, WithH2C())
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	base := "http://" + s.Addr().String()
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}, Timeout: 5 * time.Second}
+	t.Cleanup(client.CloseIdleConnections)
+
+	// Test: net/http speaking HTTP/2 with prior knowledge, several requests at once
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Post(fmt.Sprintf("%s/item/%d", base, i), "text/plain", strings.NewReader("payload"))
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, resp.ProtoMajor)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, fmt.Sprintf("2.0 POST /item/%d payload", i), string(body))
+		}()
+	}
+	wg.Wait()
+
+	// Test: Handler errors are rendered by the error renderer
+	resp, err := client.Get(base + "/missing")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Test: HTTP/1.1 still works alongside
+	conn := startServer(t, handler, WithH2C())
+	_, err = io.WriteString(conn, "GET /plain HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(readAll(t, bufio.NewReader(conn)), "1.1 GET /plain "))
+
+	// Test: Upgrade: h2c switches protocols
+	conn = startServer(t, handler, WithH2C())
+	_, err = io.WriteString(conn, "GET /up HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\n"+
+		"Upgrade: h2c\r\nHTTP2-Settings: AAMAAABk\r\n\r\n")
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", line)
+	for line != "\r\n" {
+		line, err = reader.ReadString('\n')
+		require.NoError(t, err)
+	}
+	frameHead := make([]byte, 9)
+	_, err = io.ReadFull(reader, frameHead)
+	require.NoError(t, err)
+	assert.Equal(t, byte(0x4), frameHead[3], "SETTINGS follows the 101")
+
+	// Test: Without WithH2C the preface is an invalid request
+	conn = startServer(t, handler)
+	_, err = io.WriteString(conn, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(readAll(t, bufio.NewReader(conn)), "HTTP/1.1 "))
+}
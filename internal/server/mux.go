@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"github.com/alexmarian/httpfromtcp/internal/headers"
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/alexmarian/httpfromtcp/internal/response"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Mux routes requests by method and path. Patterns ending in "/" match every
+// path below them, all other patterns match exactly; the longest pattern wins.
+// OPTIONS requests are answered from the registered routes, and HEAD falls back
+// to the GET handler when no HEAD handler is registered.
+type Mux struct {
+	routes   map[string]map[string]Handler
+	patterns []string
+}
+
+func NewMux() *Mux {
+	return &Mux{
+		routes: make(map[string]map[string]Handler),
+	}
+}
+
+func (m *Mux) Handle(method, pattern string, handler Handler) {
+	methods, present := m.routes[pattern]
+	if !present {
+		methods = make(map[string]Handler)
+		m.routes[pattern] = methods
+		m.patterns = append(m.patterns, pattern)
+		sort.Slice(m.patterns, func(i, j int) bool {
+			return len(m.patterns[i]) > len(m.patterns[j])
+		})
+	}
+	methods[method] = handler
+}
+
+// Allowed returns the methods accepted for target, or every method the mux
+// knows about when target is "*".
+func (m *Mux) Allowed(target string) []string {
+	var methods []string
+	if target == "*" {
+		for _, routes := range m.routes {
+			methods = appendMethods(methods, routes)
+		}
+	} else if pattern, ok := m.match(target); ok {
+		methods = appendMethods(methods, m.routes[pattern])
+	}
+	if len(methods) == 0 {
+		return nil
+	}
+	if slices.Contains(methods, "GET") && !slices.Contains(methods, "HEAD") {
+		methods = append(methods, "HEAD")
+	}
+	if !slices.Contains(methods, "OPTIONS") {
+		methods = append(methods, "OPTIONS")
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+func appendMethods(methods []string, routes map[string]Handler) []string {
+	for method := range routes {
+		if !slices.Contains(methods, method) {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+func (m *Mux) Serve(w *response.Writer, req *request.Request) *response.HandlerError {
+	target := req.RequestLine.RequestTarget
+	method := req.RequestLine.Method
+	if method == "OPTIONS" && target == "*" {
+		return writeAllow(w, response.NO_CONTENT, m.Allowed(target), nil)
+	}
+	pattern, ok := m.match(target)
+	if !ok {
+		return &response.HandlerError{
+			StatusCode: response.NOT_FOUND,
+			Message:    fmt.Sprintf("no route for %s", target),
+		}
+	}
+	routes := m.routes[pattern]
+	handler, present := routes[method]
+	if !present && method == "HEAD" {
+		handler, present = routes["GET"]
+	}
+	if present {
+		return handler(w, req)
+	}
+	if method == "OPTIONS" {
+		return writeAllow(w, response.NO_CONTENT, m.Allowed(target), nil)
+	}
+	return writeAllow(w, response.METHOD_NOT_ALLOWED, m.Allowed(target), []byte(fmt.Sprintf("method %s not allowed", method)))
+}
+
+func (m *Mux) match(target string) (string, bool) {
+	path, _, _ := strings.Cut(target, "?")
+	if _, present := m.routes[path]; present {
+		return path, true
+	}
+	for _, pattern := range m.patterns {
+		if strings.HasSuffix(pattern, "/") && strings.HasPrefix(path, pattern) {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+func writeAllow(w *response.Writer, code response.StatusCode, methods []string, body []byte) *response.HandlerError {
+	hs := response.GetDefaultHeaders(len(body))
+	hs.Override(headers.AllowHeader, strings.Join(methods, ", "))
+	if len(body) == 0 {
+		hs.Remove(headers.ContentTypeHeader)
+	}
+	w.WriteStatusLine(code)
+	w.WriteHeaders(hs)
+	w.WriteBody(body)
+	return nil
+}
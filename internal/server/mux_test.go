@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/alexmarian/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serveMux(t *testing.T, m *Mux, raw string) (string, *response.HandlerError) {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(raw))
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	if req.RequestLine.Method == "HEAD" {
+		w.OmitBody()
+	}
+	hErr := m.Serve(w, req)
+	return buf.String(), hErr
+}
+
+func TestMux(t *testing.T) {
+	ok := func(body string) Handler {
+		return func(w *response.Writer, req *request.Request) *response.HandlerError {
+			w.WriteStatusLine(response.SUCCESS)
+			w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+			w.WriteBody([]byte(body))
+			return nil
+		}
+	}
+	m := NewMux()
+	m.Handle("GET", "/", ok("root"))
+	m.Handle("GET", "/items/", ok("items"))
+	m.Handle("POST", "/items/", ok("created"))
+	m.Handle("DELETE", "/exact", ok("deleted"))
+
+	// Test: Longest prefix wins
+	out, hErr := serveMux(t, m, "GET /items/42?x=1 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.Nil(t, hErr)
+	assert.Contains(t, out, "items")
+
+	// Test: HEAD falls back to GET without a body
+	out, hErr = serveMux(t, m, "HEAD /items/42 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.Nil(t, hErr)
+	assert.Contains(t, out, "content-length: 5\r\n")
+	assert.NotContains(t, out, "items")
+
+	// Test: OPTIONS lists the methods of the route
+	out, hErr = serveMux(t, m, "OPTIONS /items/ HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.Nil(t, hErr)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 204 No Content\r\n"))
+	assert.Contains(t, out, "allow: GET, HEAD, OPTIONS, POST\r\n")
+
+	// Test: OPTIONS * lists every method
+	out, hErr = serveMux(t, m, "OPTIONS * HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.Nil(t, hErr)
+	assert.Contains(t, out, "allow: DELETE, GET, HEAD, OPTIONS, POST\r\n")
+
+	// Test: Wrong method
+	out, hErr = serveMux(t, m, "GET /exact HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.Nil(t, hErr)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.Contains(t, out, "allow: DELETE, OPTIONS\r\n")
+
+	// Test: Unknown path
+	m = NewMux()
+	m.Handle("GET", "/only", ok("only"))
+	_, hErr = serveMux(t, m, "GET /other HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NotNil(t, hErr)
+	assert.Equal(t, response.NOT_FOUND, hErr.StatusCode)
+}
@@ -1,42 +1,264 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/alexmarian/httpfromtcp/internal/headers"
+	"github.com/alexmarian/httpfromtcp/internal/http2"
 	"github.com/alexmarian/httpfromtcp/internal/request"
 	"github.com/alexmarian/httpfromtcp/internal/response"
+	"io"
 	"log"
 	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type Server struct {
-	listener *net.Listener
-	handler  *Handler
-	closed   atomic.Bool
+	listener       *net.Listener
+	handler        *Handler
+	closed         atomic.Bool
+	trace          bool
+	requestOpts    []request.Option
+	idleTimeout    time.Duration
+	errorRenderer  response.ErrorRenderer
+	requestTimeout time.Duration
+	maxPipeline    int
+	ctx            context.Context
+	cancel         context.CancelCauseFunc
+	h2c            bool
+	tlsConfig      *tls.Config
+	http2Opts      []http2.Option
+	http2          *http2.Server
+
+	mu    sync.Mutex
+	conns map[net.Conn]connState
 }
 
+// connState tells Shutdown whether a connection is waiting for a request and
+// can be closed right away.
+type connState int
+
+const (
+	connIdle connState = iota
+	connActive
+)
+
+var (
+	// ErrServerClosed is the cause of request contexts cancelled by Close.
+	ErrServerClosed = errors.New("server closed")
+	// ErrClientDisconnected is the cause of request contexts cancelled because
+	// the client closed the connection.
+	ErrClientDisconnected = errors.New("client disconnected")
+)
+
+const defaultIdleTimeout = 60 * time.Second
+
+// DefaultMaxPipelineDepth is how many pipelined requests a connection serves
+// unless WithMaxPipelineDepth says otherwise.
+const DefaultMaxPipelineDepth = 16
+
 type Handler func(w *response.Writer, req *request.Request) *response.HandlerError
 
-func Serve(port int, handler Handler) (*Server, error) {
+// Option configures optional server behaviour.
+type Option func(*Server)
+
+// WithTrace makes the server answer TRACE requests itself by echoing the
+// received request back as a message/http body.
+func WithTrace() Option {
+	return func(s *Server) {
+		s.trace = true
+	}
+}
+
+// WithIdleTimeout sets how long a persistent connection may wait for the next
+// request before it is closed.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = timeout
+	}
+}
+
+// WithRequestOptions sets the options used to parse every incoming request.
+func WithRequestOptions(opts ...request.Option) Option {
+	return func(s *Server) {
+		s.requestOpts = append(s.requestOpts, opts...)
+	}
+}
+
+// WithErrorRenderer sets how HandlerErrors and parse failures are written. The
+// default negotiates between HTML, problem+json and plain text.
+func WithErrorRenderer(renderer response.ErrorRenderer) Option {
+	return func(s *Server) {
+		s.errorRenderer = renderer
+	}
+}
+
+// WithRequestTimeout sets a deadline on the context of every request, measured
+// from when its headers were read.
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.requestTimeout = timeout
+	}
+}
+
+// WithMaxPipelineDepth limits how many requests a client may pipeline, that
+// is send before the response to the previous one is complete. Requests are
+// always answered in order; the response to the n-th request of a pipeline
+// closes the connection, leaving the client to retry the rest.
+func WithMaxPipelineDepth(n int) Option {
+	return func(s *Server) {
+		s.maxPipeline = max(n, 1)
+	}
+}
+
+// WithH2C serves HTTP/2 over cleartext TCP to clients that either start with
+// the HTTP/2 preface ("prior knowledge") or ask for it with "Upgrade: h2c".
+// Every stream is served by the same handler as HTTP/1.x requests.
+func WithH2C(opts ...http2.Option) Option {
+	return func(s *Server) {
+		s.h2c = true
+		s.http2Opts = append(s.http2Opts, opts...)
+	}
+}
+
+// WithTLS serves every connection over TLS with config, which must hold the
+// server's certificates. Unless config sets NextProtos, ALPN offers "h2" and
+// "http/1.1", so clients that support it get HTTP/2 and the others HTTP/1.1.
+func WithTLS(config *tls.Config) Option {
+	return func(s *Server) {
+		s.tlsConfig = config.Clone()
+		if len(s.tlsConfig.NextProtos) == 0 {
+			s.tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+	}
+}
+
+// WithHTTP2 configures HTTP/2 however it was negotiated, e.g. to enable
+// server push with http2.WithPush.
+func WithHTTP2(opts ...http2.Option) Option {
+	return func(s *Server) {
+		s.http2Opts = append(s.http2Opts, opts...)
+	}
+}
+
+func Serve(port int, handler Handler, opts ...Option) (*Server, error) {
+	server := &Server{
+		handler:       &handler,
+		closed:        atomic.Bool{},
+		idleTimeout:   defaultIdleTimeout,
+		errorRenderer: response.DefaultErrorRenderer(),
+		maxPipeline:   DefaultMaxPipelineDepth,
+		conns:         make(map[net.Conn]connState),
+	}
+	for _, opt := range opts {
+		opt(server)
+	}
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return nil, fmt.Errorf("error listening on port %d: %w", port, err)
 	}
-	server := &Server{
-		listener: &listener,
-		handler:  &handler,
-		closed:   atomic.Bool{},
+	if server.tlsConfig != nil {
+		listener = tls.NewListener(listener, server.tlsConfig)
+	}
+	server.listener = &listener
+	server.ctx, server.cancel = context.WithCancelCause(context.Background())
+	if server.h2c || (server.tlsConfig != nil && slices.Contains(server.tlsConfig.NextProtos, "h2")) {
+		server.http2 = http2.NewServer(server.serveStream, append([]http2.Option{
+			http2.WithIdleTimeout(server.idleTimeout),
+			http2.WithRequestOptions(server.requestOpts...),
+			http2.WithInvalidRequestHandler(server.renderInvalid),
+		}, server.http2Opts...)...)
 	}
 	go server.listen(handler)
 	return server, nil
 }
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() net.Addr {
+	return (*s.listener).Addr()
+}
 func (s *Server) Close() error {
 	s.closed.Store(true)
+	s.cancel(ErrServerClosed)
 	if err := (*s.listener).Close(); err != nil {
 		return fmt.Errorf("error closing server: %w", err)
 	}
 	return nil
 }
+
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Shutdown stops accepting connections and closes the open ones as they
+// become idle: HTTP/1.x connections once their current response went out with
+// "Connection: close", HTTP/2 connections after a GOAWAY once their open
+// streams are done. If ctx ends first, the rest are cut off as by Close and
+// ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed.Store(true)
+	for conn, state := range s.conns {
+		if state == connIdle {
+			conn.SetReadDeadline(time.Now())
+		}
+	}
+	s.mu.Unlock()
+	err := (*s.listener).Close()
+	if s.http2 != nil {
+		s.http2.Shutdown()
+	}
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		open := len(s.conns)
+		s.mu.Unlock()
+		if open == 0 {
+			s.cancel(ErrServerClosed)
+			if err != nil {
+				return fmt.Errorf("error closing server: %w", err)
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			s.cancel(ErrServerClosed)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// setState records whether conn is waiting for a request. It reports false
+// when the server is shutting down and an idle conn should not wait.
+func (s *Server) setState(conn net.Conn, state connState) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[conn] = state
+	if state != connIdle {
+		return true
+	}
+	if s.closed.Load() {
+		return false
+	}
+	conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+	return true
+}
+
+func (s *Server) forget(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
 func (s *Server) listen(handler Handler) {
 	for !s.closed.Load() {
 		conn, err := (*s.listener).Accept()
@@ -45,26 +267,281 @@ func (s *Server) listen(handler Handler) {
 			continue
 		}
 		log.Printf("Accepted connection: %v\n", conn)
-		s.handle(conn)
+		go s.handle(conn)
 	}
 }
 
+// handle serves requests on conn until either side asks to close it or a
+// handler hijacks it.
 func (s *Server) handle(conn net.Conn) {
-	req, err := request.RequestFromReader(conn)
+	defer s.forget(conn)
+	if !s.setState(conn, connIdle) {
+		conn.Close()
+		return
+	}
+	cr := newConnReader(conn)
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.HandshakeContext(s.ctx); err != nil {
+			log.Println("Error in TLS handshake:", err)
+			conn.Close()
+			return
+		}
+		if tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+			s.setState(conn, connActive)
+			s.http2.ServeConn(s.ctx, conn, cr)
+			return
+		}
+	} else if s.h2c {
+		if isHTTP2, err := cr.hasPrefix(http2.ClientPreface); err != nil {
+			conn.Close()
+			return
+		} else if isHTTP2 {
+			s.setState(conn, connActive)
+			s.http2.ServeConn(s.ctx, conn, cr)
+			return
+		}
+	}
+	depth := 0
+	for s.setState(conn, connIdle) {
+		if cr.pipelined() {
+			depth++
+		} else {
+			depth = 1
+		}
+		reuse, hijacked := s.serve(conn, cr, depth >= s.maxPipeline)
+		if hijacked {
+			return
+		}
+		if !reuse {
+			break
+		}
+	}
+	closeConn(conn)
+}
+
+// serve handles a single request and reports whether the connection can be
+// reused for the next one, or whether the handler took it over. The response
+// to a last request closes the connection. Requests are served one at a time,
+// so pipelined ones are answered in the order they arrived.
+func (s *Server) serve(conn net.Conn, cr *connReader, last bool) (reuse bool, hijacked bool) {
+	req, err := request.RequestFromReader(cr, s.requestOpts...)
 	res := response.NewWriter(conn)
-	defer conn.Close()
 	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, os.ErrDeadlineExceeded) {
+			return false, false
+		}
 		log.Println("Error reading request:", err)
-		response.HandlerError{
-			StatusCode: response.BAD_REQUEST,
+		s.errorRenderer.RenderError(res, nil, &response.HandlerError{
+			StatusCode: statusForParseError(err),
 			Message:    err.Error(),
-		}.Write(res)
-		return
+		})
+		return false, false
+	}
+	req.ID = newRequestID()
+	s.setState(conn, connActive)
+	conn.SetReadDeadline(time.Time{})
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		req.TLS = &state
+	}
+	res.SetHTTPVersion(responseVersion(req))
+	res.SetKeepAlive(req.KeepAlive() && !last)
+	// a shutdown that begins while the handler runs still closes the connection
+	res.BeforeHeaders(func(headers.Headers) {
+		if s.closed.Load() {
+			res.SetKeepAlive(false)
+		}
+	})
+	if expect, present := req.Headers.Get(headers.ExpectHeader); present && req.ProtoAtLeast(1, 1) && !req.ExpectsContinue() {
+		s.errorRenderer.RenderError(res, req, &response.HandlerError{
+			StatusCode: response.EXPECTATION_FAILED,
+			Message:    fmt.Sprintf("unsupported expectation: %s", expect),
+		})
+		return false, false
+	}
+	if s.h2c && req.TLS == nil && !req.BodyPending() && http2.IsUpgrade(req) {
+		s.http2.ServeUpgrade(s.ctx, conn, io.MultiReader(bytes.NewReader(req.Buffered()), cr), req)
+		return false, true
 	}
+	switch req.RequestLine.Method {
+	case "HEAD":
+		res.OmitBody()
+	case "TRACE":
+		if s.trace {
+			writeTrace(res, req)
+			// an unread 100-continue body would be parsed as the next request
+			return res.KeepAlive() && !req.BodyPending(), false
+		}
+	}
+	req.OnContinue(func() error {
+		if res.Started() {
+			return fmt.Errorf("response already started, not sending 100 Continue")
+		}
+		return res.WriteInformational(response.CONTINUE, nil)
+	})
+	ctx, cancel := context.WithCancelCause(s.ctx)
+	defer cancel(nil)
+	if s.requestTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, s.requestTimeout)
+		defer cancelTimeout()
+	}
+	req.SetContext(ctx)
+	// A body still to be read keeps the connection busy, so disconnects are
+	// only watched for once the request has been read in full.
+	if !req.BodyPending() {
+		cr.startBackgroundRead(func() { cancel(ErrClientDisconnected) })
+	}
+	res.SetHijacker(func() (net.Conn, []byte, error) {
+		cr.abortPendingRead()
+		return conn, append(req.Buffered(), cr.buffered()...), nil
+	})
 	hErr := (*s.handler)(res, req)
+	cr.abortPendingRead()
+	if hErr == abortConnection {
+		return false, false
+	}
+	if res.Hijacked() {
+		if hErr != nil {
+			log.Printf("Request %s failed after hijacking the connection: %s", req.ID, hErr.Message)
+		}
+		return false, true
+	}
+	if hErr != nil {
+		if res.Started() {
+			log.Printf("Request %s failed after starting the response: %s", req.ID, hErr.Message)
+			return false, false
+		}
+		if err := s.errorRenderer.RenderError(res, req, hErr); err != nil {
+			log.Printf("Request %s: error rendering %d: %v", req.ID, hErr.StatusCode, err)
+			return false, false
+		}
+	}
+	if err := res.Finish(); err != nil {
+		return false, false
+	}
+	// an unread deferred body is still on the wire
+	return res.KeepAlive() && !req.BodyPending(), false
+}
+
+// serveStream serves a request received on an HTTP/2 stream. The connection
+// belongs to the HTTP/2 server, so only the parts of serve that concern the
+// exchange itself apply.
+func (s *Server) serveStream(w *response.Writer, req *request.Request) error {
+	req.ID = newRequestID()
+	if s.requestTimeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), s.requestTimeout)
+		defer cancel()
+		req.SetContext(ctx)
+	}
+	switch req.RequestLine.Method {
+	case "HEAD":
+		w.OmitBody()
+	case "TRACE":
+		if s.trace {
+			writeTrace(w, req)
+			return w.Finish()
+		}
+	}
+	hErr := (*s.handler)(w, req)
+	if hErr == abortConnection {
+		return errors.New(hErr.Message)
+	}
+	if hErr == abandonedStream {
+		return nil
+	}
 	if hErr != nil {
-		hErr.Write(res)
+		if w.Started() {
+			log.Printf("Request %s failed after starting the response: %s", req.ID, hErr.Message)
+			return errors.New(hErr.Message)
+		}
+		if err := s.errorRenderer.RenderError(w, req, hErr); err != nil {
+			log.Printf("Request %s: error rendering %d: %v", req.ID, hErr.StatusCode, err)
+			return err
+		}
+	}
+	return w.Finish()
+}
+
+// renderInvalid answers an HTTP/2 request that failed validation the way
+// serve answers an unparsable HTTP/1.x request.
+func (s *Server) renderInvalid(w *response.Writer, err error) {
+	log.Println("Error reading request:", err)
+	s.errorRenderer.RenderError(w, nil, &response.HandlerError{
+		StatusCode: statusForParseError(err),
+		Message:    err.Error(),
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+const lingerTimeout = 500 * time.Millisecond
+const lingerMaxBytes = 256 << 10
+
+// closeConn half-closes conn and drains what the client is still sending
+// before closing, so unread request bytes do not turn into a reset that
+// destroys the response in flight.
+func closeConn(conn net.Conn) {
+	defer conn.Close()
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
 		return
 	}
-	return
+	if err := tcpConn.CloseWrite(); err != nil {
+		return
+	}
+	tcpConn.SetReadDeadline(time.Now().Add(lingerTimeout))
+	io.CopyN(io.Discard, tcpConn, lingerMaxBytes)
+}
+
+// responseVersion answers HTTP/1.0 requests with HTTP/1.0 and everything else
+// with HTTP/1.1, the highest version this server speaks.
+func responseVersion(req *request.Request) string {
+	if req.ProtoAtLeast(1, 1) {
+		return "1.1"
+	}
+	return "1.0"
+}
+
+// traceExcludedHeaders lists fields that are not echoed by TRACE because they
+// are likely to carry credentials.
+var traceExcludedHeaders = []string{"authorization", "cookie", "proxy-authorization"}
+
+func writeTrace(w *response.Writer, req *request.Request) {
+	b := strings.Builder{}
+	b.WriteString(fmt.Sprintf("%s %s HTTP/%s\r\n", req.RequestLine.Method, req.RequestLine.RequestTarget, req.RequestLine.HttpVersion))
+	for name, lines := range req.Headers {
+		if slices.Contains(traceExcludedHeaders, name) {
+			continue
+		}
+		for _, line := range lines {
+			b.WriteString(fmt.Sprintf("%s: %s\r\n", name, line))
+		}
+	}
+	b.WriteString("\r\n")
+	body := []byte(b.String())
+	hs := response.GetDefaultHeaders(len(body))
+	hs.Override(headers.ContentTypeHeader, "message/http")
+	w.WriteStatusLine(response.SUCCESS)
+	w.WriteHeaders(hs)
+	w.WriteBody(body)
+}
+
+func statusForParseError(err error) response.StatusCode {
+	switch {
+	case errors.Is(err, request.ErrMethodNotImplemented), errors.Is(err, request.ErrUnsupportedTransferEncoding):
+		return response.NOT_IMPLEMENTED
+	case errors.Is(err, request.ErrVersionNotSupported):
+		return response.HTTP_VERSION_NOT_SUPPORTED
+	case errors.Is(err, request.ErrBodyTooLarge):
+		return response.CONTENT_TOO_LARGE
+	case errors.Is(err, request.ErrHeadersTooLarge):
+		return response.HEADER_FIELDS_TOO_LARGE
+	default:
+		return response.BAD_REQUEST
+	}
 }
@@ -0,0 +1,330 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/alexmarian/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T, handler Handler, opts ...Option) net.Conn {
+	t.Helper()
+	s, err := Serve(0, handler, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func echoTarget(w *response.Writer, req *request.Request) *response.HandlerError {
+	body := []byte(req.RequestLine.RequestTarget)
+	w.WriteStatusLine(response.SUCCESS)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+	return nil
+}
+
+func TestPersistentConnections(t *testing.T) {
+	conn := startServer(t, echoTarget)
+	reader := bufio.NewReader(conn)
+
+	// Test: HTTP/1.1 connection serves several requests
+	_, err := io.WriteString(conn, "GET /one HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	out := readResponse(t, reader, 4)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.NotContains(t, out, "connection")
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n/one"))
+	_, err = io.WriteString(conn, "GET /two HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	out = readAll(t, reader)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "connection: close\r\n")
+	assert.True(t, strings.HasSuffix(out, "/two"))
+}
+
+func TestHTTP10(t *testing.T) {
+	// Test: HTTP/1.0 closes by default
+	conn := startServer(t, echoTarget)
+	_, err := io.WriteString(conn, "GET /old HTTP/1.0\r\n\r\n")
+	require.NoError(t, err)
+	out := readAll(t, bufio.NewReader(conn))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.0 200 OK\r\n"))
+	assert.Contains(t, out, "connection: close\r\n")
+
+	// Test: HTTP/1.0 keep-alive on request
+	conn = startServer(t, echoTarget)
+	reader := bufio.NewReader(conn)
+	_, err = io.WriteString(conn, "GET /a HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+	require.NoError(t, err)
+	out = readResponse(t, reader, 2)
+	assert.Contains(t, out, "connection: keep-alive\r\n")
+	_, err = io.WriteString(conn, "GET /b HTTP/1.0\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(readAll(t, reader), "/b"))
+
+	// Test: Unsupported major version
+	conn = startServer(t, echoTarget)
+	_, err = io.WriteString(conn, "GET / HTTP/2.0\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(readAll(t, bufio.NewReader(conn)), "HTTP/1.1 505 HTTP Version Not Supported\r\n"))
+
+	// Test: Bodies over the configured size
+	conn = startServer(t, echoTarget, WithRequestOptions(request.WithMaxBodySize(4)))
+	_, err = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(readAll(t, bufio.NewReader(conn)), "HTTP/1.1 413 Content Too Large\r\n"))
+
+	// Test: Heads over the configured size
+	conn = startServer(t, echoTarget, WithRequestOptions(request.WithMaxHeadSize(64)))
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nX-Big: "+strings.Repeat("a", 64)+"\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(readAll(t, bufio.NewReader(conn)), "HTTP/1.1 431 Request Header Fields Too Large\r\n"))
+	conn = startServer(t, echoTarget, WithRequestOptions(request.WithMaxHeadSize(64)))
+	_, err = io.WriteString(conn, "GET /"+strings.Repeat("a", 64)+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(readAll(t, bufio.NewReader(conn)), "HTTP/1.1 400 Bad Request\r\n"))
+}
+
+// readResponse reads a status line, headers and a body of bodyLen bytes.
+func readResponse(t *testing.T, reader *bufio.Reader, bodyLen int) string {
+	t.Helper()
+	b := strings.Builder{}
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		b.WriteString(line)
+		if line == "\r\n" {
+			break
+		}
+	}
+	body := make([]byte, bodyLen)
+	_, err := io.ReadFull(reader, body)
+	require.NoError(t, err)
+	b.Write(body)
+	return b.String()
+}
+
+func readAll(t *testing.T, reader *bufio.Reader) string {
+	t.Helper()
+	out, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	return string(out)
+}
+
+func TestErrorRenderer(t *testing.T) {
+	failing := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		return &response.HandlerError{StatusCode: response.NOT_FOUND, Message: "gone"}
+	}
+
+	// Test: Default renderer negotiates and includes the request ID
+	conn := startServer(t, failing)
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nAccept: application/json\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	out := readAll(t, bufio.NewReader(conn))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 404 Not Found\r\n"))
+	assert.Contains(t, out, "content-type: application/problem+json\r\n")
+	assert.Regexp(t, `"request_id":"[0-9a-f]{16}"`, out)
+
+	// Test: Configured renderer, also used for parse errors
+	conn = startServer(t, failing, WithErrorRenderer(response.TextErrorRenderer{}))
+	reader := bufio.NewReader(conn)
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	out = readResponse(t, reader, len("404 Not Found: gone\nRequest ID: 0123456789abcdef\n"))
+	assert.Contains(t, out, "content-type: text/plain\r\n")
+	assert.Regexp(t, "\r\n\r\n404 Not Found: gone\nRequest ID: [0-9a-f]{16}\n$", out)
+	_, err = io.WriteString(conn, "GET /\r\n\r\n")
+	require.NoError(t, err)
+	out = readAll(t, reader)
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 400 Bad Request\r\n"))
+	assert.Contains(t, out, "content-type: text/plain\r\n")
+}
+
+func TestHijack(t *testing.T) {
+	done := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		conn, buffered, err := w.Hijack()
+		if err != nil {
+			return &response.HandlerError{StatusCode: response.INTERNAL_SERVER_ERROR, Message: err.Error()}
+		}
+		_, _, err = w.Hijack()
+		assert.ErrorIs(t, err, response.ErrHijacked)
+		assert.Error(t, w.WriteStatusLine(response.SUCCESS))
+		// keep using the connection after the handler returned
+		go func() {
+			defer close(done)
+			defer conn.Close()
+			reader := bufio.NewReader(io.MultiReader(strings.NewReader(string(buffered)), conn))
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, "raw reply to "+line)
+		}()
+		return nil
+	}
+
+	// Test: Bytes sent right after the request reach the new owner
+	conn := startServer(t, handler)
+	_, err := io.WriteString(conn, "GET /raw HTTP/1.1\r\nHost: localhost\r\n\r\nhello\n")
+	require.NoError(t, err)
+	assert.Equal(t, "raw reply to hello\n", readAll(t, bufio.NewReader(conn)))
+	<-done
+}
+
+func TestRequestContext(t *testing.T) {
+	causes := make(chan error, 1)
+	waitForCancel := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		select {
+		case <-req.Context().Done():
+			causes <- context.Cause(req.Context())
+		case <-time.After(5 * time.Second):
+			causes <- nil
+		}
+		return nil
+	}
+
+	// Test: Cancelled when the client disconnects
+	conn := startServer(t, waitForCancel)
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	conn.Close()
+	assert.ErrorIs(t, <-causes, ErrClientDisconnected)
+
+	// Test: Cancelled by the request timeout
+	conn = startServer(t, waitForCancel, WithRequestTimeout(20*time.Millisecond))
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	assert.ErrorIs(t, <-causes, context.DeadlineExceeded)
+
+	// Test: Cancelled when the server closes
+	s, err := Serve(0, waitForCancel)
+	require.NoError(t, err)
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	s.Close()
+	assert.ErrorIs(t, <-causes, ErrServerClosed)
+
+	// Test: Values set by middleware, and a pipelined request read by the
+	// disconnect watcher is still served
+	type key struct{}
+	withValue := func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) *response.HandlerError {
+			req.SetContext(context.WithValue(req.Context(), key{}, "from middleware"))
+			return next(w, req)
+		}
+	}
+	conn = startServer(t, withValue(func(w *response.Writer, req *request.Request) *response.HandlerError {
+		// give the watcher time to pick up the next request
+		time.Sleep(20 * time.Millisecond)
+		body := []byte(req.Context().Value(key{}).(string) + " " + req.RequestLine.RequestTarget)
+		w.WriteStatusLine(response.SUCCESS)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+		return nil
+	}))
+	reader := bufio.NewReader(conn)
+	_, err = io.WriteString(conn, "GET /a HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	_, err = io.WriteString(conn, "GET /b HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(readResponse(t, reader, len("from middleware /a")), "from middleware /a"))
+	assert.True(t, strings.HasSuffix(readAll(t, reader), "from middleware /b"))
+}
+
+func TestPipelining(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	handler := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		mu.Lock()
+		order = append(order, req.RequestLine.RequestTarget)
+		mu.Unlock()
+		if req.RequestLine.RequestTarget == "/slow" {
+			time.Sleep(20 * time.Millisecond)
+		}
+		body := []byte(req.RequestLine.RequestTarget + ":" + string(req.Body))
+		w.WriteStatusLine(response.SUCCESS)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+		return nil
+	}
+	pipeline := "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"POST /post HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\nbody" +
+		"GET /last HTTP/1.1\r\nHost: localhost\r\n\r\n"
+
+	// Test: Requests sent in one write are answered in order
+	conn := startServer(t, handler)
+	reader := bufio.NewReader(conn)
+	_, err := io.WriteString(conn, pipeline)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(readResponse(t, reader, len("/slow:")), "/slow:"))
+	assert.True(t, strings.HasSuffix(readResponse(t, reader, len("/post:body")), "/post:body"))
+	out := readResponse(t, reader, len("/last:"))
+	assert.True(t, strings.HasSuffix(out, "/last:"))
+	assert.NotContains(t, out, "connection: close")
+	assert.Equal(t, []string{"/slow", "/post", "/last"}, order)
+
+	// Test: The connection stays usable after the pipeline
+	_, err = io.WriteString(conn, "GET /again HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(readAll(t, reader), "/again:"))
+
+	// Test: The response at the maximum depth closes the connection
+	conn = startServer(t, handler, WithMaxPipelineDepth(2))
+	reader = bufio.NewReader(conn)
+	_, err = io.WriteString(conn, pipeline)
+	require.NoError(t, err)
+	assert.NotContains(t, readResponse(t, reader, len("/slow:")), "connection: close")
+	out = readAll(t, reader)
+	assert.Contains(t, out, "connection: close\r\n")
+	assert.True(t, strings.HasSuffix(out, "/post:body"))
+}
+
+func TestTrace(t *testing.T) {
+	head := "TRACE / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	echo := "TRACE / HTTP/1.1\r\nhost: localhost\r\n\r\n"
+
+	// Test: TRACE echoes the request and keeps the connection
+	conn := startServer(t, echoTarget, WithTrace())
+	reader := bufio.NewReader(conn)
+	_, err := io.WriteString(conn, head)
+	require.NoError(t, err)
+	out := readResponse(t, reader, len(echo))
+	assert.Contains(t, out, "content-type: message/http\r\n")
+	assert.True(t, strings.HasSuffix(out, echo))
+	_, err = io.WriteString(conn, "GET /next HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(readAll(t, reader), "/next"))
+
+	// Test: A delayed 100-continue body is not read as the next request
+	smuggled := "GET /smuggled HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	conn = startServer(t, echoTarget, WithTrace())
+	reader = bufio.NewReader(conn)
+	_, err = io.WriteString(conn, fmt.Sprintf("TRACE / HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: %d\r\n\r\n", len(smuggled)))
+	require.NoError(t, err)
+	out = readResponse(t, reader, len(echo)+len("expect: 100-continue\r\n")+len(fmt.Sprintf("content-length: %d\r\n", len(smuggled))))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	io.WriteString(conn, smuggled)
+	rest, _ := io.ReadAll(reader)
+	assert.NotContains(t, string(rest), "/smuggled")
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/alexmarian/httpfromtcp/internal/headers"
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/alexmarian/httpfromtcp/internal/response"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrHandlerTimeout is returned by writes of a handler that ran past its
+// TimeoutHandler deadline.
+var ErrHandlerTimeout = errors.New("handler timeout")
+
+// abortConnection is returned by TimeoutHandler to make the server drop the
+// connection without touching the Writer the abandoned handler still holds.
+var abortConnection = &response.HandlerError{StatusCode: response.SERVICE_UNAVAILABLE, Message: "handler timed out"}
+
+// abandonedStream is returned by TimeoutHandler once it has answered an HTTP/2
+// stream itself, so the server leaves the abandoned handler's Writer alone.
+var abandonedStream = &response.HandlerError{StatusCode: response.SERVICE_UNAVAILABLE, Message: "handler timed out"}
+
+// TimeoutHandler runs handler with a deadline on its request context. When
+// the deadline passes before the handler wrote anything but 1xx interim
+// responses the client gets a 503
+// with message; when the response had already started the connection is
+// closed, or the HTTP/2 stream reset. Either way the handler's context is
+// cancelled and its further writes fail with ErrHandlerTimeout.
+func TimeoutHandler(handler Handler, timeout time.Duration, message string) Handler {
+	return func(w *response.Writer, req *request.Request) *response.HandlerError {
+		// The context is cancelled by hand once the response has been taken
+		// away, so a handler reacting to it cannot slip a write in first.
+		ctx, cancel := context.WithCancelCause(req.Context())
+		defer cancel(nil)
+		req.SetContext(ctx)
+		guard := &timeoutWriter{dst: w.Writer}
+		framer := w.Framer()
+		if framer != nil {
+			w.SetFramer(&timeoutFramer{dst: framer, guard: guard})
+		} else {
+			w.Writer = guard
+		}
+		head := req.RequestLine.Method == "HEAD"
+
+		done := make(chan *response.HandlerError, 1)
+		panicked := make(chan any, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			done <- handler(w, req)
+		}()
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case hErr := <-done:
+			return hErr
+		case p := <-panicked:
+			panic(p)
+		case <-timer.C:
+		}
+
+		guard.mu.Lock()
+		defer guard.mu.Unlock()
+		guard.timedOut = true
+		cancel(context.DeadlineExceeded)
+		if guard.written || guard.interim {
+			return abortConnection
+		}
+		var tw *response.Writer
+		if framer != nil {
+			tw = response.NewFramedWriter(framer)
+		} else {
+			tw = response.NewWriter(guard.dst)
+			tw.SetHTTPVersion(responseVersion(req))
+		}
+		if head {
+			tw.OmitBody()
+		}
+		response.DefaultErrorRenderer().RenderError(tw, req, &response.HandlerError{
+			StatusCode: response.SERVICE_UNAVAILABLE,
+			Message:    message,
+		})
+		if framer != nil {
+			tw.Finish()
+			return abandonedStream
+		}
+		return abortConnection
+	}
+}
+
+// timeoutWriter sits between a Writer and the connection, so the response can
+// be taken away from a handler that is still running. written is set once the
+// final response starts, interim while the head of a 1xx response is only
+// partly written.
+type timeoutWriter struct {
+	dst io.Writer
+
+	mu       sync.Mutex
+	written  bool
+	interim  bool
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, ErrHandlerTimeout
+	}
+	tw.track(p)
+	return tw.dst.Write(p)
+}
+
+// track follows the writes of the handler's Writer, which sends a status line
+// in a single write and ends a head with a lone CRLF, to tell 1xx interim
+// responses from the start of the final one.
+func (tw *timeoutWriter) track(p []byte) {
+	switch {
+	case tw.written:
+	case tw.interim:
+		tw.interim = string(p) != "\r\n"
+	case isInterimStatusLine(p):
+		tw.interim = true
+	default:
+		tw.written = true
+	}
+}
+
+// isInterimStatusLine reports whether p is the status line of a 1xx response
+// other than 101 Switching Protocols, which ends the exchange.
+func isInterimStatusLine(p []byte) bool {
+	if !bytes.HasPrefix(p, []byte("HTTP/1.")) || len(p) < len("HTTP/1.1 100") {
+		return false
+	}
+	code := string(p[len("HTTP/1.1 "):len("HTTP/1.1 100")])
+	return code[0] == '1' && code != "101"
+}
+
+// timeoutFramer guards the Framer of an HTTP/2 response the way timeoutWriter
+// guards a connection.
+type timeoutFramer struct {
+	dst   response.Framer
+	guard *timeoutWriter
+}
+
+func (tf *timeoutFramer) WriteHeader(statusCode response.StatusCode, h headers.Headers) error {
+	// an interim response still leaves room for the 503
+	return tf.write(statusCode >= 200, func() error { return tf.dst.WriteHeader(statusCode, h) })
+}
+
+func (tf *timeoutFramer) WriteData(p []byte) error {
+	return tf.write(true, func() error { return tf.dst.WriteData(p) })
+}
+
+func (tf *timeoutFramer) Close(trailers headers.Headers) error {
+	return tf.write(true, func() error { return tf.dst.Close(trailers) })
+}
+
+func (tf *timeoutFramer) Push(target string, h headers.Headers) error {
+	pusher, ok := tf.dst.(response.Pusher)
+	if !ok {
+		return response.ErrPushNotSupported
+	}
+	tf.guard.mu.Lock()
+	defer tf.guard.mu.Unlock()
+	if tf.guard.timedOut {
+		return ErrHandlerTimeout
+	}
+	return pusher.Push(target, h)
+}
+
+func (tf *timeoutFramer) write(final bool, send func() error) error {
+	tf.guard.mu.Lock()
+	defer tf.guard.mu.Unlock()
+	if tf.guard.timedOut {
+		return ErrHandlerTimeout
+	}
+	if final {
+		tf.guard.written = true
+	}
+	return send()
+}
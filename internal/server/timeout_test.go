@@ -0,0 +1,188 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexmarian/httpfromtcp/internal/http2/hpack"
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/alexmarian/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeoutHandler(t *testing.T) {
+	// Test: Fast handlers are untouched and the connection is reused
+	conn := startServer(t, TimeoutHandler(echoTarget, time.Second, "too slow"))
+	reader := bufio.NewReader(conn)
+	_, err := io.WriteString(conn, "GET /fast HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(readResponse(t, reader, 5), "/fast"))
+	_, err = io.WriteString(conn, "GET /again HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(readAll(t, reader), "/again"))
+
+	// Test: 503 with the configured message when nothing was written
+	writeErr := make(chan error, 1)
+	slow := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		<-req.Context().Done()
+		writeErr <- w.WriteStatusLine(response.SUCCESS)
+		return nil
+	}
+	conn = startServer(t, TimeoutHandler(slow, 20*time.Millisecond, "The report is taking too long"))
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nAccept: text/plain\r\n\r\n")
+	require.NoError(t, err)
+	out := readAll(t, bufio.NewReader(conn))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 503 Service Unavailable\r\n"))
+	assert.Contains(t, out, "connection: close\r\n")
+	assert.Contains(t, out, "503 Service Unavailable: The report is taking too long\n")
+	assert.ErrorIs(t, <-writeErr, ErrHandlerTimeout)
+
+	// Test: 503 after an interim response
+	hinting := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		w.WriteEarlyHints("</style.css>; rel=preload; as=style")
+		return slow(w, req)
+	}
+	conn = startServer(t, TimeoutHandler(hinting, 20*time.Millisecond, "unused"))
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	out = readAll(t, bufio.NewReader(conn))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 103 Early Hints\r\nlink: </style.css>; rel=preload; as=style\r\n\r\nHTTP/1.1 503 Service Unavailable\r\n"), out)
+	assert.ErrorIs(t, <-writeErr, ErrHandlerTimeout)
+
+	// Test: A started stream is cut off
+	streaming := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		w.WriteStatusLine(response.SUCCESS)
+		h := response.GetDefaultHeaders(0)
+		h.Remove("content-length")
+		h.Set("transfer-encoding", "chunked")
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("partial"))
+		<-req.Context().Done()
+		_, err := w.WriteChunkedBody([]byte("late"))
+		writeErr <- err
+		return nil
+	}
+	conn = startServer(t, TimeoutHandler(streaming, 20*time.Millisecond, "unused"))
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	out = readAll(t, bufio.NewReader(conn))
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.True(t, strings.HasSuffix(out, "7\r\npartial\r\n"), out)
+	assert.ErrorIs(t, <-writeErr, ErrHandlerTimeout)
+}
+
+func TestTimeoutHandlerHTTP2(t *testing.T) {
+	writeErr := make(chan error, 1)
+	slow := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		<-req.Context().Done()
+		w.WriteStatusLine(response.SUCCESS)
+		writeErr <- w.WriteHeaders(response.GetDefaultHeaders(0))
+		return nil
+	}
+
+	// Test: 503 with the configured message on a stream that got nothing yet
+	conn := startServer(t, TimeoutHandler(slow, 20*time.Millisecond, "The report is taking too long"), WithH2C())
+	fields, body, reset := h2Exchange(t, conn, "GET", "/")
+	assert.False(t, reset)
+	assert.Contains(t, fields, hpack.HeaderField{Name: ":status", Value: "503"})
+	assert.True(t, strings.HasPrefix(body, "503 Service Unavailable: The report is taking too long\n"), body)
+	assert.ErrorIs(t, <-writeErr, ErrHandlerTimeout)
+
+	// Test: HEAD gets the 503 without a body
+	conn = startServer(t, TimeoutHandler(slow, 20*time.Millisecond, "unused"), WithH2C())
+	fields, body, reset = h2Exchange(t, conn, "HEAD", "/")
+	assert.False(t, reset)
+	assert.Contains(t, fields, hpack.HeaderField{Name: ":status", Value: "503"})
+	assert.Empty(t, body)
+	<-writeErr
+
+	// Test: 503 after an interim response
+	hinting := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		w.WriteEarlyHints("</style.css>; rel=preload; as=style")
+		return slow(w, req)
+	}
+	conn = startServer(t, TimeoutHandler(hinting, 20*time.Millisecond, "unused"), WithH2C())
+	fields, _, reset = h2Exchange(t, conn, "GET", "/")
+	assert.False(t, reset)
+	assert.Equal(t, []hpack.HeaderField{{Name: ":status", Value: "103"}, {Name: "link", Value: "</style.css>; rel=preload; as=style"}}, fields[:2])
+	assert.Contains(t, fields, hpack.HeaderField{Name: ":status", Value: "503"})
+	assert.ErrorIs(t, <-writeErr, ErrHandlerTimeout)
+
+	// Test: A started stream is reset
+	streaming := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		w.WriteStatusLine(response.SUCCESS)
+		h := response.GetDefaultHeaders(0)
+		h.Remove("content-length")
+		h.Set("transfer-encoding", "chunked")
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("partial"))
+		<-req.Context().Done()
+		_, err := w.WriteChunkedBody([]byte("late"))
+		writeErr <- err
+		return nil
+	}
+	conn = startServer(t, TimeoutHandler(streaming, 20*time.Millisecond, "unused"), WithH2C())
+	fields, body, reset = h2Exchange(t, conn, "GET", "/")
+	assert.True(t, reset)
+	assert.Contains(t, fields, hpack.HeaderField{Name: ":status", Value: "200"})
+	assert.Equal(t, "partial", body)
+	assert.ErrorIs(t, <-writeErr, ErrHandlerTimeout)
+}
+
+// h2Exchange sends a request on stream 1 of a prior-knowledge HTTP/2
+// connection and reads the response until the stream ends or is reset.
+func h2Exchange(t *testing.T, conn net.Conn, method, target string) (fields []hpack.HeaderField, body string, reset bool) {
+	t.Helper()
+	block := hpack.NewEncoder().Encode(nil, []hpack.HeaderField{
+		{Name: ":method", Value: method},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: target},
+		{Name: ":authority", Value: "localhost"},
+		{Name: "accept", Value: "text/plain"},
+	})
+	out := []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	out = appendFrame(out, 0x4, 0, 0, nil)
+	out = appendFrame(out, 0x1, 0x5, 1, block) // END_STREAM | END_HEADERS
+	_, err := conn.Write(out)
+	require.NoError(t, err)
+
+	decoder := hpack.NewDecoder(4096)
+	reader := bufio.NewReader(conn)
+	head := make([]byte, 9)
+	for {
+		_, err := io.ReadFull(reader, head)
+		require.NoError(t, err)
+		payload := make([]byte, int(head[0])<<16|int(head[1])<<8|int(head[2]))
+		_, err = io.ReadFull(reader, payload)
+		require.NoError(t, err)
+		kind, flags, stream := head[3], head[4], binary.BigEndian.Uint32(head[5:])&0x7fffffff
+		if stream != 1 {
+			continue
+		}
+		switch kind {
+		case 0x0:
+			body += string(payload)
+		case 0x1:
+			decoded, err := decoder.Decode(payload)
+			require.NoError(t, err)
+			fields = append(fields, decoded...)
+		case 0x3:
+			return fields, body, true
+		}
+		if flags&0x1 != 0 {
+			return fields, body, false
+		}
+	}
+}
+
+func appendFrame(dst []byte, kind, flags byte, stream uint32, payload []byte) []byte {
+	dst = append(dst, byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload)), kind, flags)
+	dst = binary.BigEndian.AppendUint32(dst, stream)
+	return append(dst, payload...)
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexmarian/httpfromtcp/internal/http2"
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/alexmarian/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCertificate returns a self-signed certificate for localhost and a pool
+// that trusts it.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+// reportProtocol answers with the negotiated protocol and the outcome of
+// pushing /pushed.
+func reportProtocol(w *response.Writer, req *request.Request) *response.HandlerError {
+	body := req.Protocol()
+	if req.TLS != nil {
+		body += " tls:" + req.TLS.NegotiatedProtocol
+	}
+	if err := w.Push("/pushed", nil); err != nil {
+		body += " " + err.Error()
+	}
+	w.WriteStatusLine(response.SUCCESS)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody([]byte(body))
+	return nil
+}
+
+func get(t *testing.T, client *http.Client, url string) (*http.Response, string) {
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestTLS(t *testing.T) {
+	cert, pool := testCertificate(t)
+	s, err := Serve(0, reportProtocol, WithTLS(&tls.Config{Certificates: []tls.Certificate{cert}}), WithHTTP2(http2.WithPush()))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	url := fmt.Sprintf("https://localhost:%d/", s.Addr().(*net.TCPAddr).Port)
+
+	// Test: ALPN negotiates h2; net/http disables push, so Push reports that
+	h2Client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}, ForceAttemptHTTP2: true},
+		Timeout:   5 * time.Second,
+	}
+	t.Cleanup(h2Client.CloseIdleConnections)
+	resp, body := get(t, h2Client, url)
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, "h2 tls:h2 "+response.ErrPushNotSupported.Error(), body)
+
+	// Test: Clients without h2 fall back to HTTP/1.1
+	h1Client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, NextProtos: []string{"http/1.1"}}},
+		Timeout:   5 * time.Second,
+	}
+	t.Cleanup(h1Client.CloseIdleConnections)
+	resp, body = get(t, h1Client, url)
+	assert.Equal(t, 1, resp.ProtoMajor)
+	assert.Equal(t, "http/1.1 tls:http/1.1 "+response.ErrPushNotSupported.Error(), body)
+
+	// Test: Clients without ALPN get HTTP/1.1
+	conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "localhost"})
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(readAll(t, bufio.NewReader(conn)), "http/1.1 tls: "+response.ErrPushNotSupported.Error()))
+
+	// Test: Upgrade: h2c is not honoured over TLS
+	s2, err := Serve(0, reportProtocol, WithTLS(&tls.Config{Certificates: []tls.Certificate{cert}}), WithH2C())
+	require.NoError(t, err)
+	t.Cleanup(func() { s2.Close() })
+	conn, err = tls.Dial("tcp", s2.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "localhost"})
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings, close\r\n"+
+		"Upgrade: h2c\r\nHTTP2-Settings: AAMAAABk\r\n\r\n")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(readAll(t, bufio.NewReader(conn)), "HTTP/1.1 200 OK\r\n"))
+}
+
+func TestShutdown(t *testing.T) {
+	cert, pool := testCertificate(t)
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		if req.RequestLine.RequestTarget == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		return reportProtocol(w, req)
+	}
+	s, err := Serve(0, handler, WithTLS(&tls.Config{Certificates: []tls.Certificate{cert}}))
+	require.NoError(t, err)
+	base := fmt.Sprintf("https://localhost:%d", s.Addr().(*net.TCPAddr).Port)
+	h2Client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}, ForceAttemptHTTP2: true},
+		Timeout:   5 * time.Second,
+	}
+	t.Cleanup(h2Client.CloseIdleConnections)
+	dial := func() *tls.Conn {
+		conn, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "localhost", NextProtos: []string{"http/1.1"}})
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+
+	// an idle HTTP/1.1 connection, one with a request in flight and an HTTP/2
+	// stream in flight
+	idleConn := dial()
+	require.NoError(t, idleConn.Handshake())
+	busyConn := dial()
+	_, err = io.WriteString(busyConn, "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	h2Done := make(chan string, 1)
+	go func() {
+		resp, err := h2Client.Get(base + "/slow")
+		if err != nil {
+			h2Done <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		h2Done <- string(body)
+	}()
+	<-started
+	<-started
+
+	shutdownDone := make(chan error, 1)
+	go func() { shutdownDone <- s.Shutdown(context.Background()) }()
+
+	// Test: The idle connection is closed
+	_, err = idleConn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Requests in flight complete, HTTP/1.1 with Connection: close
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case <-shutdownDone:
+		t.Fatal("Shutdown returned with requests in flight")
+	default:
+	}
+	close(release)
+	out := readAll(t, bufio.NewReader(busyConn))
+	assert.Contains(t, out, "connection: close\r\n")
+	assert.True(t, strings.HasSuffix(out, "http/1.1 tls:http/1.1 "+response.ErrPushNotSupported.Error()))
+	assert.Equal(t, "h2 tls:h2 "+response.ErrPushNotSupported.Error(), <-h2Done)
+	assert.NoError(t, <-shutdownDone)
+
+	// Test: No new connections are accepted
+	_, err = net.DialTimeout("tcp", s.Addr().String(), time.Second)
+	assert.Error(t, err)
+
+	// Test: Shutdown gives up when its context ends
+	s, err = Serve(0, handler)
+	require.NoError(t, err)
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	release = make(chan struct{})
+	defer close(release)
+	_, err = io.WriteString(conn, "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/alexmarian/httpfromtcp/internal/response"
+	"strings"
+)
+
+// VirtualHosts dispatches requests to a Handler chosen by hostname. Patterns
+// are either exact hostnames ("example.com"), wildcards matching any
+// subdomain ("*.example.com") or "*" as the fallback. Exact matches win over
+// wildcards and longer wildcards win over shorter ones.
+type VirtualHosts struct {
+	exact     map[string]Handler
+	wildcards map[string]Handler
+	fallback  Handler
+}
+
+func NewVirtualHosts() *VirtualHosts {
+	return &VirtualHosts{
+		exact:     make(map[string]Handler),
+		wildcards: make(map[string]Handler),
+	}
+}
+
+func (v *VirtualHosts) Handle(pattern string, handler Handler) {
+	pattern = normalizeHostname(pattern)
+	switch {
+	case pattern == "*":
+		v.fallback = handler
+	case strings.HasPrefix(pattern, "*."):
+		v.wildcards[pattern[1:]] = handler
+	default:
+		v.exact[pattern] = handler
+	}
+}
+
+// Match returns the handler registered for host, if any.
+func (v *VirtualHosts) Match(host string) (Handler, bool) {
+	host = normalizeHostname(host)
+	if handler, present := v.exact[host]; present {
+		return handler, true
+	}
+	for i := strings.IndexByte(host, '.'); i != -1; i = strings.IndexByte(host, '.') {
+		host = host[i+1:]
+		if handler, present := v.wildcards["."+host]; present {
+			return handler, true
+		}
+	}
+	if v.fallback != nil {
+		return v.fallback, true
+	}
+	return nil, false
+}
+
+func (v *VirtualHosts) Serve(w *response.Writer, req *request.Request) *response.HandlerError {
+	handler, ok := v.Match(req.Host)
+	if !ok {
+		return &response.HandlerError{
+			StatusCode: response.MISDIRECTED_REQUEST,
+			Message:    fmt.Sprintf("no site configured for host %q", req.Host),
+		}
+	}
+	return handler(w, req)
+}
+
+func normalizeHostname(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/alexmarian/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVirtualHosts(t *testing.T) {
+	site := func(name string) Handler {
+		return func(w *response.Writer, req *request.Request) *response.HandlerError {
+			return &response.HandlerError{StatusCode: response.SUCCESS, Message: name}
+		}
+	}
+	v := NewVirtualHosts()
+	v.Handle("Example.com", site("apex"))
+	v.Handle("*.example.com", site("any-sub"))
+	v.Handle("*.api.example.com", site("api-sub"))
+	v.Handle("api.example.com", site("api"))
+
+	for host, want := range map[string]string{
+		"example.com":        "apex",
+		"example.com.":       "apex",
+		"www.example.com":    "any-sub",
+		"a.b.example.com":    "any-sub",
+		"api.example.com":    "api",
+		"v1.api.example.com": "api-sub",
+	} {
+		handler, ok := v.Match(host)
+		require.True(t, ok, host)
+		assert.Equal(t, want, handler(nil, nil).Message, host)
+	}
+
+	// Test: No match without a fallback
+	_, ok := v.Match("example.org")
+	assert.False(t, ok)
+	hErr := v.Serve(nil, &request.Request{Host: "example.org"})
+	require.NotNil(t, hErr)
+	assert.Equal(t, response.MISDIRECTED_REQUEST, hErr.StatusCode)
+
+	// Test: Fallback
+	v.Handle("*", site("default"))
+	handler, ok := v.Match("example.org")
+	require.True(t, ok)
+	assert.Equal(t, "default", handler(nil, nil).Message)
+}
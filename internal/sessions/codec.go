@@ -0,0 +1,130 @@
+package sessions
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Codec turns a session ID into a cookie value and back. Implementations bind
+// the value to the cookie name so it cannot be replayed under another cookie.
+type Codec interface {
+	Encode(name string, value []byte) (string, error)
+	Decode(name, value string) ([]byte, error)
+}
+
+var (
+	ErrInvalidKey    = errors.New("invalid session key")
+	ErrInvalidCookie = errors.New("invalid session cookie")
+)
+
+var encoding = base64.RawURLEncoding
+
+// SignedCodec authenticates cookie values with HMAC-SHA256. Values are signed
+// with the first key and accepted when any key verifies them, so keys can be
+// rotated by prepending a new one and dropping the oldest later.
+type SignedCodec struct {
+	keys [][]byte
+}
+
+func NewSignedCodec(keys ...[]byte) (*SignedCodec, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no keys", ErrInvalidKey)
+	}
+	for _, key := range keys {
+		if len(key) < 32 {
+			return nil, fmt.Errorf("%w: signing keys need at least 32 bytes", ErrInvalidKey)
+		}
+	}
+	return &SignedCodec{keys: keys}, nil
+}
+
+func (c *SignedCodec) Encode(name string, value []byte) (string, error) {
+	payload := encoding.EncodeToString(value)
+	return payload + "." + encoding.EncodeToString(sign(c.keys[0], name, payload)), nil
+}
+
+func (c *SignedCodec) Decode(name, value string) ([]byte, error) {
+	payload, rawMAC, found := strings.Cut(value, ".")
+	if !found {
+		return nil, ErrInvalidCookie
+	}
+	mac, err := encoding.DecodeString(rawMAC)
+	if err != nil {
+		return nil, ErrInvalidCookie
+	}
+	for _, key := range c.keys {
+		if hmac.Equal(mac, sign(key, name, payload)) {
+			data, err := encoding.DecodeString(payload)
+			if err != nil {
+				return nil, ErrInvalidCookie
+			}
+			return data, nil
+		}
+	}
+	return nil, ErrInvalidCookie
+}
+
+func sign(key []byte, name, payload string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(name + "=" + payload))
+	return h.Sum(nil)
+}
+
+// EncryptedCodec seals cookie values with AES-GCM, hiding them from the client
+// as well as authenticating them. Key rotation works as for SignedCodec.
+type EncryptedCodec struct {
+	aeads []cipher.AEAD
+}
+
+// NewEncryptedCodec takes AES keys of 16, 24 or 32 bytes.
+func NewEncryptedCodec(keys ...[]byte) (*EncryptedCodec, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no keys", ErrInvalidKey)
+	}
+	c := &EncryptedCodec{}
+	for _, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+		}
+		c.aeads = append(c.aeads, aead)
+	}
+	return c, nil
+}
+
+func (c *EncryptedCodec) Encode(name string, value []byte) (string, error) {
+	aead := c.aeads[0]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(value)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(aead.Seal(nonce, nonce, value, []byte(name))), nil
+}
+
+func (c *EncryptedCodec) Decode(name, value string) ([]byte, error) {
+	sealed, err := encoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrInvalidCookie
+	}
+	for _, aead := range c.aeads {
+		if len(sealed) < aead.NonceSize() {
+			continue
+		}
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		if data, err := aead.Open(nil, nonce, ciphertext, []byte(name)); err == nil {
+			return data, nil
+		}
+	}
+	return nil, ErrInvalidCookie
+}
@@ -0,0 +1,87 @@
+package sessions
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignedCodec(t *testing.T) {
+	oldKey := bytes.Repeat([]byte("a"), 32)
+	newKey := bytes.Repeat([]byte("b"), 32)
+
+	// Test: Round trip
+	c, err := NewSignedCodec(oldKey)
+	require.NoError(t, err)
+	value, err := c.Encode("session", []byte("id-1"))
+	require.NoError(t, err)
+	data, err := c.Decode("session", value)
+	require.NoError(t, err)
+	assert.Equal(t, "id-1", string(data))
+
+	// Test: Tampered value, wrong cookie name
+	_, err = c.Decode("session", "aWQtMg"+value[len("aWQtMQ"):])
+	assert.ErrorIs(t, err, ErrInvalidCookie)
+	_, err = c.Decode("other", value)
+	assert.ErrorIs(t, err, ErrInvalidCookie)
+	_, err = c.Decode("session", "garbage")
+	assert.ErrorIs(t, err, ErrInvalidCookie)
+
+	// Test: Rotation keeps old cookies valid and signs with the new key
+	rotated, err := NewSignedCodec(newKey, oldKey)
+	require.NoError(t, err)
+	data, err = rotated.Decode("session", value)
+	require.NoError(t, err)
+	assert.Equal(t, "id-1", string(data))
+	fresh, err := rotated.Encode("session", []byte("id-1"))
+	require.NoError(t, err)
+	_, err = c.Decode("session", fresh)
+	assert.ErrorIs(t, err, ErrInvalidCookie)
+
+	// Test: Short keys are refused
+	_, err = NewSignedCodec([]byte("short"))
+	assert.ErrorIs(t, err, ErrInvalidKey)
+	_, err = NewSignedCodec()
+	assert.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func TestEncryptedCodec(t *testing.T) {
+	oldKey := bytes.Repeat([]byte("a"), 32)
+	newKey := bytes.Repeat([]byte("b"), 16)
+
+	// Test: Round trip hides the plaintext
+	c, err := NewEncryptedCodec(oldKey)
+	require.NoError(t, err)
+	value, err := c.Encode("session", []byte("secret-id"))
+	require.NoError(t, err)
+	assert.NotContains(t, value, "secret")
+	data, err := c.Decode("session", value)
+	require.NoError(t, err)
+	assert.Equal(t, "secret-id", string(data))
+
+	// Test: Nonces differ between encodings
+	again, err := c.Encode("session", []byte("secret-id"))
+	require.NoError(t, err)
+	assert.NotEqual(t, value, again)
+
+	// Test: Name is authenticated, tampering fails
+	_, err = c.Decode("other", value)
+	assert.ErrorIs(t, err, ErrInvalidCookie)
+	tampered := []byte(value)
+	tampered[len(tampered)-1] ^= 1
+	_, err = c.Decode("session", string(tampered))
+	assert.ErrorIs(t, err, ErrInvalidCookie)
+
+	// Test: Rotation
+	rotated, err := NewEncryptedCodec(newKey, oldKey)
+	require.NoError(t, err)
+	data, err = rotated.Decode("session", value)
+	require.NoError(t, err)
+	assert.Equal(t, "secret-id", string(data))
+
+	// Test: Bad key size
+	_, err = NewEncryptedCodec([]byte("short"))
+	assert.ErrorIs(t, err, ErrInvalidKey)
+}
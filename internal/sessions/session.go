@@ -0,0 +1,228 @@
+package sessions
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/alexmarian/httpfromtcp/internal/cookies"
+	"github.com/alexmarian/httpfromtcp/internal/headers"
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/alexmarian/httpfromtcp/internal/response"
+	"github.com/alexmarian/httpfromtcp/internal/server"
+	"log"
+	"time"
+)
+
+const idLength = 32
+
+// Manager issues session cookies and loads the matching sessions from a
+// Store. Its Middleware makes the session of each request available through
+// Get.
+type Manager struct {
+	store  Store
+	codec  Codec
+	ttl    time.Duration
+	cookie cookies.Cookie
+}
+
+type sessionKey struct{}
+
+type Option func(*Manager)
+
+// WithTTL sets how long an idle session lives. Every Save extends it.
+func WithTTL(ttl time.Duration) Option {
+	return func(m *Manager) {
+		m.ttl = ttl
+	}
+}
+
+// WithCookie sets the name and attributes of the session cookie. Value,
+// Expires and MaxAge are managed by the Manager. NewManager fails when they
+// do not make a valid cookie.
+func WithCookie(cookie cookies.Cookie) Option {
+	return func(m *Manager) {
+		m.cookie = cookie
+	}
+}
+
+func NewManager(store Store, codec Codec, opts ...Option) (*Manager, error) {
+	m := &Manager{
+		store: store,
+		codec: codec,
+		ttl:   24 * time.Hour,
+		cookie: cookies.Cookie{
+			Name:     "session",
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: cookies.SameSiteLax,
+		},
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if err := m.cookie.Valid(); err != nil {
+		return nil, fmt.Errorf("session cookie: %w", err)
+	}
+	return m, nil
+}
+
+// Middleware loads the session named by the request cookie, or starts a new
+// one, before calling next. Changes reach the client only when the handler
+// calls Save, Destroy or RegenerateID before writing the response headers.
+func (m *Manager) Middleware(next server.Handler) server.Handler {
+	return func(w *response.Writer, req *request.Request) *response.HandlerError {
+		s, err := m.load(req)
+		if err != nil {
+			return &response.HandlerError{StatusCode: response.INTERNAL_SERVER_ERROR, Message: "Session store unavailable"}
+		}
+		req.SetContext(context.WithValue(req.Context(), sessionKey{}, s))
+		w.BeforeHeaders(s.writeCookie)
+		return next(w, req)
+	}
+}
+
+// Get returns the session of a request served through Middleware, or nil.
+func (m *Manager) Get(req *request.Request) *Session {
+	s, _ := req.Context().Value(sessionKey{}).(*Session)
+	return s
+}
+
+func (m *Manager) load(req *request.Request) (*Session, error) {
+	if c, ok := cookies.Get(req.Headers, m.cookie.Name); ok {
+		if id, err := m.codec.Decode(m.cookie.Name, c.Value); err == nil {
+			values, err := m.store.Load(string(id))
+			if err == nil {
+				return &Session{id: string(id), values: values, manager: m, requestID: req.ID}, nil
+			}
+			if !errors.Is(err, ErrNotFound) {
+				return nil, err
+			}
+		}
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	return &Session{id: id, values: make(map[string]string), isNew: true, manager: m, requestID: req.ID}, nil
+}
+
+type cookieAction int
+
+const (
+	cookieUnchanged cookieAction = iota
+	cookieSet
+	cookieClear
+)
+
+// Session holds the values of one client session. It is meant to be used by
+// a single request at a time.
+type Session struct {
+	id          string
+	values      map[string]string
+	isNew       bool
+	manager     *Manager
+	cookie      cookieAction
+	cookieValue string
+	requestID   string
+}
+
+func (s *Session) ID() string {
+	return s.id
+}
+
+// IsNew reports whether the session was started by this request.
+func (s *Session) IsNew() bool {
+	return s.isNew
+}
+
+func (s *Session) Get(key string) (string, bool) {
+	value, ok := s.values[key]
+	return value, ok
+}
+
+func (s *Session) Set(key, value string) {
+	s.values[key] = value
+}
+
+func (s *Session) Delete(key string) {
+	delete(s.values, key)
+}
+
+// Save persists the values and refreshes the cookie expiry. It fails without
+// saving when the codec cannot encode the session ID into a valid cookie.
+func (s *Session) Save() error {
+	c := s.manager.cookie
+	value, err := s.manager.codec.Encode(c.Name, []byte(s.id))
+	if err != nil {
+		return fmt.Errorf("encoding session cookie: %w", err)
+	}
+	c.Value = value
+	if err := c.Valid(); err != nil {
+		return fmt.Errorf("session cookie: %w", err)
+	}
+	if err := s.manager.store.Save(s.id, s.values, s.manager.ttl); err != nil {
+		return err
+	}
+	s.cookie = cookieSet
+	s.cookieValue = value
+	return nil
+}
+
+// Destroy removes the session from the store and expires the cookie.
+func (s *Session) Destroy() error {
+	if err := s.manager.store.Delete(s.id); err != nil {
+		return err
+	}
+	s.values = make(map[string]string)
+	s.cookie = cookieClear
+	return nil
+}
+
+// RegenerateID moves the session to a fresh ID and saves it, which should be
+// done whenever the privilege level changes, such as on login, to defeat
+// session fixation.
+func (s *Session) RegenerateID() error {
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+	if err := s.manager.store.Delete(s.id); err != nil {
+		return err
+	}
+	s.id = id
+	return s.Save()
+}
+
+func (s *Session) writeCookie(h headers.Headers) {
+	c := s.manager.cookie
+	switch s.cookie {
+	case cookieSet:
+		c.Value = s.cookieValue
+		c.MaxAge = int(s.manager.ttl / time.Second)
+	case cookieClear:
+		c.MaxAge = -1
+	default:
+		return
+	}
+	if err := cookies.SetCookie(h, &c); err != nil {
+		log.Printf("Request %s: session cookie not set: %v", s.requestID, err)
+	}
+}
+
+func newID() (string, error) {
+	b := make([]byte, idLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func validID(id string) bool {
+	if len(id) != 2*idLength {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
@@ -0,0 +1,197 @@
+package sessions
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexmarian/httpfromtcp/internal/cookies"
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/alexmarian/httpfromtcp/internal/response"
+	"github.com/alexmarian/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve runs handler through the middleware for a request carrying cookie and
+// returns the raw response.
+func serve(t *testing.T, m *Manager, cookie string, handler server.Handler) string {
+	raw := "GET / HTTP/1.1\r\nHost: localhost\r\n"
+	if cookie != "" {
+		raw += "Cookie: " + cookie + "\r\n"
+	}
+	req, err := request.RequestFromReader(strings.NewReader(raw + "\r\n"))
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	hErr := m.Middleware(handler)(w, req)
+	require.Nil(t, hErr)
+	return buf.String()
+}
+
+func ok(w *response.Writer) *response.HandlerError {
+	w.WriteStatusLine(response.SUCCESS)
+	w.WriteHeaders(response.GetDefaultHeaders(0))
+	return nil
+}
+
+// sessionCookie extracts the session cookie from a raw response.
+func sessionCookie(t *testing.T, raw string) string {
+	for _, line := range strings.Split(raw, "\r\n") {
+		if value, found := strings.CutPrefix(line, "set-cookie: "); found {
+			c := cookies.Parse(strings.SplitN(value, ";", 2)[0])
+			require.Len(t, c, 1)
+			return c[0].Name + "=" + c[0].Value
+		}
+	}
+	return ""
+}
+
+func TestSessions(t *testing.T) {
+	store := NewMemoryStore(time.Minute)
+	defer store.Close()
+	codec, err := NewSignedCodec(bytes.Repeat([]byte("k"), 32))
+	require.NoError(t, err)
+	m, err := NewManager(store, codec, WithTTL(time.Hour))
+	require.NoError(t, err)
+
+	// Test: A new session that is not saved sets no cookie
+	out := serve(t, m, "", func(w *response.Writer, req *request.Request) *response.HandlerError {
+		s := m.Get(req)
+		require.NotNil(t, s)
+		assert.True(t, s.IsNew())
+		return ok(w)
+	})
+	assert.NotContains(t, out, "set-cookie")
+
+	// Test: Saving issues the cookie
+	var firstID string
+	out = serve(t, m, "", func(w *response.Writer, req *request.Request) *response.HandlerError {
+		s := m.Get(req)
+		s.Set("user", "alex")
+		firstID = s.ID()
+		require.NoError(t, s.Save())
+		return ok(w)
+	})
+	assert.Contains(t, out, "; Path=/; Max-Age=3600; HttpOnly; SameSite=Lax\r\n")
+	cookie := sessionCookie(t, out)
+	require.NotEmpty(t, cookie)
+
+	// Test: The cookie loads the session on the next request
+	serve(t, m, cookie, func(w *response.Writer, req *request.Request) *response.HandlerError {
+		s := m.Get(req)
+		assert.False(t, s.IsNew())
+		assert.Equal(t, firstID, s.ID())
+		user, _ := s.Get("user")
+		assert.Equal(t, "alex", user)
+		return ok(w)
+	})
+
+	// Test: A forged cookie starts a fresh session
+	serve(t, m, "session="+firstID, func(w *response.Writer, req *request.Request) *response.HandlerError {
+		assert.True(t, m.Get(req).IsNew())
+		return ok(w)
+	})
+
+	// Test: Regenerating the ID keeps the values and invalidates the old ID
+	out = serve(t, m, cookie, func(w *response.Writer, req *request.Request) *response.HandlerError {
+		require.NoError(t, m.Get(req).RegenerateID())
+		return ok(w)
+	})
+	regenerated := sessionCookie(t, out)
+	assert.NotEqual(t, cookie, regenerated)
+	_, err = store.Load(firstID)
+	assert.ErrorIs(t, err, ErrNotFound)
+	serve(t, m, regenerated, func(w *response.Writer, req *request.Request) *response.HandlerError {
+		s := m.Get(req)
+		assert.NotEqual(t, firstID, s.ID())
+		user, _ := s.Get("user")
+		assert.Equal(t, "alex", user)
+		return ok(w)
+	})
+
+	// Test: Destroy expires the cookie and forgets the session
+	var lastID string
+	out = serve(t, m, regenerated, func(w *response.Writer, req *request.Request) *response.HandlerError {
+		s := m.Get(req)
+		lastID = s.ID()
+		require.NoError(t, s.Destroy())
+		return ok(w)
+	})
+	assert.Contains(t, out, "set-cookie: session=; Path=/; Max-Age=0; HttpOnly; SameSite=Lax\r\n")
+	_, err = store.Load(lastID)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestEncryptedSessions(t *testing.T) {
+	s, err := NewFileStore(t.TempDir())
+	require.NoError(t, err)
+	codec, err := NewEncryptedCodec(bytes.Repeat([]byte("k"), 32))
+	require.NoError(t, err)
+	m, err := NewManager(s, codec, WithCookie(cookies.Cookie{Name: "sid", Path: "/app", Secure: true, HttpOnly: true}))
+	require.NoError(t, err)
+
+	// Test: The encrypted cookie does not reveal the ID and round trips
+	var id string
+	out := serve(t, m, "", func(w *response.Writer, req *request.Request) *response.HandlerError {
+		sess := m.Get(req)
+		id = sess.ID()
+		require.NoError(t, sess.Save())
+		return ok(w)
+	})
+	cookie := sessionCookie(t, out)
+	assert.True(t, strings.HasPrefix(cookie, "sid="))
+	assert.NotContains(t, cookie, id)
+	assert.Contains(t, out, "; Path=/app; Max-Age=86400; Secure; HttpOnly\r\n")
+	serve(t, m, cookie, func(w *response.Writer, req *request.Request) *response.HandlerError {
+		assert.Equal(t, id, m.Get(req).ID())
+		return ok(w)
+	})
+}
+
+// plainCodec stores the ID as is, or the configured value when it is set.
+type plainCodec struct {
+	value string
+	err   error
+}
+
+func (c plainCodec) Encode(name string, value []byte) (string, error) {
+	if c.value != "" {
+		return c.value, c.err
+	}
+	return string(value), c.err
+}
+
+func (c plainCodec) Decode(name, value string) ([]byte, error) {
+	return []byte(value), nil
+}
+
+func TestSessionCookieErrors(t *testing.T) {
+	store := NewMemoryStore(time.Minute)
+	defer store.Close()
+
+	// Test: Cookie templates that cannot be sent are rejected up front
+	for c, want := range map[cookies.Cookie]error{
+		{Name: "session", SameSite: cookies.SameSiteNone}: cookies.ErrInvalidAttribute,
+		{Name: "session", Partitioned: true}:              cookies.ErrInvalidAttribute,
+		{Name: "my session"}:                              cookies.ErrInvalidName,
+	} {
+		_, err := NewManager(store, plainCodec{}, WithCookie(c))
+		assert.ErrorIs(t, err, want, "%+v", c)
+	}
+
+	// Test: Save reports encoding failures and leaves the store and cookie alone
+	for _, codec := range []plainCodec{{err: ErrInvalidKey}, {value: "bad value;"}} {
+		m, err := NewManager(store, codec)
+		require.NoError(t, err)
+		out := serve(t, m, "", func(w *response.Writer, req *request.Request) *response.HandlerError {
+			sess := m.Get(req)
+			assert.Error(t, sess.Save())
+			_, err := store.Load(sess.ID())
+			assert.ErrorIs(t, err, ErrNotFound)
+			return ok(w)
+		})
+		assert.NotContains(t, out, "set-cookie")
+	}
+}
@@ -0,0 +1,214 @@
+package sessions
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store keeps session values on the server, keyed by session ID.
+type Store interface {
+	// Load returns the values saved for id, or ErrNotFound when the session
+	// does not exist or has expired.
+	Load(id string) (map[string]string, error)
+	Save(id string, values map[string]string, ttl time.Duration) error
+	Delete(id string) error
+}
+
+var ErrNotFound = errors.New("session not found")
+
+type entry struct {
+	Values  map[string]string `json:"values"`
+	Expires time.Time         `json:"expires"`
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+// MemoryStore keeps sessions in process memory. Expired sessions are never
+// returned and are evicted by a background sweep.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]entry
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// NewMemoryStore creates a store that sweeps expired sessions every interval.
+// Close stops the sweep.
+func NewMemoryStore(interval time.Duration) *MemoryStore {
+	s := &MemoryStore{
+		entries: make(map[string]entry),
+		stop:    make(chan struct{}),
+	}
+	go s.sweep(interval)
+	return s
+}
+
+func (s *MemoryStore) Load(id string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[id]
+	if !ok || e.expired(time.Now()) {
+		return nil, ErrNotFound
+	}
+	return copyValues(e.Values), nil
+}
+
+func (s *MemoryStore) Save(id string, values map[string]string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[id] = entry{Values: copyValues(values), Expires: expiry(ttl)}
+	return nil
+}
+
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, id)
+	return nil
+}
+
+func (s *MemoryStore) Close() {
+	s.once.Do(func() { close(s.stop) })
+}
+
+func (s *MemoryStore) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.evict(now)
+		}
+	}
+}
+
+func (s *MemoryStore) evict(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, e := range s.entries {
+		if e.expired(now) {
+			delete(s.entries, id)
+		}
+	}
+}
+
+// FileStore keeps each session in its own JSON file inside a directory, so
+// sessions survive restarts of the process.
+type FileStore struct {
+	dir string
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) Load(id string) (map[string]string, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var e entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	if e.expired(time.Now()) {
+		os.Remove(path)
+		return nil, ErrNotFound
+	}
+	return e.Values, nil
+}
+
+// Save writes through a temporary file so a crash never leaves a truncated
+// session behind.
+func (s *FileStore) Save(id string, values map[string]string, ttl time.Duration) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry{Values: values, Expires: expiry(ttl)})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".session-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *FileStore) Delete(id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Prune removes every expired session file.
+func (s *FileStore) Prune() error {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		id := strings.TrimSuffix(filepath.Base(file), ".json")
+		if _, err := s.Load(id); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// path maps id to its file, refusing anything that is not a generated ID so
+// a forged value cannot escape the directory.
+func (s *FileStore) path(id string) (string, error) {
+	if !validID(id) {
+		return "", ErrNotFound
+	}
+	return filepath.Join(s.dir, id+".json"), nil
+}
+
+func expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+func copyValues(values map[string]string) map[string]string {
+	c := make(map[string]string, len(values))
+	for k, v := range values {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,91 @@
+package sessions
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testStore(t *testing.T, s Store) {
+	id, err := newID()
+	require.NoError(t, err)
+
+	// Test: Unknown session
+	_, err = s.Load(id)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// Test: Save and load
+	require.NoError(t, s.Save(id, map[string]string{"user": "alex"}, time.Hour))
+	values, err := s.Load(id)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"user": "alex"}, values)
+
+	// Test: Delete
+	require.NoError(t, s.Delete(id))
+	_, err = s.Load(id)
+	assert.ErrorIs(t, err, ErrNotFound)
+	require.NoError(t, s.Delete(id))
+
+	// Test: Expired sessions are not returned
+	require.NoError(t, s.Save(id, map[string]string{"user": "alex"}, time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	_, err = s.Load(id)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore(time.Millisecond)
+	defer s.Close()
+	testStore(t, s)
+
+	// Test: Values are copied in and out
+	values := map[string]string{"a": "1"}
+	require.NoError(t, s.Save("x", values, time.Hour))
+	values["a"] = "2"
+	loaded, err := s.Load("x")
+	require.NoError(t, err)
+	assert.Equal(t, "1", loaded["a"])
+
+	// Test: Background eviction
+	require.NoError(t, s.Save("y", nil, time.Millisecond))
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		_, ok := s.entries["y"]
+		return !ok
+	}, time.Second, time.Millisecond)
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStore(dir)
+	require.NoError(t, err)
+	testStore(t, s)
+
+	// Test: Survives a new store instance
+	id, _ := newID()
+	require.NoError(t, s.Save(id, map[string]string{"k": "v"}, time.Hour))
+	reopened, err := NewFileStore(dir)
+	require.NoError(t, err)
+	values, err := reopened.Load(id)
+	require.NoError(t, err)
+	assert.Equal(t, "v", values["k"])
+
+	// Test: Forged IDs cannot reach outside the directory
+	_, err = s.Load("../../etc/passwd")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// Test: Prune removes expired files only
+	expired, _ := newID()
+	require.NoError(t, s.Save(expired, nil, time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, s.Prune())
+	_, err = os.Stat(filepath.Join(dir, expired+".json"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat(filepath.Join(dir, id+".json"))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,217 @@
+package sse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/alexmarian/httpfromtcp/internal/headers"
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/alexmarian/httpfromtcp/internal/response"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ContentType = "text/event-stream"
+
+// DefaultKeepAlive is how often a comment is sent on an idle stream.
+const DefaultKeepAlive = 15 * time.Second
+
+var (
+	ErrInvalidField = errors.New("invalid event field")
+	ErrClosed       = errors.New("event stream closed")
+)
+
+// Event is a single server-sent event. Empty fields are omitted; Data may span
+// several lines.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	Retry time.Duration
+}
+
+type config struct {
+	keepAlive time.Duration
+}
+
+type Option func(*config)
+
+// WithKeepAlive sets the keepalive interval. Zero disables keepalives.
+func WithKeepAlive(interval time.Duration) Option {
+	return func(c *config) {
+		c.keepAlive = interval
+	}
+}
+
+// Stream writes a text/event-stream response. Every event is sent as its own
+// chunk, so it reaches the client at once. Send may be called from several
+// goroutines.
+type Stream struct {
+	w   *response.Writer
+	ctx context.Context
+
+	mu     sync.Mutex
+	err    error
+	closed bool
+
+	done     chan struct{}
+	doneOnce sync.Once
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+// NewStream writes the response headers for req and starts sending keepalive
+// comments. The handler must call Close before returning.
+func NewStream(w *response.Writer, req *request.Request, opts ...Option) (*Stream, error) {
+	cfg := config{keepAlive: DefaultKeepAlive}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	h := headers.NewHeaders()
+	h.Set(headers.ContentTypeHeader, ContentType)
+	h.Set("Cache-Control", "no-cache")
+	h.Set(headers.TransferEncodingHeader, "chunked")
+	if err := w.WriteStatusLine(response.SUCCESS); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	if req != nil {
+		ctx = req.Context()
+	}
+	s := &Stream{
+		w:       w,
+		ctx:     ctx,
+		done:    make(chan struct{}),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go s.keepAlive(cfg.keepAlive)
+	return s, nil
+}
+
+// Done is closed once the client is gone, detected by a failed write or by the
+// cancellation of the request's context. The context also covers responses
+// whose writes never fail, such as the body-less answer to HEAD.
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the write error or context cause that closed Done.
+func (s *Stream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Send writes e as one chunk.
+func (s *Stream) Send(e Event) error {
+	if strings.ContainsAny(e.ID, "\r\n\x00") || strings.ContainsAny(e.Event, "\r\n") {
+		return ErrInvalidField
+	}
+	b := strings.Builder{}
+	if e.ID != "" {
+		b.WriteString("id: " + e.ID + "\n")
+	}
+	if e.Event != "" {
+		b.WriteString("event: " + e.Event + "\n")
+	}
+	if e.Retry > 0 {
+		fmt.Fprintf(&b, "retry: %d\n", e.Retry.Milliseconds())
+	}
+	if e.Data != "" || (e.ID == "" && e.Event == "" && e.Retry == 0) {
+		for _, line := range splitLines(e.Data) {
+			b.WriteString("data: " + line + "\n")
+		}
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// Comment writes a comment line, which clients ignore.
+func (s *Stream) Comment(text string) error {
+	b := strings.Builder{}
+	for _, line := range splitLines(text) {
+		b.WriteString(": " + line + "\n")
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+func (s *Stream) write(data string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if s.closed {
+		return ErrClosed
+	}
+	if _, err := s.w.WriteChunkedBody([]byte(data)); err != nil {
+		s.fail(err)
+		return err
+	}
+	return nil
+}
+
+// fail records err and closes Done. Called with s.mu held.
+func (s *Stream) fail(err error) {
+	s.err = err
+	s.doneOnce.Do(func() { close(s.done) })
+}
+
+// Close stops the keepalives and ends the response body.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+	close(s.stop)
+	<-s.stopped
+	if s.Err() != nil {
+		return nil
+	}
+	_, err := s.w.WriteChunkedBodyDone()
+	return err
+}
+
+func (s *Stream) keepAlive(interval time.Duration) {
+	defer close(s.stopped)
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.ctx.Done():
+			s.mu.Lock()
+			if s.err == nil {
+				s.fail(context.Cause(s.ctx))
+			}
+			s.mu.Unlock()
+			return
+		case <-tick:
+			if err := s.Comment("keepalive"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// splitLines splits on any of the line endings the event stream format
+// recognizes, so data cannot inject fields.
+func splitLines(s string) []string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	return strings.Split(s, "\n")
+}
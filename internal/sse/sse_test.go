@@ -0,0 +1,146 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/alexmarian/httpfromtcp/internal/response"
+	"github.com/alexmarian/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncoding(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	s, err := NewStream(w, nil, WithKeepAlive(0))
+	require.NoError(t, err)
+
+	// Test: All fields, multi-line data and comments
+	require.NoError(t, s.Send(Event{ID: "7", Event: "progress", Data: "line one\r\nline two\rthree", Retry: 2 * time.Second}))
+	require.NoError(t, s.Send(Event{Data: "plain"}))
+	require.NoError(t, s.Comment("hi"))
+
+	// Test: Fields that would break framing
+	assert.ErrorIs(t, s.Send(Event{ID: "1\n2"}), ErrInvalidField)
+	assert.ErrorIs(t, s.Send(Event{Event: "a\rb"}), ErrInvalidField)
+
+	require.NoError(t, s.Close())
+	assert.ErrorIs(t, s.Send(Event{Data: "late"}), ErrClosed)
+	require.NoError(t, w.Finish())
+
+	out := buf.String()
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "content-type: text/event-stream\r\n")
+	assert.Contains(t, out, "cache-control: no-cache\r\n")
+	assert.Contains(t, out, "transfer-encoding: chunked\r\n")
+	_, body, found := strings.Cut(out, "\r\n\r\n")
+	require.True(t, found)
+	assert.Equal(t, "id: 7\nevent: progress\nretry: 2000\ndata: line one\ndata: line two\ndata: three\n\ndata: plain\n\n: hi\n\n",
+		dechunk(t, body))
+}
+
+func TestStream(t *testing.T) {
+	lastEventID := make(chan string, 1)
+	handler := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		lastEventID <- req.LastEventID()
+		s, err := NewStream(w, req, WithKeepAlive(20*time.Millisecond))
+		if err != nil {
+			return &response.HandlerError{StatusCode: response.INTERNAL_SERVER_ERROR, Message: err.Error()}
+		}
+		defer s.Close()
+		s.Send(Event{ID: "43", Data: "resumed"})
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	}
+	srv, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Test: Events, keepalives and Last-Event-ID
+	_, err = io.WriteString(conn, "GET /events HTTP/1.1\r\nHost: localhost\r\nLast-Event-ID: 42\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	out, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "42", <-lastEventID)
+	_, body, _ := strings.Cut(string(out), "\r\n\r\n")
+	events := dechunk(t, body)
+	assert.True(t, strings.HasPrefix(events, "id: 43\ndata: resumed\n\n: keepalive\n\n"), events)
+}
+
+func TestDisconnect(t *testing.T) {
+	stopped := make(chan error, 1)
+	handler := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		keepAlive := 10 * time.Millisecond
+		if req.RequestLine.Method == "HEAD" {
+			keepAlive = 0
+		}
+		s, err := NewStream(w, req, WithKeepAlive(keepAlive))
+		if err != nil {
+			return &response.HandlerError{StatusCode: response.INTERNAL_SERVER_ERROR, Message: err.Error()}
+		}
+		defer s.Close()
+		select {
+		case <-s.Done():
+			stopped <- s.Err()
+		case <-time.After(5 * time.Second):
+			stopped <- nil
+		}
+		return nil
+	}
+	srv, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+
+	// Test: Done closes after the client goes away
+	_, err = io.WriteString(conn, "GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	conn.Close()
+	assert.Error(t, <-stopped)
+
+	// Test: Done closes for HEAD, whose writes never fail, once the context ends
+	conn, err = net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	_, err = io.WriteString(conn, "HEAD /events HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	conn.Close()
+	assert.ErrorIs(t, <-stopped, server.ErrClientDisconnected)
+}
+
+// dechunk decodes a complete chunked body.
+func dechunk(t *testing.T, body string) string {
+	t.Helper()
+	out := strings.Builder{}
+	r := bufio.NewReader(strings.NewReader(body))
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		var size int
+		_, err = fmt.Sscanf(strings.TrimSpace(line), "%x", &size)
+		require.NoError(t, err)
+		if size == 0 {
+			return out.String()
+		}
+		chunk := make([]byte, size+2)
+		_, err = io.ReadFull(r, chunk)
+		require.NoError(t, err)
+		out.Write(chunk[:size])
+	}
+}
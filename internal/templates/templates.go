@@ -0,0 +1,201 @@
+package templates
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/alexmarian/httpfromtcp/internal/headers"
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/alexmarian/httpfromtcp/internal/response"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+)
+
+const htmlContentType = "text/html; charset=utf-8"
+
+// Templates parses every .html file of a file system into one set, so pages
+// can share layouts and partials. Each template is named after its path
+// relative to the root, such as "layout.html" or "pages/home.html".
+type Templates struct {
+	fsys  fs.FS
+	funcs template.FuncMap
+	dev   bool
+
+	mu      sync.Mutex
+	set     *template.Template
+	version version
+}
+
+// version summarizes the template files so dev mode can tell when they change.
+type version struct {
+	files   int
+	size    int64
+	modTime time.Time
+}
+
+type Option func(*Templates)
+
+// WithDevMode re-parses the templates before rendering whenever a file was
+// added, removed or modified, so edits show up without a restart.
+func WithDevMode() Option {
+	return func(t *Templates) {
+		t.dev = true
+	}
+}
+
+// WithFuncs makes funcs available to every template.
+func WithFuncs(funcs template.FuncMap) Option {
+	return func(t *Templates) {
+		for name, f := range funcs {
+			t.funcs[name] = f
+		}
+	}
+}
+
+// New parses the templates in fsys, failing on the first syntax error.
+func New(fsys fs.FS, opts ...Option) (*Templates, error) {
+	t := &Templates{
+		fsys:  fsys,
+		funcs: template.FuncMap{},
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// RequestInfo is the part of the request exposed to templates.
+type RequestInfo struct {
+	ID      string
+	Method  string
+	Target  string
+	Path    string
+	Query   url.Values
+	Host    string
+	Headers headers.Headers
+}
+
+// Context is the value templates are executed with: the request as .Request
+// and the handler's data as .Data.
+type Context struct {
+	Request RequestInfo
+	Data    any
+}
+
+func NewContext(req *request.Request, data any) Context {
+	ctx := Context{Data: data}
+	if req == nil {
+		return ctx
+	}
+	ctx.Request = RequestInfo{
+		ID:      req.ID,
+		Method:  req.RequestLine.Method,
+		Target:  req.RequestLine.RequestTarget,
+		Path:    req.RequestLine.RequestTarget,
+		Host:    req.Host,
+		Headers: req.Headers,
+	}
+	if u, err := url.ParseRequestURI(req.RequestLine.RequestTarget); err == nil {
+		ctx.Request.Path = u.Path
+		ctx.Request.Query = u.Query()
+	}
+	return ctx
+}
+
+// Render executes the template name with data and the request, then writes
+// the result with code. The page is rendered in full before anything is
+// written, so a failing template still gets a clean error response.
+func (t *Templates) Render(w *response.Writer, req *request.Request, code response.StatusCode, name string, data any) *response.HandlerError {
+	set, err := t.templates()
+	if err != nil {
+		return &response.HandlerError{StatusCode: response.INTERNAL_SERVER_ERROR, Message: err.Error()}
+	}
+	body := bytes.Buffer{}
+	if err := set.ExecuteTemplate(&body, name, NewContext(req, data)); err != nil {
+		log.Printf("Error rendering template %s: %v", name, err)
+		return &response.HandlerError{StatusCode: response.INTERNAL_SERVER_ERROR, Message: "Failed to render page"}
+	}
+	if err := w.WriteContent(code, htmlContentType, body.Bytes()); err != nil {
+		log.Printf("Error writing template %s: %v", name, err)
+	}
+	return nil
+}
+
+// templates returns the current set, reloading it first in dev mode when the
+// files changed.
+func (t *Templates) templates() (*template.Template, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.dev {
+		v, err := t.currentVersion()
+		if err != nil {
+			return nil, err
+		}
+		if v != t.version {
+			if err := t.parse(v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return t.set, nil
+}
+
+func (t *Templates) load() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v, err := t.currentVersion()
+	if err != nil {
+		return err
+	}
+	return t.parse(v)
+}
+
+func (t *Templates) parse(v version) error {
+	set := template.New("").Funcs(t.funcs)
+	err := fs.WalkDir(t.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || path.Ext(name) != ".html" {
+			return err
+		}
+		content, err := fs.ReadFile(t.fsys, name)
+		if err != nil {
+			return err
+		}
+		if _, err := set.New(name).Parse(string(content)); err != nil {
+			return fmt.Errorf("parsing template %s: %w", name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	t.set = set
+	t.version = v
+	return nil
+}
+
+func (t *Templates) currentVersion() (version, error) {
+	v := version{}
+	err := fs.WalkDir(t.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || path.Ext(name) != ".html" {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		v.files++
+		v.size += info.Size()
+		if info.ModTime().After(v.modTime) {
+			v.modTime = info.ModTime()
+		}
+		return nil
+	})
+	return v, err
+}
@@ -0,0 +1,95 @@
+package templates
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/alexmarian/httpfromtcp/internal/response"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRequest(t *testing.T, target string) *request.Request {
+	req, err := request.RequestFromReader(strings.NewReader("GET " + target + " HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	require.NoError(t, err)
+	req.ID = "req-1"
+	return req
+}
+
+func TestRender(t *testing.T) {
+	fsys := fstest.MapFS{
+		"layout.html":     {Data: []byte(`<main>{{block "content" .}}{{end}}</main>`)},
+		"pages/home.html": {Data: []byte(`{{template "layout.html" .}}{{define "content"}}{{upper .Data.Name}} {{.Request.Method}} {{.Request.Path}} {{index .Request.Query "q" }} {{.Request.Host}} {{.Request.ID}}{{end}}`)},
+		"broken.html":     {Data: []byte(`{{index .Data 5}}`)},
+		"notes.txt":       {Data: []byte(`{{ not a template`)},
+	}
+	tmpls, err := New(fsys, WithFuncs(template.FuncMap{"upper": strings.ToUpper}))
+	require.NoError(t, err)
+
+	// Test: Layout, functions, data and request info, with Content-Length
+	buf := &bytes.Buffer{}
+	hErr := tmpls.Render(response.NewWriter(buf), newRequest(t, "/home?q=<x>"), response.SUCCESS, "pages/home.html",
+		map[string]string{"Name": "alex"})
+	require.Nil(t, hErr)
+	out := buf.String()
+	body := "<main>ALEX GET /home [&lt;x&gt;] example.com req-1</main>"
+	assert.True(t, strings.HasPrefix(out, "HTTP/1.1 200 OK\r\n"))
+	assert.Contains(t, out, "content-type: text/html; charset=utf-8\r\n")
+	assert.Contains(t, out, fmt.Sprintf("content-length: %d\r\n", len(body)))
+	assert.True(t, strings.HasSuffix(out, "\r\n\r\n"+body))
+
+	// Test: Execution errors leave the response unstarted
+	w := response.NewWriter(&bytes.Buffer{})
+	hErr = tmpls.Render(w, newRequest(t, "/"), response.SUCCESS, "broken.html", map[string]any{})
+	require.NotNil(t, hErr)
+	assert.Equal(t, response.INTERNAL_SERVER_ERROR, hErr.StatusCode)
+	assert.False(t, w.Started())
+
+	// Test: Unknown template
+	hErr = tmpls.Render(response.NewWriter(&bytes.Buffer{}), nil, response.SUCCESS, "missing.html", nil)
+	require.NotNil(t, hErr)
+
+	// Test: Syntax errors fail loading
+	_, err = New(fstest.MapFS{"bad.html": {Data: []byte(`{{if}}`)}})
+	assert.ErrorContains(t, err, "bad.html")
+}
+
+func TestDevMode(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "page.html")
+	write := func(content string, modTime time.Time) {
+		require.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+		require.NoError(t, os.Chtimes(file, modTime, modTime))
+	}
+	render := func(tmpls *Templates) string {
+		buf := &bytes.Buffer{}
+		require.Nil(t, tmpls.Render(response.NewWriter(buf), nil, response.SUCCESS, "page.html", nil))
+		return buf.String()
+	}
+	start := time.Now()
+	write("v1", start)
+
+	cached, err := New(os.DirFS(dir))
+	require.NoError(t, err)
+	dev, err := New(os.DirFS(dir), WithDevMode())
+	require.NoError(t, err)
+
+	// Test: Dev mode picks up edits, the cached set does not
+	write("v2", start.Add(time.Second))
+	assert.True(t, strings.HasSuffix(render(dev), "v2"))
+	assert.True(t, strings.HasSuffix(render(cached), "v1"))
+
+	// Test: New files are found, broken edits surface as errors
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "other.html"), []byte("{{if}}"), 0o600))
+	hErr := dev.Render(response.NewWriter(&bytes.Buffer{}), nil, response.SUCCESS, "page.html", nil)
+	require.NotNil(t, hErr)
+	assert.Contains(t, hErr.Message, "other.html")
+}
@@ -0,0 +1,44 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+)
+
+// deflateTail is the empty stored block a sync flush ends with, which
+// permessage-deflate strips from every message (RFC 7692 section 7.2.1).
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// compress deflates a whole message. Contexts are never taken over between
+// messages, which is what the negotiated no_context_takeover parameters allow.
+func compress(payload []byte) ([]byte, error) {
+	buf := bytes.Buffer{}
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail), nil
+}
+
+// decompress inflates a message, failing with ErrReadLimit rather than
+// producing more than limit bytes.
+func decompress(payload []byte, limit int64) ([]byte, error) {
+	fr := flate.NewReader(io.MultiReader(bytes.NewReader(payload), bytes.NewReader(deflateTail)))
+	defer fr.Close()
+	data, err := io.ReadAll(io.LimitReader(fr, limit+1))
+	// the tail is a sync flush, not a final block, so the stream ends early
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, ErrReadLimit
+	}
+	return data, nil
+}
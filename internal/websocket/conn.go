@@ -0,0 +1,322 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type MessageType int
+
+const (
+	TextMessage   MessageType = MessageType(opText)
+	BinaryMessage MessageType = MessageType(opBinary)
+)
+
+// Close codes from RFC 6455 section 7.4.1.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseAbnormal        = 1006
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+var (
+	ErrReadLimit = errors.New("websocket message exceeds read limit")
+	ErrClosed    = errors.New("websocket connection closed")
+)
+
+// CloseError is returned by ReadMessage once the peer sent a close frame.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+// Conn is an established WebSocket connection. Any number of goroutines may
+// write and close concurrently, while messages are read by one goroutine at a
+// time. Reading answers pings and close frames automatically.
+type Conn struct {
+	conn     net.Conn
+	reader   io.Reader
+	server   bool
+	compress bool
+	limit    int64
+
+	// writeMu serializes frames, messageMu keeps fragmented messages whole
+	// while still letting control frames through between fragments.
+	writeMu   sync.Mutex
+	messageMu sync.Mutex
+	closeSent bool
+
+	closeOnce sync.Once
+}
+
+func newConn(conn net.Conn, reader io.Reader, server, compress bool, limit int64) *Conn {
+	if reader == nil {
+		reader = bufio.NewReader(conn)
+	}
+	return &Conn{
+		conn:     conn,
+		reader:   reader,
+		server:   server,
+		compress: compress,
+		limit:    limit,
+	}
+}
+
+// Compressed reports whether permessage-deflate was negotiated.
+func (c *Conn) Compressed() bool {
+	return c.compress
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetReadDeadline bounds how long ReadMessage waits, which is also how idle
+// connections are detected.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// ReadMessage returns the next data message, reassembling fragments. A
+// *CloseError is returned after the peer closed the connection; protocol
+// violations close it with the matching code.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	var (
+		messageType MessageType
+		compressed  bool
+		message     []byte
+		started     bool
+	)
+	for {
+		f, err := readFrame(c.reader, c.server, c.limit-int64(len(message)))
+		if err != nil {
+			return 0, nil, c.failRead(err)
+		}
+		if f.rsv1 && (!c.compress || f.opcode.isControl() || f.opcode == opContinuation) {
+			return 0, nil, c.failRead(fmt.Errorf("%w: unexpected RSV1", ErrProtocol))
+		}
+		switch f.opcode {
+		case opPing:
+			if err := c.writeFrame(&frame{fin: true, opcode: opPong, payload: f.payload}); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return 0, nil, c.handleClose(f.payload)
+		case opText, opBinary:
+			if started {
+				return 0, nil, c.failRead(fmt.Errorf("%w: new message inside a fragmented one", ErrProtocol))
+			}
+			started = true
+			messageType = MessageType(f.opcode)
+			compressed = f.rsv1
+		case opContinuation:
+			if !started {
+				return 0, nil, c.failRead(fmt.Errorf("%w: continuation without a message", ErrProtocol))
+			}
+		}
+		message = append(message, f.payload...)
+		if !f.fin {
+			continue
+		}
+		if compressed {
+			if message, err = decompress(message, c.limit); err != nil {
+				if !errors.Is(err, ErrReadLimit) {
+					err = fmt.Errorf("%w: %w", ErrProtocol, err)
+				}
+				return 0, nil, c.failRead(err)
+			}
+		}
+		if messageType == TextMessage && !utf8.Valid(message) {
+			return 0, nil, c.failWith(CloseInvalidPayload, "invalid UTF-8", errors.New("websocket text message is not UTF-8"))
+		}
+		return messageType, message, nil
+	}
+}
+
+func (c *Conn) failRead(err error) error {
+	switch {
+	case errors.Is(err, ErrReadLimit):
+		return c.failWith(CloseMessageTooBig, "message too big", err)
+	case errors.Is(err, ErrProtocol):
+		return c.failWith(CloseProtocolError, "protocol error", err)
+	default:
+		return err
+	}
+}
+
+// failWith sends a close frame for a violation and drops the connection.
+func (c *Conn) failWith(code int, reason string, err error) error {
+	c.WriteClose(code, reason)
+	c.closeConn()
+	return err
+}
+
+func (c *Conn) handleClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatus}
+	switch {
+	case len(payload) == 1:
+		return c.failRead(fmt.Errorf("%w: truncated close frame", ErrProtocol))
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !validCloseCode(closeErr.Code) || !utf8.ValidString(closeErr.Reason) {
+			return c.failRead(fmt.Errorf("%w: invalid close frame", ErrProtocol))
+		}
+	}
+	// Echo the status code to complete the closing handshake.
+	code := closeErr.Code
+	if code == CloseNoStatus {
+		code = CloseNormal
+	}
+	c.WriteClose(code, "")
+	if c.server {
+		c.closeConn()
+	}
+	return closeErr
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011, code >= 3000 && code <= 4999:
+		return true
+	default:
+		return false
+	}
+}
+
+// WriteMessage sends data as a single frame, compressed when permessage-deflate
+// was negotiated.
+func (c *Conn) WriteMessage(messageType MessageType, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("invalid message type %d", messageType)
+	}
+	c.messageMu.Lock()
+	defer c.messageMu.Unlock()
+	f := &frame{fin: true, opcode: opcode(messageType), payload: data}
+	if c.compress {
+		compressed, err := compress(data)
+		if err != nil {
+			return err
+		}
+		f.payload, f.rsv1 = compressed, true
+	}
+	return c.writeFrame(f)
+}
+
+// NextWriter returns a writer that sends every Write as a fragment of one
+// message and the final fragment on Close. Fragments are not compressed.
+// Other data messages wait until the writer is closed.
+func (c *Conn) NextWriter(messageType MessageType) (io.WriteCloser, error) {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return nil, fmt.Errorf("invalid message type %d", messageType)
+	}
+	c.messageMu.Lock()
+	return &messageWriter{conn: c, opcode: opcode(messageType)}, nil
+}
+
+type messageWriter struct {
+	conn   *Conn
+	opcode opcode
+	closed bool
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrClosed
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := w.conn.writeFrame(&frame{opcode: w.opcode, payload: p}); err != nil {
+		return 0, err
+	}
+	w.opcode = opContinuation
+	return len(p), nil
+}
+
+func (w *messageWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.conn.messageMu.Unlock()
+	return w.conn.writeFrame(&frame{fin: true, opcode: w.opcode})
+}
+
+// Ping sends a ping; the pong is consumed by ReadMessage.
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return fmt.Errorf("ping payload over %d bytes", maxControlPayload)
+	}
+	return c.writeFrame(&frame{fin: true, opcode: opPing, payload: data})
+}
+
+// WriteClose starts the closing handshake. The peer answers with its own close
+// frame, which ReadMessage reports as a *CloseError.
+func (c *Conn) WriteClose(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > maxControlPayload {
+		payload = payload[:maxControlPayload]
+	}
+	return c.writeFrame(&frame{fin: true, opcode: opClose, payload: payload})
+}
+
+// Close sends a normal close frame unless one was sent already and closes the
+// underlying connection. For a clean shutdown call WriteClose instead and keep
+// reading until ReadMessage returns the peer's *CloseError.
+func (c *Conn) Close() error {
+	if err := c.WriteClose(CloseNormal, ""); err != nil && !errors.Is(err, ErrClosed) {
+		c.closeConn()
+		return err
+	}
+	c.closeConn()
+	return nil
+}
+
+func (c *Conn) closeConn() {
+	c.closeOnce.Do(func() {
+		c.conn.Close()
+	})
+}
+
+func (c *Conn) writeFrame(f *frame) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	if f.opcode == opClose {
+		c.closeSent = true
+	}
+	var key [4]byte
+	if !c.server {
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+	}
+	_, err := c.conn.Write(appendFrame(nil, f, !c.server, key))
+	return err
+}
@@ -0,0 +1,149 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type opcode byte
+
+const (
+	opContinuation opcode = 0x0
+	opText         opcode = 0x1
+	opBinary       opcode = 0x2
+	opClose        opcode = 0x8
+	opPing         opcode = 0x9
+	opPong         opcode = 0xa
+)
+
+func (op opcode) isControl() bool {
+	return op&0x8 != 0
+}
+
+const (
+	finBit  = 0x80
+	rsv1Bit = 0x40
+	rsvBits = 0x70
+	maskBit = 0x80
+
+	maxControlPayload = 125
+)
+
+var ErrProtocol = errors.New("websocket protocol error")
+
+// frame is a single RFC 6455 frame with its payload already unmasked.
+type frame struct {
+	fin     bool
+	rsv1    bool
+	opcode  opcode
+	payload []byte
+}
+
+// readFrame reads one frame. Client frames must be masked and server frames
+// must not; limit bounds the payload length.
+func readFrame(r io.Reader, expectMasked bool, limit int64) (*frame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	f := &frame{
+		fin:    head[0]&finBit != 0,
+		rsv1:   head[0]&rsv1Bit != 0,
+		opcode: opcode(head[0] & 0x0f),
+	}
+	if head[0]&(rsvBits&^rsv1Bit) != 0 {
+		return nil, fmt.Errorf("%w: reserved bits set", ErrProtocol)
+	}
+	switch f.opcode {
+	case opContinuation, opText, opBinary, opClose, opPing, opPong:
+	default:
+		return nil, fmt.Errorf("%w: unknown opcode %#x", ErrProtocol, f.opcode)
+	}
+	masked := head[1]&maskBit != 0
+	if masked != expectMasked {
+		return nil, fmt.Errorf("%w: unexpected masking", ErrProtocol)
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return nil, fmt.Errorf("%w: invalid payload length", ErrProtocol)
+		}
+	}
+	if f.opcode.isControl() && (length > maxControlPayload || !f.fin) {
+		return nil, fmt.Errorf("%w: invalid control frame", ErrProtocol)
+	}
+	if !f.opcode.isControl() && length > uint64(limit) {
+		return nil, ErrReadLimit
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return nil, err
+		}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+	if masked {
+		maskBytes(key, f.payload)
+	}
+	return f, nil
+}
+
+// appendFrame appends the encoded frame to b, masking the payload with key
+// when mask is set.
+func appendFrame(b []byte, f *frame, mask bool, key [4]byte) []byte {
+	b0 := byte(f.opcode)
+	if f.fin {
+		b0 |= finBit
+	}
+	if f.rsv1 {
+		b0 |= rsv1Bit
+	}
+	var b1 byte
+	if mask {
+		b1 = maskBit
+	}
+	length := len(f.payload)
+	switch {
+	case length < 126:
+		b = append(b, b0, b1|byte(length))
+	case length <= 0xffff:
+		b = append(b, b0, b1|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(length))
+	default:
+		b = append(b, b0, b1|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(length))
+	}
+	if !mask {
+		return append(b, f.payload...)
+	}
+	b = append(b, key[:]...)
+	start := len(b)
+	b = append(b, f.payload...)
+	maskBytes(key, b[start:])
+	return b
+}
+
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i&3]
+	}
+}
@@ -0,0 +1,186 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"github.com/alexmarian/httpfromtcp/internal/headers"
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/alexmarian/httpfromtcp/internal/response"
+	"io"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+const (
+	UpgradeHeader    = "Upgrade"
+	KeyHeader        = "Sec-WebSocket-Key"
+	AcceptHeader     = "Sec-WebSocket-Accept"
+	VersionHeader    = "Sec-WebSocket-Version"
+	ProtocolHeader   = "Sec-WebSocket-Protocol"
+	ExtensionsHeader = "Sec-WebSocket-Extensions"
+	OriginHeader     = "Origin"
+
+	acceptGUID         = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	supportedVersion   = "13"
+	deflateExtension   = "permessage-deflate"
+	deflateAgreedParam = "permessage-deflate; server_no_context_takeover; client_no_context_takeover"
+)
+
+// DefaultReadLimit is the largest message a Conn accepts unless
+// Upgrader.ReadLimit says otherwise.
+const DefaultReadLimit = 1 << 20
+
+// Upgrader performs the opening handshake of RFC 6455 section 4.2.
+type Upgrader struct {
+	// Subprotocols lists the supported subprotocols by preference. The first
+	// one the client also offers is selected.
+	Subprotocols []string
+	// EnableCompression negotiates permessage-deflate (RFC 7692) when the
+	// client offers it.
+	EnableCompression bool
+	// ReadLimit bounds the size of a received message, after decompression.
+	ReadLimit int64
+	// CheckOrigin accepts or rejects the request. By default requests with an
+	// Origin header must come from the host they are addressed to.
+	CheckOrigin func(req *request.Request) bool
+}
+
+// Upgrade validates the handshake request, hijacks the connection and writes
+// the 101 response. The returned Conn belongs to the caller, who may serve it
+// from other goroutines after the handler returns and must close it. On
+// failure the returned HandlerError describes the response to send.
+func (u *Upgrader) Upgrade(w *response.Writer, req *request.Request) (*Conn, *response.HandlerError) {
+	if req.RequestLine.Method != "GET" || !req.ProtoAtLeast(1, 1) {
+		return nil, &response.HandlerError{StatusCode: response.BAD_REQUEST, Message: "WebSocket handshake requires GET over HTTP/1.1"}
+	}
+	if !headerHasToken(req.Headers, UpgradeHeader, "websocket") || !req.HasConnectionOption("upgrade") {
+		return nil, &response.HandlerError{StatusCode: response.UPGRADE_REQUIRED, Message: "Expected a WebSocket upgrade"}
+	}
+	if version, _ := req.Headers.Get(VersionHeader); version != supportedVersion {
+		return nil, &response.HandlerError{StatusCode: response.UPGRADE_REQUIRED, Message: "Unsupported WebSocket version, expected " + supportedVersion}
+	}
+	key, _ := req.Headers.Get(KeyHeader)
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, &response.HandlerError{StatusCode: response.BAD_REQUEST, Message: "Invalid Sec-WebSocket-Key"}
+	}
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(req) {
+		return nil, &response.HandlerError{StatusCode: response.FORBIDDEN, Message: "Origin not allowed"}
+	}
+	netConn, buffered, err := w.Hijack()
+	if err != nil {
+		return nil, &response.HandlerError{StatusCode: response.INTERNAL_SERVER_ERROR, Message: "Connection cannot be upgraded"}
+	}
+
+	h := headers.NewHeaders()
+	h.Set(UpgradeHeader, "websocket")
+	h.Set(headers.ConnectionHeader, "Upgrade")
+	h.Set(AcceptHeader, acceptKey(key))
+	if protocol := u.selectSubprotocol(req); protocol != "" {
+		h.Set(ProtocolHeader, protocol)
+	}
+	compress := u.EnableCompression && offersDeflate(req.Headers)
+	if compress {
+		h.Set(ExtensionsHeader, deflateAgreedParam)
+	}
+	// The server no longer manages the connection, so failures past this
+	// point can only be answered by closing it.
+	hw := response.NewWriter(netConn)
+	if err := hw.WriteStatusLine(response.SWITCHING_PROTOCOLS); err == nil {
+		err = hw.WriteHeaders(h)
+	}
+	if err != nil {
+		netConn.Close()
+		return nil, &response.HandlerError{StatusCode: response.INTERNAL_SERVER_ERROR, Message: err.Error()}
+	}
+	limit := u.ReadLimit
+	if limit <= 0 {
+		limit = DefaultReadLimit
+	}
+	var reader io.Reader = netConn
+	if len(buffered) > 0 {
+		reader = io.MultiReader(bytes.NewReader(buffered), netConn)
+	}
+	return newConn(netConn, bufio.NewReader(reader), true, compress, limit), nil
+}
+
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (u *Upgrader) selectSubprotocol(req *request.Request) string {
+	offered, ok := req.Headers.Get(ProtocolHeader)
+	if !ok {
+		return ""
+	}
+	var protocols []string
+	for _, p := range strings.Split(offered, ",") {
+		protocols = append(protocols, strings.TrimSpace(p))
+	}
+	for _, supported := range u.Subprotocols {
+		if slices.Contains(protocols, supported) {
+			return supported
+		}
+	}
+	return ""
+}
+
+// offersDeflate reports whether any permessage-deflate offer can be accepted
+// with a full 32K window, the only size compress/flate produces.
+func offersDeflate(h headers.Headers) bool {
+	value, ok := h.Get(ExtensionsHeader)
+	if !ok {
+		return false
+	}
+	for _, offer := range strings.Split(value, ",") {
+		params := strings.Split(offer, ";")
+		if strings.TrimSpace(params[0]) != deflateExtension {
+			continue
+		}
+		acceptable := true
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			switch name {
+			case "server_no_context_takeover", "client_no_context_takeover", "client_max_window_bits":
+			case "server_max_window_bits":
+				acceptable = acceptable && strings.Trim(value, `"`) == "15"
+			default:
+				acceptable = false
+			}
+		}
+		if acceptable {
+			return true
+		}
+	}
+	return false
+}
+
+func headerHasToken(h headers.Headers, name, token string) bool {
+	value, _ := h.Get(name)
+	for _, t := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameOrigin(req *request.Request) bool {
+	origin, ok := req.Headers.Get(OriginHeader)
+	if !ok {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	host, _ := req.Headers.Get(headers.HostHeader)
+	return strings.EqualFold(u.Host, host)
+}
@@ -0,0 +1,228 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexmarian/httpfromtcp/internal/request"
+	"github.com/alexmarian/httpfromtcp/internal/response"
+	"github.com/alexmarian/httpfromtcp/internal/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+// echoServer starts a server whose handler upgrades with u and echoes every
+// message until the connection closes.
+func echoServer(t *testing.T, u *Upgrader) string {
+	handler := func(w *response.Writer, req *request.Request) *response.HandlerError {
+		conn, hErr := u.Upgrade(w, req)
+		if hErr != nil {
+			return hErr
+		}
+		defer conn.Close()
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return nil
+			}
+			if err := conn.WriteMessage(messageType, data); err != nil {
+				return nil
+			}
+		}
+	}
+	s, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s.Addr().String()
+}
+
+// dial performs the client handshake with extra request headers and returns
+// the raw response head together with a client side Conn.
+func dial(t *testing.T, addr, extra string) (string, *Conn) {
+	netConn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { netConn.Close() })
+	netConn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = fmt.Fprintf(netConn, "GET /chat HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n%s\r\n", addr, testKey, extra)
+	require.NoError(t, err)
+	reader := bufio.NewReader(netConn)
+	head := strings.Builder{}
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		head.WriteString(line)
+		if line == "\r\n" {
+			break
+		}
+	}
+	compressed := strings.Contains(head.String(), "permessage-deflate")
+	return head.String(), newConn(netConn, reader, false, compressed, DefaultReadLimit)
+}
+
+func TestHandshake(t *testing.T) {
+	addr := echoServer(t, &Upgrader{Subprotocols: []string{"chat.v2", "chat.v1"}})
+
+	// Test: Accept key, subprotocol selection
+	head, _ := dial(t, addr, "Sec-WebSocket-Protocol: chat.v1, chat.v2\r\n")
+	assert.True(t, strings.HasPrefix(head, "HTTP/1.1 101 Switching Protocols\r\n"))
+	assert.Contains(t, head, "sec-websocket-accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n")
+	assert.Contains(t, head, "upgrade: websocket\r\n")
+	assert.Contains(t, head, "connection: Upgrade\r\n")
+	assert.Contains(t, head, "sec-websocket-protocol: chat.v2\r\n")
+	assert.NotContains(t, head, "sec-websocket-extensions")
+
+	// Test: Failed handshakes
+	cases := []struct {
+		name, raw, status string
+	}{
+		{"no upgrade", "GET / HTTP/1.1\r\nHost: x\r\n\r\n", "426"},
+		{"wrong version", "GET / HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: upgrade\r\nSec-WebSocket-Version: 8\r\nSec-WebSocket-Key: " + testKey + "\r\n\r\n", "426"},
+		{"bad key", "GET / HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: abc\r\n\r\n", "400"},
+		{"cross origin", "GET / HTTP/1.1\r\nHost: x\r\nOrigin: http://evil.example\r\nUpgrade: websocket\r\nConnection: upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: " + testKey + "\r\n\r\n", "403"},
+		{"post", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 0\r\nUpgrade: websocket\r\nConnection: upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: " + testKey + "\r\n\r\n", "400"},
+	}
+	for _, tc := range cases {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.WriteString(conn, strings.Replace(tc.raw, "Connection: upgrade", "Connection: keep-alive, upgrade", 1))
+		require.NoError(t, err)
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		require.NoError(t, err, tc.name)
+		assert.True(t, strings.HasPrefix(line, "HTTP/1.1 "+tc.status), tc.name+": "+line)
+		conn.Close()
+	}
+}
+
+func TestMessages(t *testing.T) {
+	addr := echoServer(t, &Upgrader{ReadLimit: 1024})
+	_, conn := dial(t, addr, "")
+
+	// Test: Text and binary echo, with a ping in between
+	require.NoError(t, conn.WriteMessage(TextMessage, []byte("hello")))
+	require.NoError(t, conn.Ping([]byte("are you there")))
+	require.NoError(t, conn.WriteMessage(BinaryMessage, []byte{0, 1, 2}))
+	messageType, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, messageType)
+	assert.Equal(t, "hello", string(data))
+	messageType, data, err = conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, BinaryMessage, messageType)
+	assert.Equal(t, []byte{0, 1, 2}, data)
+
+	// Test: Fragmented message
+	mw, err := conn.NextWriter(TextMessage)
+	require.NoError(t, err)
+	io.WriteString(mw, "frag")
+	io.WriteString(mw, "mented")
+	require.NoError(t, mw.Close())
+	_, data, err = conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "fragmented", string(data))
+
+	// Test: Large message using the 16-bit length
+	large := bytes.Repeat([]byte("x"), 1000)
+	require.NoError(t, conn.WriteMessage(BinaryMessage, large))
+	_, data, err = conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, large, data)
+
+	// Test: Concurrent writers keep messages whole
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn.WriteMessage(TextMessage, []byte(fmt.Sprintf("message-%d", i)))
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 10; i++ {
+		_, data, err = conn.ReadMessage()
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(string(data), "message-"))
+	}
+
+	// Test: Closing handshake
+	require.NoError(t, conn.WriteClose(CloseGoingAway, "bye"))
+	_, _, err = conn.ReadMessage()
+	var closeErr *CloseError
+	require.True(t, errors.As(err, &closeErr))
+	assert.Equal(t, CloseGoingAway, closeErr.Code)
+}
+
+func TestViolations(t *testing.T) {
+	addr := echoServer(t, &Upgrader{ReadLimit: 16})
+	expectClose := func(conn *Conn, code int) {
+		t.Helper()
+		_, _, err := conn.ReadMessage()
+		var closeErr *CloseError
+		require.True(t, errors.As(err, &closeErr), "%v", err)
+		assert.Equal(t, code, closeErr.Code)
+	}
+
+	// Test: Read limit
+	_, conn := dial(t, addr, "")
+	require.NoError(t, conn.WriteMessage(BinaryMessage, bytes.Repeat([]byte("x"), 17)))
+	expectClose(conn, CloseMessageTooBig)
+
+	// Test: Invalid UTF-8 text
+	_, conn = dial(t, addr, "")
+	require.NoError(t, conn.WriteMessage(TextMessage, []byte{0xff, 0xfe}))
+	expectClose(conn, CloseInvalidPayload)
+
+	// Test: Unmasked client frame
+	_, conn = dial(t, addr, "")
+	conn.conn.Write(appendFrame(nil, &frame{fin: true, opcode: opText, payload: []byte("hi")}, false, [4]byte{}))
+	expectClose(conn, CloseProtocolError)
+
+	// Test: Continuation without a message
+	_, conn = dial(t, addr, "")
+	require.NoError(t, conn.writeFrame(&frame{fin: true, opcode: opContinuation, payload: []byte("hi")}))
+	expectClose(conn, CloseProtocolError)
+
+	// Test: Compressed frame without negotiation
+	_, conn = dial(t, addr, "")
+	require.NoError(t, conn.writeFrame(&frame{fin: true, rsv1: true, opcode: opText, payload: []byte("hi")}))
+	expectClose(conn, CloseProtocolError)
+}
+
+func TestCompression(t *testing.T) {
+	addr := echoServer(t, &Upgrader{EnableCompression: true, ReadLimit: 4096})
+
+	// Test: Negotiation
+	head, conn := dial(t, addr, "Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n")
+	assert.Contains(t, head, "sec-websocket-extensions: permessage-deflate; server_no_context_takeover; client_no_context_takeover\r\n")
+	require.True(t, conn.Compressed())
+
+	// Test: Compressed round trip of a message larger than its frame
+	message := bytes.Repeat([]byte("compress me "), 200)
+	require.NoError(t, conn.WriteMessage(TextMessage, message))
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, message, data)
+
+	// Test: Decompression is bounded by the read limit
+	require.NoError(t, conn.WriteMessage(BinaryMessage, make([]byte, 10000)))
+	_, _, err = conn.ReadMessage()
+	var closeErr *CloseError
+	require.True(t, errors.As(err, &closeErr), "%v", err)
+	assert.Equal(t, CloseMessageTooBig, closeErr.Code)
+
+	// Test: Offers with a smaller server window are declined
+	head, conn = dial(t, addr, "Sec-WebSocket-Extensions: permessage-deflate; server_max_window_bits=10\r\n")
+	assert.NotContains(t, head, "sec-websocket-extensions")
+	assert.False(t, conn.Compressed())
+}